@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/miekg/dns"
+)
+
+// axfrChunkSize is the number of records sent per message of a zone transfer
+const axfrChunkSize = 100
+
+// axfrACL are the client networks allowed to transfer the cache with -allow-axfr
+var axfrACL []*net.IPNet
+
+// Function to parse the comma separated -axfr-acl networks, accepting plain addresses too
+func parseACL(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// Function to check if a client address is in one of the networks
+func aclAllows(acl []*net.IPNet, ip net.IP) bool {
+	for _, network := range acl {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to stream every cached record as the -axfr-zone zone, bracketed by its SOA
+func handleAXFR(db *sql.DB, writer dns.ResponseWriter, request *dns.Msg) {
+	question := request.Question[0]
+	zone := strings.ToLower(dns.Fqdn(axfrZone))
+	refuse := func(reason string) {
+		countRejected("refused", reason)
+		response := new(dns.Msg)
+		response.SetRcode(request, dns.RcodeRefused)
+		if err := writer.WriteMsg(response); err != nil {
+			log.Printf("Error writing DNS response: %s\n", err)
+		}
+	}
+	switch {
+	case !allowAXFR || db == nil:
+		refuse("axfr_disabled")
+		return
+	case isUDP(writer):
+		// Zone transfers only run over TCP
+		refuse("axfr_udp")
+		return
+	case !aclAllows(axfrACL, clientIP(writer)):
+		refuse("axfr_acl")
+		return
+	case strings.ToLower(question.Name) != zone:
+		refuse("axfr_zone")
+		return
+	}
+
+	resolutions, err := dbfunc.ListResolutions(db)
+	if err != nil {
+		log.Printf("Error listing resolutions for AXFR: %s\n", err)
+		response := new(dns.Msg)
+		response.SetRcode(request, dns.RcodeServerFailure)
+		writer.WriteMsg(response)
+		return
+	}
+
+	soa := zoneSOA(zone)
+	records := []dns.RR{soa}
+	for _, resolution := range resolutions {
+		// Only names inside the zone belong in its transfer
+		if !dns.IsSubDomain(zone, strings.ToLower(dns.Fqdn(resolution.Domain))) {
+			continue
+		}
+		if rr := resolution.ToRR(); rr != nil {
+			records = append(records, rr)
+		}
+	}
+	records = append(records, soa)
+
+	envelopes := make(chan *dns.Envelope)
+	// Closed when Out returns, so the sender stops when a write to the client fails
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(envelopes)
+		for start := 0; start < len(records); start += axfrChunkSize {
+			end := start + axfrChunkSize
+			if end > len(records) {
+				end = len(records)
+			}
+			select {
+			case envelopes <- &dns.Envelope{RR: records[start:end]}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	transfer := new(dns.Transfer)
+	if err := transfer.Out(writer, request, envelopes); err != nil {
+		log.Printf("Error sending AXFR of %s: %s\n", zone, err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/miekg/dns"
+)
+
+// Function to allow AXFR of zone for loopback clients for the rest of a test
+func allowTestAXFR(t *testing.T, zone string) {
+	t.Helper()
+	acl, err := parseACL("127.0.0.1")
+	if err != nil {
+		t.Fatalf("parseACL: %s", err)
+	}
+	allowAXFR, axfrACL, axfrZone = true, acl, zone
+	t.Cleanup(func() { allowAXFR, axfrACL, axfrZone = false, nil, "cache.dnstoy" })
+}
+
+func TestAXFRTransfersZone(t *testing.T) {
+	db := newTestDB(t)
+	allowTestAXFR(t, "test.local")
+	for _, r := range []dbfunc.Resolution{
+		{Domain: "nas.test.local", IP: "192.168.1.2", Static: true},
+		{Domain: "printer.test.local", IP: "192.168.1.3", Static: true},
+		{Domain: "example.com", IP: "192.0.2.1", TTL: 300},
+	} {
+		if err := dbfunc.AddToDatabase(db, r); err != nil {
+			t.Fatalf("AddToDatabase(%s): %s", r.Domain, err)
+		}
+	}
+	server := startTCPServer(t, handleDNSRequest(db))
+
+	request := new(dns.Msg)
+	request.SetAxfr("test.local.")
+	envelopes, err := new(dns.Transfer).In(request, server)
+	if err != nil {
+		t.Fatalf("Transfer.In: %s", err)
+	}
+	var names []string
+	soas := 0
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			t.Fatalf("transfer failed: %s", envelope.Error)
+		}
+		for _, rr := range envelope.RR {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				soas++
+				continue
+			}
+			names = append(names, rr.Header().Name)
+		}
+	}
+	slices.Sort(names)
+	// example.com. is cached but outside the zone, so it isn't transferred
+	if want := []string{"nas.test.local.", "printer.test.local."}; !slices.Equal(names, want) {
+		t.Errorf("transferred %v, want %v", names, want)
+	}
+	if soas != 2 {
+		t.Errorf("transfer had %d SOA records, want one at each end", soas)
+	}
+}
+
+func TestAXFRSenderStopsWhenWriteFails(t *testing.T) {
+	db := newTestDB(t)
+	allowTestAXFR(t, "test.local")
+	// More records than fit one message, so the sender still has some left when the write fails
+	for i := 0; i < axfrChunkSize*3; i++ {
+		r := dbfunc.Resolution{Domain: fmt.Sprintf("host%d.test.local", i), IP: "192.168.1.2", Static: true}
+		if err := dbfunc.AddToDatabase(db, r); err != nil {
+			t.Fatalf("AddToDatabase: %s", err)
+		}
+	}
+	request := new(dns.Msg)
+	request.SetAxfr("test.local.")
+	before := runtime.NumGoroutine()
+	handleAXFR(db, &failingWriter{}, request)
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left after a failed transfer, want %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// failingWriter is a TCP client whose connection is gone, every write fails
+type failingWriter struct{ testWriter }
+
+func (w *failingWriter) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+}
+func (w *failingWriter) WriteMsg(m *dns.Msg) error { return net.ErrClosed }
+func (w *failingWriter) TsigStatus() error         { return nil }
+func (w *failingWriter) TsigTimersOnly(bool)       {}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/blocklist"
+	"github.com/miekg/dns"
+)
+
+// Lists are swapped in whole when they are reloaded, so queries never see a half loaded one
+var (
+	blockList atomic.Pointer[blocklist.List] // Domains answered with the -block-mode response
+	allowList atomic.Pointer[blocklist.List] // Domains that are never blocked, even when on the blocklist
+)
+
+// Function to load the -blocklist and -allowlist sources, files or http(s) URLs, keeping
+// the lists in use when one of them fails to load
+func loadBlockLists() error {
+	var blocked, allowed *blocklist.List
+	var err error
+	if blocklistFile != "" {
+		if blocked, err = blocklist.LoadSources(blocklistFile, listCacheDir); err != nil {
+			return err
+		}
+	}
+	if allowlistFile != "" {
+		if allowed, err = blocklist.LoadSources(allowlistFile, listCacheDir); err != nil {
+			return err
+		}
+	}
+	if blocklistFile != "" {
+		log.Printf("Loaded %d blocked domains from %s\n", blocked.Len(), blocklistFile)
+	}
+	blockList.Store(blocked)
+	allowList.Store(allowed)
+	return nil
+}
+
+// Function to load the block lists again on SIGHUP
+func reloadBlockListsOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		if err := loadBlockLists(); err != nil {
+			log.Printf("Error reloading block lists, keeping the current ones: %s\n", err)
+		}
+	}
+}
+
+// Function to load the block lists again every interval for -blocklist-refresh-interval,
+// logging how many blocked domains came and went
+func refreshBlockLists(interval time.Duration) {
+	ticker := appClock.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C() {
+		previous := blockList.Load()
+		if err := loadBlockLists(); err != nil {
+			log.Printf("Error refreshing block lists, keeping the current ones: %s\n", err)
+			continue
+		}
+		added, removed := previous.Diff(blockList.Load())
+		log.Printf("Refreshed block lists: %d domains added, %d removed\n", added, removed)
+	}
+}
+
+// Function to check if a queried name should be blocked
+func isBlocked(name string) bool {
+	return blockList.Load().Contains(name) && !allowList.Load().Contains(name)
+}
+
+// Function to answer a blocked question according to -block-mode
+func answerBlocked(response *dns.Msg, question dns.Question) {
+	switch blockMode {
+	case "nxdomain":
+		response.Rcode = dns.RcodeNameError
+	case "refused":
+		response.Rcode = dns.RcodeRefused
+	default:
+		// Null route the name so each question in the message is answered on its own
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: serveTTL(defaultTTL)}
+		switch question.Qtype {
+		case dns.TypeA:
+			response.Answer = append(response.Answer, &dns.A{Hdr: hdr, A: net.IPv4zero})
+		case dns.TypeAAAA:
+			response.Answer = append(response.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBlockListsRefreshOnInterval(t *testing.T) {
+	fake := useFakeClock(t, time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	var body atomic.Value
+	body.Store("ads.example\ntracker.example\n")
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write([]byte(body.Load().(string)))
+	}))
+	defer server.Close()
+	oldCacheDir := listCacheDir
+	blocklistFile, listCacheDir = server.URL+"/hosts.txt", t.TempDir()
+	t.Cleanup(func() {
+		blocklistFile, listCacheDir = "", oldCacheDir
+		blockList.Store(nil)
+	})
+	if err := loadBlockLists(); err != nil {
+		t.Fatalf("loadBlockLists: %s", err)
+	}
+
+	go refreshBlockLists(time.Hour)
+	for fake.Tickers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The feed drops one domain and adds another, which only shows once the interval has passed
+	body.Store("tracker.example\nmalware.example\n")
+	fake.Advance(59 * time.Minute)
+	time.Sleep(50 * time.Millisecond)
+	if got := fetches.Load(); got != 1 || !isBlocked("ads.example.") {
+		t.Fatalf("list fetched %d times before the interval, want only the initial load", got)
+	}
+
+	fake.Advance(time.Minute)
+	deadline := time.Now().Add(2 * time.Second)
+	for !isBlocked("malware.example.") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !isBlocked("malware.example.") || isBlocked("ads.example.") || !isBlocked("tracker.example.") {
+		t.Errorf("after the interval malware %v, ads %v, tracker %v blocked, want the new list", isBlocked("malware.example."), isBlocked("ads.example."), isBlocked("tracker.example."))
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	catchAllV4 net.IP // Address every A query is answered with by -catch-all, nil when unset
+	catchAllV6 net.IP // Address every AAAA query is answered with by -catch-all, nil when unset
+)
+
+// Function to parse -catch-all, an IPv4 address, an IPv6 address or one of each separated by a comma
+func parseCatchAll(value string) (net.IP, net.IP, error) {
+	var v4, v6 net.IP
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		ip := net.ParseIP(entry)
+		switch {
+		case ip == nil:
+			return nil, nil, fmt.Errorf("%q is not an IP address", entry)
+		case ip.To4() != nil && v4 == nil:
+			v4 = ip.To4()
+		case ip.To4() == nil && v6 == nil:
+			v6 = ip
+		default:
+			return nil, nil, fmt.Errorf("more than one address of the family of %s", entry)
+		}
+	}
+	return v4, v6, nil
+}
+
+// Function to answer an A or AAAA question with the -catch-all address whatever the name,
+// returning false for other questions. Without an address of the asked family the answer is empty
+func answerCatchAll(response *dns.Msg, question dns.Question) bool {
+	if catchAllV4 == nil && catchAllV6 == nil {
+		return false
+	}
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: serveTTL(defaultTTL)}
+	switch question.Qtype {
+	case dns.TypeA:
+		if catchAllV4 != nil {
+			response.Answer = append(response.Answer, &dns.A{Hdr: hdr, A: catchAllV4})
+		}
+	case dns.TypeAAAA:
+		if catchAllV6 != nil {
+			response.Answer = append(response.Answer, &dns.AAAA{Hdr: hdr, AAAA: catchAllV6})
+		}
+	default:
+		return false
+	}
+	response.Authoritative = true
+	return true
+}
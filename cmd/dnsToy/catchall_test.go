@@ -0,0 +1,76 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/miekg/dns"
+)
+
+func TestParseCatchAll(t *testing.T) {
+	for _, test := range []struct {
+		value  string
+		v4, v6 string
+		ok     bool
+	}{
+		{"192.0.2.80", "192.0.2.80", "<nil>", true},
+		{"2001:db8::80", "<nil>", "2001:db8::80", true},
+		{"192.0.2.80, 2001:db8::80", "192.0.2.80", "2001:db8::80", true},
+		{"192.0.2.80,192.0.2.81", "", "", false},
+		{"portal.example", "", "", false},
+	} {
+		v4, v6, err := parseCatchAll(test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("parseCatchAll(%q) error %v, want ok %v", test.value, err, test.ok)
+			continue
+		}
+		if test.ok && (v4.String() != test.v4 || v6.String() != test.v6) {
+			t.Errorf("parseCatchAll(%q) = %s, %s, want %s, %s", test.value, v4, v6, test.v4, test.v6)
+		}
+	}
+}
+
+func TestCatchAllAnswersEveryName(t *testing.T) {
+	db := newTestDB(t)
+	var asked atomic.Int32
+	useStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		asked.Add(1)
+		answerStubA(writer, request)
+	})
+	v4, v6, err := parseCatchAll("192.0.2.80,2001:db8::80")
+	if err != nil {
+		t.Fatalf("parseCatchAll: %s", err)
+	}
+	catchAllV4, catchAllV6 = v4, v6
+	t.Cleanup(func() { catchAllV4, catchAllV6 = nil, nil })
+
+	for _, name := range []string{"example.com.", "anything.at.all.test.", "login.bank.example."} {
+		for qtype, want := range map[uint16]string{dns.TypeA: "192.0.2.80", dns.TypeAAAA: "2001:db8::80"} {
+			request := new(dns.Msg)
+			request.SetQuestion(name, qtype)
+			writer := newTestWriter()
+			resolveDNSRequest(db)(writer, request)
+			if len(writer.msg.Answer) != 1 || !writer.msg.Authoritative {
+				t.Errorf("%s %s answered %v (aa %v), want one authoritative record", name, dns.TypeToString[qtype], writer.msg.Answer, writer.msg.Authoritative)
+				continue
+			}
+			var got string
+			switch rr := writer.msg.Answer[0].(type) {
+			case *dns.A:
+				got = rr.A.String()
+			case *dns.AAAA:
+				got = rr.AAAA.String()
+			}
+			if got != want {
+				t.Errorf("%s %s answered %s, want the catch-all %s", name, dns.TypeToString[qtype], got, want)
+			}
+		}
+	}
+	if got := asked.Load(); got != 0 {
+		t.Errorf("upstream asked %d times, want never", got)
+	}
+	if _, err := dbfunc.GetFromDatabase(db, "example.com."); err != dbfunc.ErrNotFound {
+		t.Errorf("catch-all answer was stored in the database: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/blocklist"
+	"github.com/miekg/dns"
+)
+
+var (
+	injectDelayList *blocklist.List // Domains that -inject-delay is scoped to, nil for every domain
+	dropList        *blocklist.List // Domains that -drop-rate is scoped to, nil for every domain
+
+	chaosRand      = rand.New(rand.NewSource(time.Now().UnixNano())) // Source for -drop-rate decisions
+	chaosRandMutex sync.Mutex                                        // Guards chaosRand, which isn't safe for concurrent use
+)
+
+// Function to turn a comma separated list of domains into a list matching them and their subdomains
+func parseDomainList(value string) *blocklist.List {
+	if value == "" {
+		return nil
+	}
+	list := blocklist.New()
+	for _, domain := range strings.Split(value, ",") {
+		list.Add(strings.TrimSpace(domain))
+	}
+	return list
+}
+
+// Function to check if any question in the request matches a chaos scope list, a nil list matches everything
+func chaosScopeMatches(list *blocklist.List, request *dns.Msg) bool {
+	if list == nil {
+		return true
+	}
+	for _, question := range request.Question {
+		if list.Contains(question.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to get the artificial delay to apply before answering a request
+func injectedDelay(request *dns.Msg) time.Duration {
+	if injectDelay <= 0 || !chaosScopeMatches(injectDelayList, request) {
+		return 0
+	}
+	return injectDelay
+}
+
+// Function to decide if a request should be dropped without a response to simulate packet loss
+func shouldDrop(request *dns.Msg) bool {
+	if dropRate <= 0 || !chaosScopeMatches(dropList, request) {
+		return false
+	}
+	chaosRandMutex.Lock()
+	defer chaosRandMutex.Unlock()
+	return chaosRand.Float64() < dropRate
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestInjectDelayScope(t *testing.T) {
+	db := newTestDB(t)
+	disableLookups(t)
+	injectDelay, injectDelayList = 100*time.Millisecond, parseDomainList("slow.example, slower.example")
+	t.Cleanup(func() { injectDelay, injectDelayList = 0, nil })
+
+	for _, test := range []struct {
+		name    string
+		delayed bool
+	}{
+		{"slow.example.", true},
+		{"www.slower.example.", true},
+		{"fast.example.", false},
+		{"notslow.example.", false},
+	} {
+		request := new(dns.Msg)
+		request.SetQuestion(test.name, dns.TypeA)
+		if got := injectedDelay(request) > 0; got != test.delayed {
+			t.Errorf("%s delayed %t, want %t", test.name, got, test.delayed)
+		}
+		start := time.Now()
+		resolveDNSRequest(db)(newTestWriter(), request)
+		if elapsed := time.Since(start); (elapsed >= injectDelay) != test.delayed {
+			t.Errorf("%s answered after %s with a %s delay, want delayed %t", test.name, elapsed, injectDelay, test.delayed)
+		}
+	}
+
+	// Without a scope every name is delayed
+	injectDelayList = nil
+	request := new(dns.Msg)
+	request.SetQuestion("fast.example.", dns.TypeA)
+	if delay := injectedDelay(request); delay != injectDelay {
+		t.Errorf("unscoped delay for fast.example. = %s, want %s", delay, injectDelay)
+	}
+}
+
+func TestDropRateFraction(t *testing.T) {
+	dropRate, dropList = 0.3, parseDomainList("lossy.example")
+	chaosRand = rand.New(rand.NewSource(1))
+	t.Cleanup(func() {
+		dropRate, dropList = 0, nil
+		chaosRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	})
+	handler := dropForTesting(dns.HandlerFunc(func(writer dns.ResponseWriter, request *dns.Msg) {
+		response := new(dns.Msg)
+		writer.WriteMsg(response.SetReply(request))
+	}))
+	dropped := func(name string) int {
+		count := 0
+		for i := 0; i < 10000; i++ {
+			request := new(dns.Msg)
+			request.SetQuestion(name, dns.TypeA)
+			writer := newTestWriter()
+			handler.ServeDNS(writer, request)
+			if writer.msg == nil {
+				count++
+			}
+		}
+		return count
+	}
+
+	// The seeded source makes the run repeatable, so the bounds can be tight
+	if got := dropped("www.lossy.example."); got < 2800 || got > 3200 {
+		t.Errorf("dropped %d of 10000 queries at -drop-rate 0.3, want about 3000", got)
+	}
+	if got := dropped("other.example."); got != 0 {
+		t.Errorf("dropped %d queries outside -drop-domains, want none", got)
+	}
+}
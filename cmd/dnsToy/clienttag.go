@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// unfilteredTags are the -unfiltered-tags values whose clients bypass the block lists
+var unfilteredTags map[string]bool
+
+// Function to parse the comma separated -unfiltered-tags values
+func parseClientTags(value string) map[string]bool {
+	tags := make(map[string]bool)
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags[tag] = true
+		}
+	}
+	return tags
+}
+
+// Function to read the client's tag from the -client-tag-option EDNS0 local option, empty when untagged
+func clientTag(request *dns.Msg) string {
+	opt := request.IsEdns0()
+	if clientTagOption == 0 || opt == nil {
+		return ""
+	}
+	for _, option := range opt.Option {
+		if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == uint16(clientTagOption) {
+			return string(local.Data)
+		}
+	}
+	return ""
+}
+
+// Function to check if the block lists apply to a request, clients tagged with one of the
+// -unfiltered-tags get unfiltered answers
+func filterClient(request *dns.Msg) bool {
+	tag := clientTag(request)
+	return tag == "" || !unfilteredTags[tag]
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/chaoticcyber/dnsToy/internal/blocklist"
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/miekg/dns"
+)
+
+func TestParseClientTags(t *testing.T) {
+	tags := parseClientTags(" kids, ,adults,")
+	if len(tags) != 2 || !tags["kids"] || !tags["adults"] {
+		t.Errorf("parseClientTags = %v, want kids and adults", tags)
+	}
+}
+
+func TestClientTagSelectsFiltering(t *testing.T) {
+	db := newTestDB(t)
+	disableLookups(t)
+	if err := dbfunc.AddToDatabase(db, dbfunc.Resolution{Domain: "ads.example.", IP: "192.0.2.7", TTL: 300}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	list := blocklist.New()
+	list.Add("ads.example")
+	blockList.Store(list)
+	clientTagOption, unfilteredTags = 65001, parseClientTags("admin")
+	t.Cleanup(func() {
+		blockList.Store(nil)
+		clientTagOption, unfilteredTags = 0, nil
+	})
+
+	for _, test := range []struct {
+		name   string
+		code   uint16 // EDNS0 local option carrying the tag, 0 for an untagged query
+		tag    string
+		answer string
+	}{
+		{"untagged", 0, "", "0.0.0.0"},
+		{"tagged for filtering", 65001, "kids", "0.0.0.0"},
+		{"tagged unfiltered", 65001, "admin", "192.0.2.7"},
+		// The tag only counts in the configured option
+		{"tag in another option", 65002, "admin", "0.0.0.0"},
+	} {
+		request := new(dns.Msg)
+		request.SetQuestion("ads.example.", dns.TypeA)
+		if test.code != 0 {
+			request.SetEdns0(1232, false)
+			opt := request.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: test.code, Data: []byte(test.tag)})
+		}
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		if got := answerIPs(writer.msg); len(got) != 1 || got[0] != test.answer {
+			t.Errorf("%s query answered %v, want %s", test.name, got, test.answer)
+		}
+	}
+}
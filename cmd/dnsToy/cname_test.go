@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Function to answer with one CNAME per query: loop-a and loop-b point at each other, and
+// hopN.<length>.chain points at hopN+1 until hop<length> has an A record
+func answerStubCNAMEs(writer dns.ResponseWriter, request *dns.Msg) {
+	response := new(dns.Msg)
+	response.SetReply(request)
+	name := request.Question[0].Name
+	hdr := dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}
+	var hop, length int
+	switch {
+	case name == "loop-a.example.":
+		response.Answer = append(response.Answer, &dns.CNAME{Hdr: hdr, Target: "loop-b.example."})
+	case name == "loop-b.example.":
+		response.Answer = append(response.Answer, &dns.CNAME{Hdr: hdr, Target: "loop-a.example."})
+	case strings.HasSuffix(name, ".chain."):
+		fmt.Sscanf(name, "hop%d.%d.chain.", &hop, &length)
+		if hop < length {
+			response.Answer = append(response.Answer, &dns.CNAME{Hdr: hdr, Target: fmt.Sprintf("hop%d.%d.chain.", hop+1, length)})
+		} else {
+			hdr.Rrtype = dns.TypeA
+			response.Answer = append(response.Answer, &dns.A{Hdr: hdr, A: net.IPv4(192, 0, 2, 1)})
+		}
+	}
+	writer.WriteMsg(response)
+}
+
+func TestCNAMEChains(t *testing.T) {
+	db := newTestDB(t)
+	useStubUpstream(t, answerStubCNAMEs)
+	for _, test := range []struct {
+		name  string
+		rcode int
+	}{
+		{"loop-a.example.", dns.RcodeServerFailure},
+		{"hop0.3.chain.", dns.RcodeSuccess},
+		// Following maxCNAMEHops-1 CNAMEs visits exactly maxCNAMEHops names
+		{fmt.Sprintf("hop0.%d.chain.", maxCNAMEHops-1), dns.RcodeSuccess},
+		{fmt.Sprintf("hop0.%d.chain.", maxCNAMEHops), dns.RcodeServerFailure},
+		{"hop0.100.chain.", dns.RcodeServerFailure},
+	} {
+		request := new(dns.Msg)
+		request.SetQuestion(test.name, dns.TypeA)
+		writer := newTestWriter()
+		done := make(chan struct{})
+		go func() {
+			resolveDNSRequest(db)(writer, request)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: handler still chasing the chain", test.name)
+		}
+		if writer.msg.Rcode != test.rcode {
+			t.Errorf("%s: rcode %s, want %s", test.name, dns.RcodeToString[writer.msg.Rcode], dns.RcodeToString[test.rcode])
+		}
+		if test.rcode == dns.RcodeServerFailure && len(writer.msg.Answer) != 0 {
+			t.Errorf("%s: SERVFAIL carries a partial answer %v", test.name, writer.msg.Answer)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+
+	"github.com/chaoticcyber/dnsToy/internal/metrics"
+	"github.com/miekg/dns"
+)
+
+// cookieSecret keys the server cookies handed out by -dns-cookies, it is regenerated on every start
+var cookieSecret = newCookieSecret()
+
+func newCookieSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// Function to find the COOKIE option in a message, if any
+func findCookie(msg *dns.Msg) *dns.EDNS0_COOKIE {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if cookie, ok := option.(*dns.EDNS0_COOKIE); ok {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// Function to compute the 8 byte server cookie for a client cookie and client address (RFC 7873)
+func serverCookie(clientCookie []byte, clientIP net.IP) []byte {
+	mac := hmac.New(sha256.New, cookieSecret)
+	mac.Write(clientCookie)
+	mac.Write(clientIP)
+	return mac.Sum(nil)[:8]
+}
+
+// Function to check the request's cookie, returning the client cookie to answer with
+// and false when the option is malformed and the request must get FORMERR
+func checkCookie(request *dns.Msg, clientIP net.IP) ([]byte, bool) {
+	cookie := findCookie(request)
+	if cookie == nil {
+		return nil, true
+	}
+	raw, err := hex.DecodeString(cookie.Cookie)
+	// A client cookie is 8 bytes, optionally followed by an 8 to 32 byte server cookie
+	if err != nil || len(raw) < 8 || (len(raw) > 8 && (len(raw) < 16 || len(raw) > 40)) {
+		return nil, false
+	}
+	clientCookie := raw[:8]
+	if len(raw) > 8 && !hmac.Equal(raw[8:], serverCookie(clientCookie, clientIP)) {
+		// A stale or forged server cookie is treated as if only the client cookie was sent
+		metrics.Inc("dnstoy_cookie_invalid_total")
+	}
+	return clientCookie, true
+}
+
+// Function to check if the request carries a server cookie this server issued to the client,
+// which proves the client owns its source address
+func hasServerCookie(request *dns.Msg, clientIP net.IP) bool {
+	cookie := findCookie(request)
+	if !dnsCookies || cookie == nil {
+		return false
+	}
+	raw, err := hex.DecodeString(cookie.Cookie)
+	if err != nil || len(raw) < 16 || len(raw) > 40 {
+		return false
+	}
+	return hmac.Equal(raw[8:], serverCookie(raw[:8], clientIP))
+}
+
+// Function to add the COOKIE option with a fresh server cookie to the response
+func appendCookie(response, request *dns.Msg, clientCookie []byte, clientIP net.IP) {
+	opt := response.IsEdns0()
+	if opt == nil {
+		response.SetEdns0(advertisedUDPSize(request), false)
+		opt = response.IsEdns0()
+	}
+	full := append(append([]byte(nil), clientCookie...), serverCookie(clientCookie, clientIP)...)
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(full)})
+}
+
+// Function to get the IP address of the client that sent a request
+func clientIP(writer dns.ResponseWriter) net.IP {
+	switch addr := writer.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/chaoticcyber/dnsToy/internal/metrics"
+	"github.com/miekg/dns"
+)
+
+// Function to send a query carrying the hex cookie and return the response
+func queryWithCookie(t *testing.T, handler dns.HandlerFunc, cookie string) *dns.Msg {
+	t.Helper()
+	request := new(dns.Msg)
+	request.SetQuestion("cookie.example.", dns.TypeA)
+	request.SetEdns0(1232, false)
+	if cookie != "" {
+		opt := request.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	}
+	writer := newTestWriter()
+	handler(writer, request)
+	if writer.msg == nil {
+		t.Fatal("no response written")
+	}
+	return writer.msg
+}
+
+func TestCookieEcho(t *testing.T) {
+	db := newTestDB(t)
+	disableLookups(t)
+	dnsCookies = true
+	t.Cleanup(func() { dnsCookies = false })
+	handler := resolveDNSRequest(db)
+	const client = "0102030405060708"
+
+	// The first answer echoes the client cookie with a server cookie appended
+	response := queryWithCookie(t, handler, client)
+	cookie := findCookie(response)
+	if cookie == nil || len(cookie.Cookie) != 32 || !strings.HasPrefix(cookie.Cookie, client) {
+		t.Fatalf("answer carries cookie %v, want %s followed by an 8 byte server cookie", cookie, client)
+	}
+
+	// Sent back, the full cookie is accepted and the same one returned
+	invalid := metrics.Get("dnstoy_cookie_invalid_total")
+	if again := findCookie(queryWithCookie(t, handler, cookie.Cookie)); again == nil || again.Cookie != cookie.Cookie {
+		t.Errorf("second answer carries cookie %v, want %s", again, cookie.Cookie)
+	}
+	if got := metrics.Get("dnstoy_cookie_invalid_total"); got != invalid {
+		t.Errorf("a server cookie this server issued was counted invalid")
+	}
+
+	// A forged server cookie is counted and replaced with the right one
+	if forged := findCookie(queryWithCookie(t, handler, client+"0000000000000000")); forged == nil || forged.Cookie != cookie.Cookie {
+		t.Errorf("answer to a forged server cookie carries %v, want %s", forged, cookie.Cookie)
+	}
+	if got := metrics.Get("dnstoy_cookie_invalid_total"); got != invalid+1 {
+		t.Errorf("dnstoy_cookie_invalid_total = %v after a forged server cookie, want %v", got, invalid+1)
+	}
+
+	// A client cookie shorter than 8 bytes is malformed
+	if response := queryWithCookie(t, handler, "01020304"); response.Rcode != dns.RcodeFormatError {
+		t.Errorf("short cookie answered %s, want FORMERR", dns.RcodeToString[response.Rcode])
+	}
+
+	// Without -dns-cookies no cookie is returned
+	dnsCookies = false
+	if cookie := findCookie(queryWithCookie(t, handler, client)); cookie != nil {
+		t.Errorf("answer without -dns-cookies carries cookie %v", cookie)
+	}
+}
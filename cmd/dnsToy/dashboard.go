@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+)
+
+// dashboardTemplate renders the resolutions table and lookup toggle without any external assets
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>dnsToy</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>dnsToy</h1>
+<p>Queries: {{.Stats.Queries}} &middot; Cache hits: {{.Stats.CacheHits}} &middot; Misses: {{.Stats.CacheMisses}} &middot; Hit ratio: {{printf "%.1f" .HitRatio}}%</p>
+<form method="post" action="/toggle">
+{{if .LookupsEnabled}}
+<p>DNS lookups are <b>enabled</b> <button name="state" value="disable">Disable</button></p>
+{{else}}
+<p>DNS lookups are <b>disabled</b> <button name="state" value="enable">Enable</button></p>
+{{end}}
+</form>
+<table>
+<tr><th>Domain</th><th>IP</th><th>Query count</th><th>TTL</th></tr>
+{{range .Resolutions}}<tr><td>{{.Domain}}</td><td>{{.IP}}</td><td>{{.QueryCount}}</td><td>{{.TTL}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// dashboardPage is the data shown on the dashboard
+type dashboardPage struct {
+	Stats          statsSnapshot
+	HitRatio       float64
+	LookupsEnabled bool
+	Resolutions    []dbfunc.Resolution
+}
+
+// Function to build the dashboard handlers
+func newDashboardMux(db *sql.DB) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		var resolutions []dbfunc.Resolution
+		if db != nil {
+			var err error
+			if resolutions, err = dbfunc.ListResolutions(db); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		page := dashboardPage{Stats: currentStats(), LookupsEnabled: enableDNSLookup.Load(), Resolutions: resolutions}
+		if total := page.Stats.CacheHits + page.Stats.CacheMisses; total > 0 {
+			page.HitRatio = 100 * float64(page.Stats.CacheHits) / float64(total)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardTemplate.Execute(w, page); err != nil {
+			log.Printf("Error rendering dashboard: %s\n", err)
+		}
+	})
+	mux.HandleFunc("/toggle", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		switch r.FormValue("state") {
+		case "enable":
+			enableDNSLookup.Store(true)
+		case "disable":
+			enableDNSLookup.Store(false)
+		default:
+			http.Error(w, "state must be enable or disable", http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	})
+	registerZoneAPI(mux)
+	registerDrainAPI(mux)
+	return mux
+}
+
+// Function to serve the dashboard on -dashboard-addr
+func startDashboard(addr string, db *sql.DB) {
+	mux := newDashboardMux(db)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Error starting dashboard: %s\n", err)
+		}
+	}()
+}
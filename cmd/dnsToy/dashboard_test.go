@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+)
+
+func TestDashboardListsResolutions(t *testing.T) {
+	db := newTestDB(t)
+	if err := dbfunc.AddToDatabase(db, dbfunc.Resolution{Domain: "shown.example", IP: "192.0.2.7", TTL: 300}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	server := httptest.NewServer(newDashboardMux(db))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatalf("GET /: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading dashboard: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("GET / = %s, %q", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	for _, want := range []string{"<td>shown.example.</td>", "<td>192.0.2.7</td>", "DNS lookups are <b>enabled</b>"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("dashboard is missing %q", want)
+		}
+	}
+
+	resp, err = http.Get(server.URL + "/missing")
+	if err != nil {
+		t.Fatalf("GET /missing: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /missing = %s, want 404", resp.Status)
+	}
+}
+
+func TestDashboardToggle(t *testing.T) {
+	t.Cleanup(func() { enableDNSLookup.Store(true) })
+	mux := newDashboardMux(nil)
+	for _, test := range []struct {
+		method, state string
+		status        int
+		enabled       bool
+	}{
+		{http.MethodPost, "disable", http.StatusSeeOther, false},
+		{http.MethodPost, "bogus", http.StatusBadRequest, false},
+		{http.MethodGet, "enable", http.StatusMethodNotAllowed, false},
+		{http.MethodPost, "enable", http.StatusSeeOther, true},
+	} {
+		request := httptest.NewRequest(test.method, "/toggle", strings.NewReader(url.Values{"state": {test.state}}.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, request)
+		if recorder.Code != test.status || enableDNSLookup.Load() != test.enabled {
+			t.Errorf("%s /toggle state=%s = %d with lookups %t, want %d with lookups %t",
+				test.method, test.state, recorder.Code, enableDNSLookup.Load(), test.status, test.enabled)
+		}
+	}
+}
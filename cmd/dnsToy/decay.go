@@ -0,0 +1,20 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+)
+
+// Function to halve the stored query counts every interval for -count-decay-interval
+func runCountDecay(db *sql.DB, interval time.Duration) {
+	ticker := appClock.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C() {
+		if _, err := dbfunc.DecayCounts(db); err != nil {
+			log.Printf("Error decaying query counts: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// dns64Prefix is the NAT64 prefix AAAA answers are synthesized under with -dns64
+var dns64Prefix *net.IPNet
+
+// Function to parse a -dns64-prefix, which RFC 6052 limits to a few IPv6 prefix lengths
+func parseDNS64Prefix(value string) (*net.IPNet, error) {
+	ip, prefix, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() != nil {
+		return nil, fmt.Errorf("%s is not an IPv6 prefix", value)
+	}
+	switch ones, _ := prefix.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+		return prefix, nil
+	}
+	return nil, fmt.Errorf("prefix length must be 32, 40, 48, 56, 64 or 96")
+}
+
+// Function to embed an IPv4 address in the NAT64 prefix as RFC 6052 lays it out,
+// skipping the reserved bits 64 to 71
+func synthesizeIPv6(prefix *net.IPNet, v4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+	ones, _ := prefix.Mask.Size()
+	pos := ones / 8
+	for _, b := range v4.To4() {
+		if pos == 8 {
+			pos++
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
+
+// Function to answer an AAAA question with -dns64, passing real AAAA records through and
+// synthesizing them from the A record when the name has none
+func answerDNS64(db *sql.DB, response *dns.Msg, question dns.Question, lookups bool, subnet *dns.EDNS0_SUBNET) {
+	// Without upstreams only the cached A record is used, as A questions do
+	lookups = lookups && hasUpstreams()
+	if lookups {
+		answer, err := forwardQuestion(question, subnet)
+		if err != nil {
+			log.Println(err)
+			response.Rcode = dns.RcodeServerFailure
+			return
+		}
+		if answer.Rcode != dns.RcodeSuccess {
+			response.Rcode = answer.Rcode
+			return
+		}
+		hasAAAA := false
+		for _, rr := range answer.Answer {
+			hasAAAA = hasAAAA || rr.Header().Rrtype == dns.TypeAAAA
+			rr.Header().Ttl = serveTTL(rr.Header().Ttl)
+		}
+		if hasAAAA {
+			response.Answer = append(response.Answer, answer.Answer...)
+			return
+		}
+	}
+
+	addresses, ttl, _, found := lookupResolution(db, question.Name, lookups)
+	if !found && !lookups && answerCacheOnlyMiss(response) {
+		return
+	}
+	if !found && lookups {
+		ips, resolvedTTL, err := DnsLookup(pickUpstream(), new(dns.Msg), question.Name, subnet)
+		if err != nil {
+			// The name has neither record, so there is nothing to synthesize
+			return
+		}
+		if _, err := storeResolution(db, question.Name, ips, resolvedTTL); err != nil {
+			log.Printf("Error storing resolved IP in database: %s\n", err)
+		}
+		addresses, ttl = nil, resolvedTTL
+		for _, ip := range ips {
+			addresses = append(addresses, ip.String())
+		}
+	}
+	ttl = serveTTL(ttl)
+	for _, address := range addresses {
+		ip := net.ParseIP(address).To4()
+		if ip == nil {
+			continue
+		}
+		response.Answer = append(response.Answer, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: question.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl},
+			AAAA: synthesizeIPv6(dns64Prefix, ip),
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSynthesizeIPv6(t *testing.T) {
+	// The examples of RFC 6052 section 2.4, embedding 192.0.2.33
+	for _, test := range []struct {
+		prefix string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
+	} {
+		prefix, err := parseDNS64Prefix(test.prefix)
+		if err != nil {
+			t.Fatalf("parseDNS64Prefix(%s): %s", test.prefix, err)
+		}
+		if got := synthesizeIPv6(prefix, net.ParseIP("192.0.2.33")); !got.Equal(net.ParseIP(test.want)) {
+			t.Errorf("synthesizeIPv6(%s) = %s, want %s", test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestParseDNS64PrefixRejects(t *testing.T) {
+	for _, value := range []string{"64:ff9b::/33", "192.0.2.0/24", "64:ff9b::"} {
+		if _, err := parseDNS64Prefix(value); err == nil {
+			t.Errorf("parseDNS64Prefix(%s) accepted it", value)
+		}
+	}
+}
+
+func TestDNS64(t *testing.T) {
+	db := newTestDB(t)
+	useStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		question := request.Question[0]
+		response := new(dns.Msg)
+		response.SetReply(request)
+		header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: 300}
+		switch {
+		case question.Qtype == dns.TypeA:
+			response.Answer = append(response.Answer, &dns.A{Hdr: header, A: net.IPv4(192, 0, 2, 33)})
+		case question.Qtype == dns.TypeAAAA && question.Name == "dual.example.":
+			response.Answer = append(response.Answer, &dns.AAAA{Hdr: header, AAAA: net.ParseIP("2001:db8::1")})
+		}
+		writer.WriteMsg(response)
+	})
+	prefix, err := parseDNS64Prefix("64:ff9b::/96")
+	if err != nil {
+		t.Fatalf("parseDNS64Prefix: %s", err)
+	}
+	dns64Prefix = prefix
+	t.Cleanup(func() { dns64Prefix = nil })
+
+	// A v4-only name gets an AAAA made from its A record, a name with its own AAAA keeps it
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{"v4only.example.", "64:ff9b::c000:221"},
+		{"dual.example.", "2001:db8::1"},
+	} {
+		request := new(dns.Msg)
+		request.SetQuestion(test.name, dns.TypeAAAA)
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		if writer.msg.Rcode != dns.RcodeSuccess || len(writer.msg.Answer) != 1 {
+			t.Fatalf("AAAA for %s answered %s %v, want one record", test.name, dns.RcodeToString[writer.msg.Rcode], writer.msg.Answer)
+		}
+		aaaa, ok := writer.msg.Answer[0].(*dns.AAAA)
+		if !ok || !aaaa.AAAA.Equal(net.ParseIP(test.want)) {
+			t.Errorf("AAAA for %s answered %v, want %s", test.name, writer.msg.Answer[0], test.want)
+		}
+	}
+}
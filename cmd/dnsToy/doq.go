@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// doqIdleTimeout closes DoQ connections a client has left idle
+const doqIdleTimeout = 30 * time.Second
+
+// doqErrorProtocol is the DOQ_PROTOCOL_ERROR code a connection is closed with when a client
+// breaks RFC 9250, e.g. by sending a message ID other than 0
+const doqErrorProtocol = 0x2
+
+// doqServer serves DNS over QUIC (RFC 9250) on one -doq-addr address, one query per stream
+type doqServer struct {
+	listener *quic.Listener
+	handler  dns.Handler
+}
+
+// Function to create the DNS over QUIC servers for each comma separated -doq-addr, sharing the
+// -tls-cert certificate with the DNS over TLS listeners
+func newDoQServers(addrs string, handler dns.Handler, reloader *certReloader) ([]*doqServer, error) {
+	var servers []*doqServer
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		config := &tls.Config{GetCertificate: reloader.GetCertificate, MinVersion: tls.VersionTLS13, NextProtos: []string{"doq"}}
+		listener, err := quic.ListenAddr(addr, config, &quic.Config{MaxIdleTimeout: doqIdleTimeout})
+		if err != nil {
+			for _, server := range servers {
+				server.Shutdown()
+			}
+			return nil, err
+		}
+		servers = append(servers, &doqServer{listener: listener, handler: handler})
+	}
+	return servers, nil
+}
+
+// Function to accept DoQ connections until the server is shut down
+func (s *doqServer) serve() {
+	for {
+		conn, err := s.listener.Accept(context.Background())
+		if err != nil {
+			if !errors.Is(err, quic.ErrServerClosed) {
+				log.Printf("Error accepting DoQ connection: %s\n", err)
+			}
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Function to answer every stream a client opens on a connection, each carrying one query
+func (s *doqServer) serveConn(conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go s.serveStream(conn, stream)
+	}
+}
+
+// Function to read the length prefixed query on a stream and hand it to the shared handler
+func (s *doqServer) serveStream(conn quic.Connection, stream quic.Stream) {
+	stream.SetReadDeadline(time.Now().Add(doqIdleTimeout))
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		stream.CancelRead(doqErrorProtocol)
+		stream.Close()
+		return
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		stream.CancelRead(doqErrorProtocol)
+		stream.Close()
+		return
+	}
+	// The header is screened before the message is parsed, as the UDP and TCP servers do
+	if len(buf) < 12 {
+		countRejected("dropped", "header")
+		stream.Close()
+		return
+	}
+	header := dns.Header{
+		Id:      binary.BigEndian.Uint16(buf[0:]),
+		Bits:    binary.BigEndian.Uint16(buf[2:]),
+		Qdcount: binary.BigEndian.Uint16(buf[4:]),
+		Ancount: binary.BigEndian.Uint16(buf[6:]),
+		Nscount: binary.BigEndian.Uint16(buf[8:]),
+		Arcount: binary.BigEndian.Uint16(buf[10:]),
+	}
+	// The ID is always 0 on DoQ, the stream tells the queries apart
+	if header.Id != 0 {
+		conn.CloseWithError(doqErrorProtocol, "message ID must be 0")
+		return
+	}
+	request := new(dns.Msg)
+	if acceptMsg(header) != dns.MsgAccept || request.Unpack(buf) != nil {
+		stream.Close()
+		return
+	}
+	s.handler.ServeDNS(&doqWriter{conn: conn, stream: stream}, request)
+}
+
+// Function to stop accepting DoQ connections
+func (s *doqServer) Shutdown() error {
+	return s.listener.Close()
+}
+
+// doqWriter writes the handler's answer back on the stream the query came in on
+type doqWriter struct {
+	conn   quic.Connection
+	stream quic.Stream
+}
+
+func (w *doqWriter) LocalAddr() net.Addr  { return w.conn.LocalAddr() }
+func (w *doqWriter) RemoteAddr() net.Addr { return w.conn.RemoteAddr() }
+
+// Function to pack and write a response, closing the stream after it as RFC 9250 asks
+func (w *doqWriter) WriteMsg(m *dns.Msg) error {
+	packed, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(packed)
+	return err
+}
+
+// Function to write a packed response with its length prefix and close the stream
+func (w *doqWriter) Write(packed []byte) (int, error) {
+	framed := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(packed)), uint16(len(packed)))
+	if _, err := w.stream.Write(append(framed, packed...)); err != nil {
+		return 0, err
+	}
+	return len(packed), w.stream.Close()
+}
+
+func (w *doqWriter) Close() error        { return w.stream.Close() }
+func (w *doqWriter) TsigStatus() error   { return nil }
+func (w *doqWriter) TsigTimersOnly(bool) {}
+func (w *doqWriter) Hijack()             {}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// Function to write a self-signed certificate for localhost with the given serial number, and its key
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "dnsToy test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %s", err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+}
+
+// Function to write a self-signed certificate and key for 127.0.0.1 and load them
+func newTestCertReloader(t *testing.T) *certReloader {
+	t.Helper()
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCert(t, certFile, keyFile, 1)
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader: %s", err)
+	}
+	return reloader
+}
+
+// Function to send one query on a new stream of a DoQ connection and read the answer
+func exchangeDoQ(conn quic.Connection, query *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	framed := binary.BigEndian.AppendUint16(nil, uint16(len(packed)))
+	if _, err := stream.Write(append(framed, packed...)); err != nil {
+		return nil, err
+	}
+	// Closing our side tells the server the query is complete
+	stream.Close()
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		return nil, err
+	}
+	response := new(dns.Msg)
+	return response, response.Unpack(buf)
+}
+
+func TestDoQResolvesThroughHandler(t *testing.T) {
+	db := newTestDB(t)
+	disableLookups(t)
+	if err := dbfunc.AddToDatabase(db, dbfunc.Resolution{Domain: "quic.example", IP: "192.0.2.53", TTL: 300}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	servers, err := newDoQServers("127.0.0.1:0", resolveDNSRequest(db), newTestCertReloader(t))
+	if err != nil {
+		t.Fatalf("newDoQServers: %s", err)
+	}
+	server := servers[0]
+	go server.serve()
+	t.Cleanup(func() { server.Shutdown() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, server.listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"doq"}}, nil)
+	if err != nil {
+		t.Fatalf("DialAddr: %s", err)
+	}
+	defer conn.CloseWithError(0, "")
+
+	query := new(dns.Msg)
+	query.SetQuestion("quic.example.", dns.TypeA)
+	query.Id = 0
+	response, err := exchangeDoQ(conn, query)
+	if err != nil {
+		t.Fatalf("DoQ exchange: %s", err)
+	}
+	if ips := answerIPs(response); len(ips) != 1 || ips[0] != "192.0.2.53" {
+		t.Errorf("DoQ answered %v, want the stored address", ips)
+	}
+	if response.Truncated {
+		t.Error("DoQ response was truncated like a UDP one")
+	}
+
+	// A nonzero message ID breaks RFC 9250 and closes the connection
+	query.Id = 1
+	if _, err := exchangeDoQ(conn, query); err == nil {
+		t.Error("query with a nonzero ID was answered")
+	}
+}
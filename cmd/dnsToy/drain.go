@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	draining     atomic.Bool           // Set once drain is asked for, new queries are refused from then on
+	inFlight     atomic.Int64          // Queries being answered
+	lastQuery    atomic.Int64          // Unix nanoseconds of the most recent query, refused ones included
+	drained      = make(chan struct{}) // Closed once a drain has gone idle, so main can shut down
+	drainStarter sync.Once             // Makes startDrain take effect once
+)
+
+// Function to note a query arriving, reporting false when the server is draining and the query
+// should be refused. Accepted queries must call finishQuery when they are answered
+func startQuery() bool {
+	lastQuery.Store(appClock.Now().UnixNano())
+	if draining.Load() {
+		return false
+	}
+	inFlight.Add(1)
+	// A drain may have started between the check and the count, so check again
+	if draining.Load() {
+		inFlight.Add(-1)
+		return false
+	}
+	return true
+}
+
+// Function to note a query accepted by startQuery has been answered
+func finishQuery() {
+	inFlight.Add(-1)
+}
+
+// Function to start draining: new queries are refused so load balancers route away, and once
+// nothing is in flight and no query has arrived for -drain-idle, drained is closed
+func startDrain() {
+	drainStarter.Do(func() {
+		draining.Store(true)
+		log.Println("Draining, new queries are refused from now on.")
+		go waitForIdle()
+	})
+}
+
+// Function to close drained once the server has been idle for -drain-idle
+func waitForIdle() {
+	ticker := appClock.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for range ticker.C() {
+		idle := appClock.Now().Sub(time.Unix(0, lastQuery.Load()))
+		if inFlight.Load() == 0 && idle >= drainIdle {
+			close(drained)
+			return
+		}
+	}
+}
+
+// Function to add the POST /drain endpoint to the dashboard
+func registerDrainAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		startDrain()
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, "draining")
+	})
+}
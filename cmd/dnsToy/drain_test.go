@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Function to give a test a server that isn't draining, with a fresh drained channel and
+// drainStarter so startDrain works again, put back the same way afterwards
+func resetDrain(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		draining.Store(false)
+		inFlight.Store(0)
+		lastQuery.Store(0)
+		drained = make(chan struct{})
+		drainStarter = sync.Once{}
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// Function to check whether drained has been closed, waiting up to wait for it
+func isDrained(wait time.Duration) bool {
+	select {
+	case <-drained:
+		return true
+	case <-time.After(wait):
+		return false
+	}
+}
+
+func TestDrain(t *testing.T) {
+	db := newTestDB(t)
+	disableLookups(t)
+	fake := useFakeClock(t, time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	resetDrain(t)
+	handler := refuseWhileDraining(resolveDNSRequest(db))
+	request := new(dns.Msg)
+	request.SetQuestion("drain.example.", dns.TypeA)
+
+	// A query still being answered when the drain starts
+	if !startQuery() {
+		t.Fatal("query refused before the drain")
+	}
+	mux := http.NewServeMux()
+	registerDrainAPI(mux)
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/drain", nil))
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("POST /drain answered %d, want %d", recorder.Code, http.StatusAccepted)
+	}
+	// Asking again doesn't start a second wait
+	startDrain()
+	for fake.Tickers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if got := fake.Tickers(); got != 1 {
+		t.Errorf("%d drain waits running, want 1", got)
+	}
+
+	// Idle long enough, but the accepted query hasn't been answered yet
+	fake.Advance(drainIdle)
+	if isDrained(50 * time.Millisecond) {
+		t.Fatal("drained with a query still in flight")
+	}
+	finishQuery()
+
+	// A refused query still counts as activity, so the idle time starts over from it
+	writer := newTestWriter()
+	handler.ServeDNS(writer, request)
+	if writer.msg == nil || writer.msg.Rcode != dns.RcodeRefused {
+		t.Errorf("query while draining answered %v, want REFUSED", writer.msg)
+	}
+	fake.Advance(100 * time.Millisecond)
+	if isDrained(50 * time.Millisecond) {
+		t.Fatal("drained right after a query arrived")
+	}
+	fake.Advance(drainIdle)
+	if !isDrained(2 * time.Second) {
+		t.Fatal("not drained once idle with nothing in flight")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Function to work out the client subnet (RFC 7871) sent upstream for a request, the client's own
+// ECS option when it sent one, otherwise its address masked to -ecs-prefix, or nil with -no-ecs.
+// A client's option is never passed on more precisely than -ecs-prefix allows, and with -strip-ecs
+// it is dropped so only the subnet derived from the client's address goes upstream
+func clientSubnet(writer dns.ResponseWriter, request *dns.Msg) *dns.EDNS0_SUBNET {
+	if noECS {
+		return nil
+	}
+	if opt := request.IsEdns0(); opt != nil && !stripECS {
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok && (subnet.Family == 1 || subnet.Family == 2) {
+				bits := min(int(subnet.SourceNetmask), familyPrefix(subnet.Family))
+				return maskedSubnet(subnet.Family, subnet.Address, bits)
+			}
+		}
+	}
+	ip := clientIP(writer)
+	// Addresses that mean nothing outside this network aren't worth leaking
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return nil
+	}
+	if ip.To4() != nil {
+		return maskedSubnet(1, ip, familyPrefix(1))
+	}
+	return maskedSubnet(2, ip, familyPrefix(2))
+}
+
+// Function to get the longest prefix sent upstream for an ECS address family, -ecs-prefix for IPv4.
+// IPv6 clients are masked to 32 more bits, so the default of 24 gives the usual /56
+func familyPrefix(family uint16) int {
+	if family == 1 {
+		return ecsPrefix
+	}
+	return ecsPrefix + 32
+}
+
+// Function to build a client subnet option for an address masked to bits
+func maskedSubnet(family uint16, ip net.IP, bits int) *dns.EDNS0_SUBNET {
+	if family == 1 {
+		ip, bits = ip.To4(), min(bits, 32)
+	} else {
+		ip, bits = ip.To16(), min(bits, 128)
+	}
+	if ip == nil {
+		return nil
+	}
+	return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: uint8(bits),
+		Address: ip.Mask(net.CIDRMask(bits, len(ip)*8))}
+}
+
+// Function to add the client subnet to a query going upstream, doing nothing when subnet is nil
+func withSubnet(m *dns.Msg, subnet *dns.EDNS0_SUBNET) {
+	if subnet == nil {
+		return
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, subnet)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// Function to send request through the handler and return the client subnet option of the
+// query it forwarded upstream, nil when it had none
+func forwardedSubnet(t *testing.T, request *dns.Msg) *dns.EDNS0_SUBNET {
+	t.Helper()
+	var mu sync.Mutex
+	var forwarded *dns.EDNS0_SUBNET
+	useStubUpstream(t, func(writer dns.ResponseWriter, query *dns.Msg) {
+		mu.Lock()
+		if opt := query.IsEdns0(); opt != nil {
+			for _, option := range opt.Option {
+				if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+					forwarded = subnet
+				}
+			}
+		}
+		mu.Unlock()
+		answerStubA(writer, query)
+	})
+	resolveDNSRequest(newTestDB(t))(newTestWriter(), request)
+	mu.Lock()
+	defer mu.Unlock()
+	return forwarded
+}
+
+// Function to build an A query carrying the client's own subnet option
+func queryWithSubnet(address string, bits uint8) *dns.Msg {
+	request := new(dns.Msg)
+	request.SetQuestion("ecs.example.", dns.TypeA)
+	request.SetEdns0(dns.DefaultMsgSize, false)
+	ip := net.ParseIP(address)
+	family := uint16(2)
+	if ip.To4() != nil {
+		family = 1
+	}
+	opt := request.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: bits, Address: ip})
+	return request
+}
+
+func TestForwardedSubnetFromClientAddress(t *testing.T) {
+	request := new(dns.Msg)
+	request.SetQuestion("ecs.example.", dns.TypeA)
+	subnet := forwardedSubnet(t, request)
+	if subnet == nil {
+		t.Fatal("forwarded query has no client subnet")
+	}
+	if subnet.SourceNetmask != 24 || !subnet.Address.Equal(net.ParseIP("192.0.2.0")) {
+		t.Errorf("forwarded %s/%d, want 192.0.2.0/24", subnet.Address, subnet.SourceNetmask)
+	}
+}
+
+func TestForwardedSubnetClampsClientOption(t *testing.T) {
+	for _, test := range []struct {
+		address string
+		bits    uint8
+		want    string
+		wantLen uint8
+	}{
+		{"198.51.100.77", 32, "198.51.100.0", 24},
+		{"198.51.100.77", 16, "198.51.0.0", 16},
+		{"2001:db8:1:2ff::1", 128, "2001:db8:1:200::", 56},
+	} {
+		subnet := forwardedSubnet(t, queryWithSubnet(test.address, test.bits))
+		if subnet == nil {
+			t.Errorf("%s/%d: forwarded query has no client subnet", test.address, test.bits)
+			continue
+		}
+		if subnet.SourceNetmask != test.wantLen || !subnet.Address.Equal(net.ParseIP(test.want)) {
+			t.Errorf("%s/%d: forwarded %s/%d, want %s/%d", test.address, test.bits, subnet.Address, subnet.SourceNetmask, test.want, test.wantLen)
+		}
+	}
+}
+
+func TestForwardedSubnetNoECS(t *testing.T) {
+	noECS = true
+	t.Cleanup(func() { noECS = false })
+	if subnet := forwardedSubnet(t, queryWithSubnet("198.51.100.77", 32)); subnet != nil {
+		t.Errorf("-no-ecs forwarded %s/%d", subnet.Address, subnet.SourceNetmask)
+	}
+}
+
+func TestForwardedSubnetStripECS(t *testing.T) {
+	stripECS = true
+	t.Cleanup(func() { stripECS = false })
+	subnet := forwardedSubnet(t, queryWithSubnet("198.51.100.77", 32))
+	if subnet == nil {
+		t.Fatal("-strip-ecs forwarded no client subnet, want the one derived from the client's address")
+	}
+	if subnet.SourceNetmask != 24 || !subnet.Address.Equal(net.ParseIP("192.0.2.0")) {
+		t.Errorf("-strip-ecs forwarded %s/%d, want 192.0.2.0/24 instead of the client's option", subnet.Address, subnet.SourceNetmask)
+	}
+}
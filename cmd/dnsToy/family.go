@@ -0,0 +1,35 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// Function to rank a record for -prefer-family, addresses of the preferred family come first
+// and every other record keeps its place relative to the rest
+func familyRank(rr dns.RR) int {
+	switch rr.Header().Rrtype {
+	case dns.TypeA:
+		if preferFamily == "v6" {
+			return 1
+		}
+	case dns.TypeAAAA:
+		if preferFamily == "v4" {
+			return 1
+		}
+	}
+	return 0
+}
+
+// Function to move the addresses of the -prefer-family family ahead of the other family in a section
+// holding both, such as the answer to an ANY query or upstream glue. Answers to A or AAAA queries
+// only hold their own family, so they are left as they are
+func orderByFamily(records []dns.RR) {
+	if preferFamily == "" {
+		return
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return familyRank(records[i]) < familyRank(records[j])
+	})
+}
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/chaoticcyber/dnsToy/internal/metrics"
+	"github.com/chaoticcyber/dnsToy/internal/rpz"
+	"github.com/miekg/dns"
+)
+
+// cacheInfoOptionCode is the EDNS0 local option used to report -debug-cache-info
+const cacheInfoOptionCode = dns.EDNS0LOCALSTART
+
+// defaultTTL is the TTL advertised for answers served from the database
+const defaultTTL uint32 = 60
+
+// Function to build the handler that answers DNS requests from the database and upstream, or
+// from the root servers down with -recursive, behind the -middleware steps
+func handleDNSRequest(database *sql.DB) dns.Handler {
+	return chainMiddlewares(resolveDNSRequestWith(database, resolveIterative), serverMiddlewares()...)
+}
+
+// Function to build the handler that resolves DNS requests once the middlewares let them through
+func resolveDNSRequest(database *sql.DB) dns.HandlerFunc {
+	return resolveDNSRequestWith(database, nil)
+}
+
+// Function to build the resolving handler with resolve in place of the upstream servers, so it
+// needs no network. A questions missing from the database and forwarded query types go through
+// resolve, DNS64 and service binding lookups still use the upstreams. A nil resolve uses them for everything
+func resolveDNSRequestWith(database *sql.DB, resolve resolveFunc) dns.HandlerFunc {
+	return func(writer dns.ResponseWriter, request *dns.Msg) {
+		// Prepare an empty DNS message to construct the response
+		response := new(dns.Msg)
+		response.SetReply(request)
+		// SetReply only copies the first question, each one is answered on its own below
+		response.Question = append([]dns.Question(nil), request.Question...)
+
+		// A query has to ask something
+		if len(request.Question) == 0 {
+			writeFormatError(writer, request, "no_question")
+			return
+		}
+
+		// Zone transfers of the cache are streamed rather than answered in one message
+		if request.Question[0].Qtype == dns.TypeAXFR {
+			handleAXFR(database, writer, request)
+			return
+		}
+
+		// Validate the client's DNS cookie before doing any work for it
+		var clientCookie []byte
+		if dnsCookies {
+			var valid bool
+			if clientCookie, valid = checkCookie(request, clientIP(writer)); !valid {
+				writeFormatError(writer, request, "bad_cookie")
+				return
+			}
+		}
+
+		// Publicly exposed servers keep spoofed UDP queries from turning into floods of large answers
+		proven := !isUDP(writer) || hasServerCookie(request, clientIP(writer))
+		if hardenPublic {
+			if !proven && !allowUnproven(clientIP(writer)) {
+				countRejected("dropped", "harden_rate")
+				return
+			}
+			for _, question := range request.Question {
+				if question.Qtype == dns.TypeANY {
+					countRejected("refused", "any")
+					response.Rcode = dns.RcodeRefused
+					metrics.Inc("dnstoy_responses_total", "rcode", dns.RcodeToString[response.Rcode])
+					if err := writer.WriteMsg(response); err != nil {
+						log.Printf("Error writing DNS response: %s\n", err)
+					}
+					return
+				}
+			}
+		}
+
+		// Only go upstream when lookups are on, there is an upstream to ask and, with -honor-rd,
+		// the client asked for recursion
+		canResolve := hasUpstreams() || resolve != nil
+		lookups := enableDNSLookup.Load() && canResolve && (!honorRD || request.RecursionDesired)
+		response.RecursionAvailable = enableDNSLookup.Load() && canResolve && !authoritativeOnly
+
+		// While warming up, either fail fast or answer only from what is already cached
+		if warming.Load() {
+			if warmupMode == "servfail" {
+				response.Rcode = dns.RcodeServerFailure
+				logWire("response to", writer, response)
+				if err := writer.WriteMsg(response); err != nil {
+					log.Printf("Error writing DNS response: %s\n", err)
+				}
+				return
+			}
+			lookups = false
+		}
+
+		// Upstream queries carry the client's subnet so CDNs can pick a nearby address
+		subnet := clientSubnet(writer, request)
+
+		// Clients tagged through -client-tag-option can be exempt from the block lists
+		filter := filterClient(request)
+
+		// Track whether the answers came from the database, and the seconds left of the stored TTL, for -debug-cache-info
+		cacheStatus := ""
+		var answerTTL uint32
+
+		// Record the path each question takes for -trace
+		trace := newTrace(request)
+
+		// Iterate through each question in the DNS request message
+		for _, question := range request.Question {
+			// In learning mode the query is only recorded, nothing is resolved or answered
+			if learnOnly {
+				if err := dbfunc.RecordQuery(database, question.Name, dns.TypeToString[question.Qtype]); err != nil {
+					log.Printf("Error recording query for %s: %s\n", question.Name, err)
+				}
+				response.Rcode = dns.RcodeRefused
+				continue
+			}
+			// Only INET questions are resolved, the records we build all assume it
+			switch question.Qclass {
+			case dns.ClassINET:
+			case dns.ClassCHAOS:
+				// Diagnostic queries in the CHAOS class never touch the database or upstream
+				answerChaos(response, question)
+				continue
+			default:
+				countRejected("refused", "qclass")
+				response.Rcode = dns.RcodeRefused
+				continue
+			}
+			trace.add("question", "%s %s", question.Name, dns.TypeToString[question.Qtype])
+			// A honeypot or captive portal answers every address question with its own address
+			if answerCatchAll(response, question) {
+				trace.add("catch-all", "")
+				continue
+			}
+			// Response policy rules come before the blocklist, and a passthru rule exempts the name from it
+			rule := matchRPZ(writer, question.Name)
+			if rule != nil && rule.Action == rpz.ActionDrop {
+				metrics.Inc("dnstoy_rpz_hits_total", "action", rule.Action.String())
+				countRejected("dropped", "rpz")
+				trace.add("rpz", "drop")
+				trace.finish(writer, response)
+				return
+			}
+			if rule != nil && rule.Action != rpz.ActionPassthru {
+				trace.add("rpz", rule.Action.String())
+				answerRPZ(response, question, rule)
+				continue
+			}
+			// The block and allow lists apply to each question on its own
+			if rule == nil && filter && isBlocked(question.Name) {
+				trace.add("blocklist", blockMode)
+				notifyBlocked(clientIP(writer), question.Name)
+				answerBlocked(response, question)
+				continue
+			}
+			// Scheduled domains are blocked outside the time windows they are allowed in
+			if rule == nil && filter && scheduleBlocked(question.Name) {
+				trace.add("schedule", blockMode)
+				notifyBlocked(clientIP(writer), question.Name)
+				answerBlocked(response, question)
+				continue
+			}
+			// Records pushed through the /zone API are answered authoritatively as they are
+			if answerStatic(response, question) {
+				trace.add("static", "")
+				continue
+			}
+			// An authoritative-only server answers its own zones and nothing else
+			if authoritativeOnly {
+				if zone := findLocalZone(question.Name); zone != "" && database != nil {
+					trace.add("local-zone", zone)
+					answerLocalZone(database, response, question, zone)
+					continue
+				}
+				trace.add("refused", "not authoritative")
+				countRejected("refused", "not_authoritative")
+				response.Rcode = dns.RcodeRefused
+				continue
+			}
+			// Without a database every other question is passed straight through to the upstream
+			if database == nil {
+				if lookups {
+					started := appClock.Now()
+					forwardToResponse(response, question, subnet, resolve)
+					trace.add("forward", "%s in %s", dns.RcodeToString[response.Rcode], appClock.Now().Sub(started))
+				} else if !answerCacheOnlyMiss(response) {
+					response.Rcode = dns.RcodeRefused
+				}
+				continue
+			}
+			// Local zones are answered from the database alone, with this server as their authority
+			if zone := findLocalZone(question.Name); zone != "" {
+				trace.add("local-zone", zone)
+				answerLocalZone(database, response, question, zone)
+				continue
+			}
+			// Reverse lookups for the server's own addresses are answered with -self-ptr
+			if question.Qtype == dns.TypePTR && answerSelfPTR(response, question) {
+				trace.add("self-ptr", "")
+				continue
+			}
+			// Reverse lookups for private addresses never leave this server
+			if question.Qtype == dns.TypePTR && localPTR {
+				if ip := reverseToIP(question.Name); ip != nil && isPrivateIP(ip) {
+					trace.add("local-ptr", ip.String())
+					answerLocalPTR(database, response, question, ip)
+					continue
+				}
+			}
+			// IPv6-only clients behind NAT64 get AAAA records made from the A record
+			if question.Qtype == dns.TypeAAAA && dns64Prefix != nil {
+				trace.add("dns64", "")
+				answerDNS64(database, response, question, lookups, subnet)
+				continue
+			}
+			// IPv4-only setups answer AAAA right away so clients fall back to A without waiting
+			if question.Qtype == dns.TypeAAAA && aaaaPolicy != "forward" {
+				trace.add("aaaa-policy", aaaaPolicy)
+				if aaaaPolicy == "nxdomain" {
+					response.Rcode = dns.RcodeNameError
+				}
+				continue
+			}
+			// HTTPS and SVCB records are cached, whatever the -unknown-qtype policy
+			if question.Qtype == dns.TypeHTTPS || question.Qtype == dns.TypeSVCB {
+				trace.add("service-binding", "")
+				answerServiceBinding(database, response, question, lookups, subnet)
+				continue
+			}
+			// Check the type of DNS query
+			if question.Qtype != dns.TypeA {
+				// Anything other than an A query is handled by the unknown query type policy
+				started := appClock.Now()
+				handleUnknownQtype(response, question, lookups, subnet, resolve)
+				trace.add("qtype-policy", "%s %s in %s", unknownQtypePolicy, dns.RcodeToString[response.Rcode], appClock.Now().Sub(started))
+				continue
+			}
+			// Check if DNS lookup is enabled or if the domain is in the database
+			if lookups {
+				// Check if the queried domain exists in the resolutions database
+				if addresses, ttl, remaining, found := lookupResolution(database, question.Name, true); found {
+					// If found in resolutions, reply with every stored address
+					if answerAddresses(response, question, addresses, ttl) {
+						cacheStatus, answerTTL = "cache-hit", remaining
+					}
+					metrics.Inc("dnstoy_cache_hits_total")
+					trace.add("cache-hit", strings.Join(addresses, ","))
+				} else {
+					cacheStatus = "cache-miss"
+					metrics.Inc("dnstoy_cache_misses_total")
+					trace.add("cache-miss", "")
+					var server string
+					var ips []net.IP
+					var ttl uint32
+					var err error
+					started := appClock.Now()
+					if resolve != nil {
+						server = "injected resolver"
+						ips, ttl, err = lookupWith(resolve, response, question.Name)
+					} else {
+						server = upstreamFor(database, question.Name)
+						ips, ttl, err = DnsLookup(server, response, question.Name, subnet)
+					}
+					if err != nil {
+						trace.add("forward", "%s failed in %s: %s", server, appClock.Now().Sub(started), err)
+						switch {
+						case errors.Is(err, errNXDOMAIN):
+							response.Rcode = dns.RcodeNameError
+						case errors.Is(err, errNoData):
+							// NOERROR with no answer, the name exists without an A record
+						case errors.Is(err, errCNAMELoop):
+							// Don't hand the client a partial answer for a broken chain
+							log.Println(err)
+							response.Rcode = dns.RcodeServerFailure
+						default:
+							// A busy or failing upstream says nothing about the name, so don't answer NODATA
+							log.Println(err)
+							response.Rcode = dns.RcodeServerFailure
+						}
+					} else {
+						trace.add("forward", "%s answered %s in %s", server, ips, appClock.Now().Sub(started))
+						answerTTL = ttl
+						if logMissesOnly {
+							log.Printf("miss %s %s -> %s via %s\n", question.Name, dns.TypeToString[question.Qtype], ips, server)
+						}
+						exists, err := storeResolution(database, question.Name, ips, ttl)
+						if err != nil {
+							log.Printf("Error storing resolved IP in database: %s\n", err)
+						} else if !exists && !logMissesOnly {
+							log.Printf("A new domain called %s was added to the database with the IP Addresses: %s\n", question.Name, ips)
+						}
+					}
+				}
+			}
+			if !lookups {
+				// If DNS lookup is disabled, check if domain exists in the database
+				if addresses, ttl, remaining, found := lookupResolution(database, question.Name, false); found {
+					// If found in resolutions, reply with every stored address
+					trace.add("cache-hit", "%s (lookups off)", strings.Join(addresses, ","))
+					if answerAddresses(response, question, addresses, ttl) {
+						cacheStatus, answerTTL = "cache-hit", remaining
+					}
+					metrics.Inc("dnstoy_cache_hits_total")
+					continue
+				}
+				trace.add("cache-miss", "lookups off")
+				answerCacheOnlyMiss(response)
+			}
+		}
+
+		// Several code paths append answers, so collapse identical records
+		if dedupAnswers {
+			response.Answer = dns.Dedup(response.Answer, nil)
+		}
+
+		// Spread clients over a name's addresses by leading with the next one each query
+		if rrRotate {
+			for _, question := range request.Question {
+				rotateAnswers(response, question)
+			}
+		}
+
+		// Answers and glue holding both families lead with the -prefer-family addresses
+		orderByFamily(response.Answer)
+		orderByFamily(response.Extra)
+
+		// Answers pointing into networks with RPZ IP triggers are rewritten as a whole
+		if rule := matchRPZAnswer(response); rule != nil {
+			if rule.Action == rpz.ActionDrop {
+				metrics.Inc("dnstoy_rpz_hits_total", "action", rule.Action.String())
+				countRejected("dropped", "rpz")
+				return
+			}
+			response.Answer = nil
+			response.Rcode = dns.RcodeSuccess
+			for _, question := range request.Question {
+				answerRPZ(response, question, rule)
+			}
+		}
+
+		// Cap the answer count to limit amplification, UDP clients are told to retry over TCP
+		if maxAnswers > 0 && len(response.Answer) > maxAnswers {
+			response.Answer = response.Answer[:maxAnswers]
+			if isUDP(writer) {
+				response.Truncated = true
+			}
+		}
+
+		// Give clients an SOA so they can cache negative answers (RFC 2308)
+		if negativeSOA {
+			appendNegativeSOA(response)
+		}
+
+		if debugCacheInfo && cacheStatus != "" {
+			appendCacheInfo(response, request, cacheStatus, answerTTL)
+		}
+
+		if clientCookie != nil {
+			appendCookie(response, request, clientCookie, clientIP(writer))
+		}
+
+		// Pack repeated names as pointers so larger answers fit without truncation
+		response.Compress = compressReplies
+
+		// Slow the answer down when -inject-delay is testing client timeouts
+		if delay := injectedDelay(request); delay > 0 {
+			time.Sleep(delay)
+		}
+
+		// A record that can't be packed would otherwise leave the client with no answer at all
+		if _, err := response.Pack(); err != nil {
+			log.Printf("Error packing DNS response for %s, sending SERVFAIL: %s\n", request.Question[0].Name, err)
+			metrics.Inc("dnstoy_pack_failures_total")
+			response = servfailFor(request, response)
+		}
+
+		// Oversized UDP answers are cut down and marked truncated so the client retries over TCP
+		if hardenPublic && isUDP(writer) {
+			response.Truncate(hardenedUDPSize(request, proven))
+		}
+
+		metrics.Inc("dnstoy_responses_total", "rcode", dns.RcodeToString[response.Rcode])
+		logWire("response to", writer, response)
+		logQuery(writer, request, response)
+		trace.finish(writer, response)
+
+		// Send the DNS response back to the client
+		err := writer.WriteMsg(response)
+		if err != nil {
+			log.Printf("Error writing DNS response: %s\n", err)
+		}
+	}
+}
+
+// Function to answer a non-A question according to the -unknown-qtype policy
+func handleUnknownQtype(response *dns.Msg, question dns.Question, lookups bool, subnet *dns.EDNS0_SUBNET, resolve resolveFunc) {
+	if !lookups && answerCacheOnlyMiss(response) {
+		return
+	}
+	if unknownQtypePolicy == "refuse" || !lookups {
+		countRejected("refused", "qtype")
+		response.Rcode = dns.RcodeRefused
+		return
+	}
+	forwardToResponse(response, question, subnet, resolve)
+}
+
+// Function to answer a question nothing local could answer with the -cache-only-miss rcode when
+// there are no upstreams to forward it to, returning false when there are
+func answerCacheOnlyMiss(response *dns.Msg) bool {
+	if hasUpstreams() {
+		return false
+	}
+	metrics.Inc("dnstoy_cache_misses_total")
+	if cacheOnlyMiss == "servfail" {
+		response.Rcode = dns.RcodeServerFailure
+	} else {
+		response.Rcode = dns.RcodeNameError
+	}
+	return true
+}
+
+// Function to forward a question upstream and copy the answer into response unchanged, asking
+// resolve instead when it isn't nil
+func forwardToResponse(response *dns.Msg, question dns.Question, subnet *dns.EDNS0_SUBNET, resolve resolveFunc) {
+	if resolve != nil {
+		forwardWith(resolve, response, question)
+		return
+	}
+	answer, err := forwardQuestion(question, subnet)
+	if err != nil {
+		log.Println(err)
+		response.Rcode = dns.RcodeServerFailure
+		return
+	}
+	for _, rr := range answer.Answer {
+		rr.Header().Ttl = serveTTL(rr.Header().Ttl)
+	}
+	response.Answer = append(response.Answer, answer.Answer...)
+	if len(answer.Answer) == 0 {
+		// NXDOMAIN and NODATA answers carry the upstream's SOA
+		copyNegativeSOA(response, answer)
+	} else {
+		copyUpstreamSections(response, answer)
+	}
+	if answer.Rcode != dns.RcodeSuccess {
+		response.Rcode = answer.Rcode
+	}
+}
+
+// Function to add a minimal SOA to the authority section of NXDOMAIN and REFUSED answers
+// that don't already carry one
+func appendNegativeSOA(response *dns.Msg) {
+	if response.Rcode != dns.RcodeNameError && response.Rcode != dns.RcodeRefused {
+		return
+	}
+	if len(response.Ns) > 0 || len(response.Question) == 0 {
+		return
+	}
+	zone := strings.ToLower(dns.Fqdn(response.Question[0].Name))
+	if localZone := findLocalZone(zone); localZone != "" {
+		zone = localZone
+	}
+	soa := zoneSOA(zone)
+	// Negative answers are cached for the lower of the SOA TTL and its minimum
+	soa.Hdr.Ttl = soa.Minttl
+	response.Ns = append(response.Ns, soa)
+}
+
+// Function to attach an EDNS0 local option saying whether the answer was a cache hit and its remaining TTL
+func appendCacheInfo(response, request *dns.Msg, status string, ttl uint32) {
+	opt := response.IsEdns0()
+	if opt == nil {
+		response.SetEdns0(advertisedUDPSize(request), false)
+		opt = response.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+		Code: cacheInfoOptionCode,
+		Data: []byte(fmt.Sprintf("%s ttl=%d", status, ttl)),
+	})
+}
+
+// Function to append a record to the answer section only if it packs, e.g. a stored IP that isn't IPv4
+func appendValid(response *dns.Msg, rr dns.RR) bool {
+	buf := make([]byte, dns.Len(rr))
+	if _, err := dns.PackRR(rr, buf, 0, nil, false); err != nil {
+		log.Printf("Error packing %s record for %s, leaving it out: %s\n", dns.TypeToString[rr.Header().Rrtype], rr.Header().Name, err)
+		metrics.Inc("dnstoy_pack_failures_total")
+		return false
+	}
+	response.Answer = append(response.Answer, rr)
+	return true
+}
+
+// Function to answer an A question with the stored IPv4 addresses, returning false when none could be answered
+func answerAddresses(response *dns.Msg, question dns.Question, addresses []string, ttl uint32) bool {
+	ttl = serveTTL(ttl)
+	answered := false
+	for _, address := range addresses {
+		ip := net.ParseIP(address).To4()
+		if ip == nil {
+			continue
+		}
+		answerRecord := dns.A{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   ip,
+		}
+		answered = appendValid(response, &answerRecord) || answered
+	}
+	return answered
+}
+
+// Function to build a bare SERVFAIL reply for a response that couldn't be packed, keeping its EDNS0 OPT
+func servfailFor(request, failed *dns.Msg) *dns.Msg {
+	response := new(dns.Msg)
+	response.SetRcode(request, dns.RcodeServerFailure)
+	response.RecursionAvailable = failed.RecursionAvailable
+	if opt := failed.IsEdns0(); opt != nil {
+		response.SetEdns0(opt.UDPSize(), false)
+	}
+	return response
+}
+
+// Function to pick the EDNS0 buffer size for a response, the client's own capped at -udp-read-size
+func advertisedUDPSize(request *dns.Msg) uint16 {
+	udpSize := uint16(dns.MinMsgSize)
+	if opt := request.IsEdns0(); opt != nil && opt.UDPSize() > udpSize {
+		udpSize = opt.UDPSize()
+	}
+	if int(udpSize) > udpReadSize {
+		udpSize = uint16(udpReadSize)
+	}
+	return udpSize
+}
+
+// Function to spread a TTL by -ttl-jitter and raise it to the -min-serve-ttl floor before it is advertised to clients
+func serveTTL(ttl uint32) uint32 {
+	if ttlJitter > 0 {
+		ttl = jitterTTL(ttl, ttlJitter)
+	}
+	if uint(ttl) < minServeTTL {
+		return uint32(minServeTTL)
+	}
+	return ttl
+}
+
+// Function to move a TTL by a random amount of up to percent of it in either direction
+func jitterTTL(ttl uint32, percent uint) uint32 {
+	spread := float64(ttl) * float64(percent) / 100
+	jittered := math.Round(float64(ttl) + spread*(2*rand.Float64()-1))
+	return uint32(math.Min(math.Max(jittered, 0), math.MaxUint32))
+}
+
+// Function to check if a request arrived over UDP. DoQ runs over UDP too, but its streams are
+// reliable like TCP, so it needs neither truncation nor the UDP spoofing defences
+func isUDP(writer dns.ResponseWriter) bool {
+	if _, ok := writer.(*doqWriter); ok {
+		return false
+	}
+	_, ok := writer.RemoteAddr().(*net.UDPAddr)
+	return ok
+}
+
+// Function to count a query that was refused, dropped or malformed, by reason
+func countRejected(kind, reason string) {
+	metrics.Inc("dnstoy_rejected_queries_total", "kind", kind, "reason", reason)
+}
+
+// Function to answer a malformed request with FORMERR
+func writeFormatError(writer dns.ResponseWriter, request *dns.Msg, reason string) {
+	countRejected("formerr", reason)
+	response := new(dns.Msg)
+	response.SetRcode(request, dns.RcodeFormatError)
+	metrics.Inc("dnstoy_responses_total", "rcode", dns.RcodeToString[response.Rcode])
+	logWire("response to", writer, response)
+	if err := writer.WriteMsg(response); err != nil {
+		log.Printf("Error writing DNS response: %s\n", err)
+	}
+}
+
+// maxQuestions is the most questions accepted in one message, each is answered on its own
+const maxQuestions = 16
+
+// Function to screen message headers before they are parsed, counting the ones turned away.
+// Unlike the default, messages with several questions are accepted so each gets its own answer
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Qdcount > 1 && dh.Qdcount <= maxQuestions {
+		dh.Qdcount = 1
+	}
+	action := dns.DefaultMsgAcceptFunc(dh)
+	switch action {
+	case dns.MsgReject, dns.MsgRejectNotImplemented:
+		countRejected("formerr", "header")
+	case dns.MsgIgnore:
+		countRejected("dropped", "header")
+	}
+	return action
+}
+
+// Function to log the decoded message for -debug-wire, which is off by default since it
+// is verbose and records what clients look up
+func logWire(direction string, writer dns.ResponseWriter, msg *dns.Msg) {
+	if debugWire {
+		log.Printf("%s %s:\n%s\n", direction, writer.RemoteAddr(), msg.String())
+	}
+}
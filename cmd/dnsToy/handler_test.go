@@ -0,0 +1,744 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/blocklist"
+	"github.com/chaoticcyber/dnsToy/internal/clock"
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/chaoticcyber/dnsToy/internal/metrics"
+	"github.com/miekg/dns"
+)
+
+// testWriter records the message a handler writes
+type testWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testWriter) RemoteAddr() net.Addr      { return w.remote }
+func (w *testWriter) LocalAddr() net.Addr       { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53} }
+func (w *testWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+
+// Function to get a writer for a UDP client at 192.0.2.10
+func newTestWriter() *testWriter {
+	return &testWriter{remote: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 40000}}
+}
+
+// Function to open an empty database in a temporary directory
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := dbfunc.Open(filepath.Join(t.TempDir(), "dns.db"), 5000)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := dbfunc.CreateTables(db); err != nil {
+		t.Fatalf("CreateTables: %s", err)
+	}
+	return db
+}
+
+// Function to turn upstream lookups off for a test, answering only from the database
+func disableLookups(t *testing.T) {
+	t.Helper()
+	enableDNSLookup.Store(false)
+	t.Cleanup(func() { enableDNSLookup.Store(true) })
+}
+
+// Function to collect what the server logs during a test
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+// Function to stand the server's clock still at start for a test, moved on with Advance
+func useFakeClock(t *testing.T, start time.Time) *clock.Fake {
+	t.Helper()
+	fake := clock.NewFake(start)
+	appClock, dbfunc.Clock = fake, fake
+	t.Cleanup(func() { appClock, dbfunc.Clock = clock.Real{}, clock.Real{} })
+	return fake
+}
+
+func TestAcceptMsgSeveralQuestions(t *testing.T) {
+	for _, test := range []struct {
+		qdcount uint16
+		want    dns.MsgAcceptAction
+	}{
+		{0, dns.MsgReject},
+		{1, dns.MsgAccept},
+		{2, dns.MsgAccept},
+		{maxQuestions, dns.MsgAccept},
+		{maxQuestions + 1, dns.MsgReject},
+	} {
+		if got := acceptMsg(dns.Header{Qdcount: test.qdcount}); got != test.want {
+			t.Errorf("acceptMsg with %d questions = %v, want %v", test.qdcount, got, test.want)
+		}
+	}
+}
+
+func TestBlocklistPerQuestion(t *testing.T) {
+	db := newTestDB(t)
+	disableLookups(t)
+	if err := dbfunc.AddToDatabase(db, dbfunc.Resolution{Domain: "allowed.example.", IP: "192.0.2.1", TTL: 300}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	list := blocklist.New()
+	list.Add("blocked.example")
+	blockList.Store(list)
+	t.Cleanup(func() { blockList.Store(nil) })
+
+	request := new(dns.Msg)
+	request.SetQuestion("blocked.example.", dns.TypeA)
+	request.Question = append(request.Question, dns.Question{Name: "allowed.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	writer := newTestWriter()
+	resolveDNSRequest(db)(writer, request)
+
+	if writer.msg == nil {
+		t.Fatal("no response written")
+	}
+	if len(writer.msg.Question) != 2 {
+		t.Fatalf("response has %d questions, want both", len(writer.msg.Question))
+	}
+	answers := make(map[string]string)
+	for _, rr := range writer.msg.Answer {
+		answers[rr.Header().Name] = rr.(*dns.A).A.String()
+	}
+	if answers["blocked.example."] != "0.0.0.0" {
+		t.Errorf("blocked.example. answered %q, want the null route", answers["blocked.example."])
+	}
+	if answers["allowed.example."] != "192.0.2.1" {
+		t.Errorf("allowed.example. answered %q, want the stored address", answers["allowed.example."])
+	}
+}
+
+// Function to get the -debug-cache-info option of a response, empty when it has none
+func cacheInfo(response *dns.Msg) string {
+	if opt := response.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if local, ok := option.(*dns.EDNS0_LOCAL); ok && local.Code == cacheInfoOptionCode {
+				return string(local.Data)
+			}
+		}
+	}
+	return ""
+}
+
+func TestCacheInfoReportsRemainingTTL(t *testing.T) {
+	db := newTestDB(t)
+	disableLookups(t)
+	fake := clock.NewFake(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	dbfunc.Clock = fake
+	t.Cleanup(func() { dbfunc.Clock = clock.Real{} })
+	if err := dbfunc.AddToDatabase(db, dbfunc.Resolution{Domain: "cached.example", IP: "192.0.2.1", TTL: 300}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	fake.Advance(100 * time.Second)
+
+	request := new(dns.Msg)
+	request.SetQuestion("cached.example.", dns.TypeA)
+	writer := newTestWriter()
+	resolveDNSRequest(db)(writer, request)
+	if info := cacheInfo(writer.msg); info != "" {
+		t.Errorf("cache info %q without -debug-cache-info", info)
+	}
+
+	debugCacheInfo = true
+	t.Cleanup(func() { debugCacheInfo = false })
+	writer = newTestWriter()
+	resolveDNSRequest(db)(writer, request)
+	if info := cacheInfo(writer.msg); info != "cache-hit ttl=200" {
+		t.Errorf("cache info %q, want %q", info, "cache-hit ttl=200")
+	}
+}
+
+func TestCacheOnlyMissForEveryQtype(t *testing.T) {
+	db := newTestDB(t)
+	if hasUpstreams() {
+		t.Fatal("test needs no upstream servers configured")
+	}
+	prefix, err := parseDNS64Prefix("64:ff9b::/96")
+	if err != nil {
+		t.Fatalf("parseDNS64Prefix: %s", err)
+	}
+	dns64Prefix = prefix
+	t.Cleanup(func() { dns64Prefix = nil; cacheOnlyMiss = "nxdomain" })
+
+	for _, miss := range []struct {
+		policy string
+		rcode  int
+	}{{"nxdomain", dns.RcodeNameError}, {"servfail", dns.RcodeServerFailure}} {
+		cacheOnlyMiss = miss.policy
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeHTTPS, dns.TypeSVCB, dns.TypeAAAA} {
+			request := new(dns.Msg)
+			request.SetQuestion("uncached.example.", qtype)
+			writer := newTestWriter()
+			resolveDNSRequest(db)(writer, request)
+			if writer.msg == nil || writer.msg.Rcode != miss.rcode {
+				t.Errorf("%s miss with -cache-only-miss %s answered %v, want %s", dns.TypeToString[qtype], miss.policy, writer.msg, dns.RcodeToString[miss.rcode])
+			}
+		}
+	}
+}
+
+func TestCompressShrinksReplies(t *testing.T) {
+	useStubUpstream(t, answerStubMultiA)
+	t.Cleanup(func() { compressReplies = true })
+	packedSize := func(compress bool) int {
+		t.Helper()
+		compressReplies = compress
+		request := new(dns.Msg)
+		request.SetQuestion("a.long.name.of.several.labels.example.", dns.TypeA)
+		writer := newTestWriter()
+		resolveDNSRequest(nil)(writer, request)
+		if len(answerIPs(writer.msg)) != 3 {
+			t.Fatalf("answered %v, want the 3 upstream addresses", answerIPs(writer.msg))
+		}
+		packed, err := writer.msg.Pack()
+		if err != nil {
+			t.Fatalf("Pack: %s", err)
+		}
+		return len(packed)
+	}
+	compressed, uncompressed := packedSize(true), packedSize(false)
+	// Each of the 3 answers repeats the 39 byte owner name, which compresses to a 2 byte pointer
+	if want := uncompressed - 3*(39-2); compressed != want {
+		t.Errorf("compressed reply is %d bytes, want %d (uncompressed %d)", compressed, want, uncompressed)
+	}
+}
+
+func TestUnknownQtypePolicySRV(t *testing.T) {
+	db := newTestDB(t)
+	var asked atomic.Int32
+	useStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		asked.Add(1)
+		response := new(dns.Msg)
+		response.SetReply(request)
+		response.Answer = append(response.Answer, &dns.SRV{
+			Hdr:      dns.RR_Header{Name: request.Question[0].Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 300},
+			Priority: 10, Weight: 5, Port: 5060, Target: "sip.example.",
+		})
+		writer.WriteMsg(response)
+	})
+	t.Cleanup(func() { unknownQtypePolicy = "forward" })
+	for _, test := range []struct {
+		policy  string
+		rcode   int
+		answers int
+		asked   int32
+	}{
+		{"forward", dns.RcodeSuccess, 1, 1},
+		{"refuse", dns.RcodeRefused, 0, 0},
+	} {
+		unknownQtypePolicy = test.policy
+		asked.Store(0)
+		request := new(dns.Msg)
+		request.SetQuestion("_sip._udp.example.", dns.TypeSRV)
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		response := writer.msg
+		if response.Rcode != test.rcode || len(response.Answer) != test.answers || asked.Load() != test.asked {
+			t.Errorf("-unknown-qtype %s answered %s with %d records after %d upstream queries, want %s with %d after %d",
+				test.policy, dns.RcodeToString[response.Rcode], len(response.Answer), asked.Load(),
+				dns.RcodeToString[test.rcode], test.answers, test.asked)
+			continue
+		}
+		if test.answers > 0 {
+			if srv, ok := response.Answer[0].(*dns.SRV); !ok || srv.Target != "sip.example." || srv.Port != 5060 {
+				t.Errorf("-unknown-qtype forward answered %v, want the upstream SRV record", response.Answer[0])
+			}
+		}
+	}
+}
+
+func TestMinServeTTLRaisesShortTTLs(t *testing.T) {
+	db := newTestDB(t)
+	useStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		response := new(dns.Msg)
+		response.SetReply(request)
+		response.Answer = append(response.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: request.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 2},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+		writer.WriteMsg(response)
+	})
+	minServeTTL = 60
+	t.Cleanup(func() { minServeTTL = 0 })
+
+	// The miss is answered from the upstream and the hit from the stored entry, both at the floor
+	for _, status := range []string{"miss", "hit"} {
+		request := new(dns.Msg)
+		request.SetQuestion("short.example.", dns.TypeA)
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		if len(writer.msg.Answer) != 1 {
+			t.Fatalf("cache %s answered %v, want one A record", status, writer.msg.Answer)
+		}
+		if ttl := writer.msg.Answer[0].Header().Ttl; ttl != 60 {
+			t.Errorf("cache %s answered with TTL %d, want the -min-serve-ttl floor of 60", status, ttl)
+		}
+	}
+}
+
+func TestLearnOnlyCountsQueries(t *testing.T) {
+	db := newTestDB(t)
+	var asked atomic.Int32
+	useStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		asked.Add(1)
+		answerStubA(writer, request)
+	})
+	learnOnly = true
+	t.Cleanup(func() { learnOnly = false })
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeA, dns.TypeAAAA} {
+		request := new(dns.Msg)
+		request.SetQuestion("Learn.Example.", qtype)
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		if writer.msg.Rcode != dns.RcodeRefused || len(writer.msg.Answer) != 0 {
+			t.Errorf("learn-only answered %s with %d records, want REFUSED and nothing else", dns.RcodeToString[writer.msg.Rcode], len(writer.msg.Answer))
+		}
+	}
+	if asked.Load() != 0 {
+		t.Errorf("learn-only sent %d queries upstream, want none", asked.Load())
+	}
+	for qtype, want := range map[string]int{"A": 2, "AAAA": 1} {
+		var count int
+		if err := db.QueryRow("SELECT query_count FROM queries WHERE domain=? AND qtype=?", "learn.example.", qtype).Scan(&count); err != nil {
+			t.Fatalf("reading the %s count: %s", qtype, err)
+		}
+		if count != want {
+			t.Errorf("%s queries counted %d, want %d", qtype, count, want)
+		}
+	}
+	if resolutions, err := dbfunc.ListResolutions(db); err != nil || len(resolutions) != 0 {
+		t.Errorf("learn-only stored resolutions %v (%v), want none", resolutions, err)
+	}
+}
+
+func TestDedupAnswers(t *testing.T) {
+	useStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		response := new(dns.Msg)
+		response.SetReply(request)
+		for _, last := range []byte{1, 1, 2, 1} {
+			response.Answer = append(response.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: request.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.IPv4(192, 0, 2, last),
+			})
+		}
+		writer.WriteMsg(response)
+	})
+	t.Cleanup(func() { dedupAnswers = true })
+
+	for _, test := range []struct {
+		dedup bool
+		want  []string
+	}{
+		{true, []string{"192.0.2.1", "192.0.2.2"}},
+		{false, []string{"192.0.2.1", "192.0.2.1", "192.0.2.2", "192.0.2.1"}},
+	} {
+		dedupAnswers = test.dedup
+		request := new(dns.Msg)
+		request.SetQuestion("dup.example.", dns.TypeA)
+		writer := newTestWriter()
+		resolveDNSRequest(nil)(writer, request)
+		if got := answerIPs(writer.msg); !slices.Equal(got, test.want) {
+			t.Errorf("-dedup-answers=%t answered %v, want %v", test.dedup, got, test.want)
+		}
+	}
+}
+
+func TestQuestionClasses(t *testing.T) {
+	db := newTestDB(t)
+	disableLookups(t)
+	if err := dbfunc.AddToDatabase(db, dbfunc.Resolution{Domain: "class.example.", IP: "192.0.2.1", TTL: 300}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	for _, test := range []struct {
+		name   string
+		qtype  uint16
+		qclass uint16
+		rcode  int
+		rrtype uint16
+	}{
+		{"class.example.", dns.TypeA, dns.ClassINET, dns.RcodeSuccess, dns.TypeA},
+		{"version.bind.", dns.TypeTXT, dns.ClassCHAOS, dns.RcodeSuccess, dns.TypeTXT},
+		{"class.example.", dns.TypeA, dns.ClassHESIOD, dns.RcodeRefused, dns.TypeNone},
+		{"class.example.", dns.TypeA, 42, dns.RcodeRefused, dns.TypeNone},
+	} {
+		request := new(dns.Msg)
+		request.SetQuestion(test.name, test.qtype)
+		request.Question[0].Qclass = test.qclass
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		class := dns.Class(test.qclass).String()
+		if writer.msg.Rcode != test.rcode {
+			t.Errorf("%s %s answered %s, want %s", class, test.name, dns.RcodeToString[writer.msg.Rcode], dns.RcodeToString[test.rcode])
+			continue
+		}
+		if test.rrtype == dns.TypeNone {
+			if len(writer.msg.Answer) != 0 {
+				t.Errorf("%s %s answered %v, want no records", class, test.name, writer.msg.Answer)
+			}
+			continue
+		}
+		if len(writer.msg.Answer) != 1 || writer.msg.Answer[0].Header().Rrtype != test.rrtype || writer.msg.Answer[0].Header().Class != test.qclass {
+			t.Errorf("%s %s answered %v, want one %s %s record", class, test.name, writer.msg.Answer, class, dns.TypeToString[test.rrtype])
+		}
+	}
+}
+
+func TestMaxAnswersTruncates(t *testing.T) {
+	useStubUpstream(t, answerStubMultiA)
+	t.Cleanup(func() { maxAnswers = 0 })
+	tcp := &testWriter{remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 40000}}
+	for _, test := range []struct {
+		limit     int
+		writer    *testWriter
+		answers   int
+		truncated bool
+	}{
+		{0, newTestWriter(), 3, false},
+		{3, newTestWriter(), 3, false},
+		{2, newTestWriter(), 2, true},
+		{2, tcp, 2, false},
+	} {
+		maxAnswers = test.limit
+		request := new(dns.Msg)
+		request.SetQuestion("many.example.", dns.TypeA)
+		resolveDNSRequest(nil)(test.writer, request)
+		transport := test.writer.remote.Network()
+		if got := len(test.writer.msg.Answer); got != test.answers || test.writer.msg.Truncated != test.truncated {
+			t.Errorf("-max-answers %d over %s gave %d answers (TC %t), want %d (TC %t)",
+				test.limit, transport, got, test.writer.msg.Truncated, test.answers, test.truncated)
+		}
+	}
+}
+
+func TestHonorRD(t *testing.T) {
+	db := newTestDB(t)
+	var asked atomic.Int32
+	useStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		asked.Add(1)
+		answerStubA(writer, request)
+	})
+	if err := dbfunc.AddToDatabase(db, dbfunc.Resolution{Domain: "cached.example.", IP: "192.0.2.9", TTL: 300}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	for _, test := range []struct {
+		name  string
+		rd    bool
+		rcode int
+		ips   []string
+		asked int32
+	}{
+		// Without recursion only what is already held locally is answered
+		{"cached.example.", false, dns.RcodeSuccess, []string{"192.0.2.9"}, 0},
+		{"rd0.example.", false, dns.RcodeSuccess, nil, 0},
+		{"cached.example.", true, dns.RcodeSuccess, []string{"192.0.2.9"}, 0},
+		{"rd1.example.", true, dns.RcodeSuccess, []string{"192.0.2.1"}, 1},
+	} {
+		asked.Store(0)
+		request := new(dns.Msg)
+		request.SetQuestion(test.name, dns.TypeA)
+		request.RecursionDesired = test.rd
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		response := writer.msg
+		if ips := answerIPs(response); response.Rcode != test.rcode || !slices.Equal(ips, test.ips) || asked.Load() != test.asked {
+			t.Errorf("%s with RD=%t answered %s %v after %d upstream queries, want %s %v after %d", test.name, test.rd,
+				dns.RcodeToString[response.Rcode], ips, asked.Load(), dns.RcodeToString[test.rcode], test.ips, test.asked)
+		}
+		if !response.RecursionAvailable {
+			t.Errorf("%s with RD=%t answered without RA", test.name, test.rd)
+		}
+	}
+}
+
+func TestLogMissesOnly(t *testing.T) {
+	db := newTestDB(t)
+	useStubUpstream(t, answerStubA)
+	logMissesOnly = true
+	t.Cleanup(func() { logMissesOnly = false })
+	logged := captureLog(t)
+
+	request := new(dns.Msg)
+	request.SetQuestion("logged.example.", dns.TypeA)
+	resolveDNSRequest(db)(newTestWriter(), request)
+	lines := strings.Split(strings.TrimSpace(logged.String()), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], "miss logged.example. A -> [192.0.2.1] via ") {
+		t.Errorf("the miss logged %q, want one miss line", logged.String())
+	}
+
+	logged.Reset()
+	resolveDNSRequest(db)(newTestWriter(), request)
+	if logged.Len() != 0 {
+		t.Errorf("the hit logged %q, want nothing", logged.String())
+	}
+}
+
+func TestAAAAPolicy(t *testing.T) {
+	db := newTestDB(t)
+	var asked atomic.Int32
+	// The name only has an A record, so the upstream answers AAAA with no data
+	useStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		asked.Add(1)
+		if request.Question[0].Qtype == dns.TypeA {
+			answerStubA(writer, request)
+			return
+		}
+		response := new(dns.Msg)
+		writer.WriteMsg(response.SetReply(request))
+	})
+	t.Cleanup(func() { aaaaPolicy = "forward" })
+	for _, test := range []struct {
+		policy string
+		rcode  int
+		asked  int32
+	}{
+		{"forward", dns.RcodeSuccess, 1},
+		{"empty", dns.RcodeSuccess, 0},
+		{"nxdomain", dns.RcodeNameError, 0},
+	} {
+		aaaaPolicy = test.policy
+		asked.Store(0)
+		request := new(dns.Msg)
+		request.SetQuestion("v4only.example.", dns.TypeAAAA)
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		if writer.msg.Rcode != test.rcode || len(writer.msg.Answer) != 0 || asked.Load() != test.asked {
+			t.Errorf("-aaaa-policy %s answered %s with %d records after %d upstream queries, want %s with none after %d",
+				test.policy, dns.RcodeToString[writer.msg.Rcode], len(writer.msg.Answer), asked.Load(), dns.RcodeToString[test.rcode], test.asked)
+		}
+	}
+}
+
+func TestCacheTTLSeparateFromAdvertisedTTL(t *testing.T) {
+	db := newTestDB(t)
+	fake := useFakeClock(t, time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	var asked atomic.Int32
+	useStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		asked.Add(1)
+		answerStubA(writer, request)
+	})
+	cacheTTL, advertisedTTL = 600, 30
+	t.Cleanup(func() { cacheTTL, advertisedTTL = 0, uint(defaultTTL) })
+
+	query := func() *dns.Msg {
+		t.Helper()
+		request := new(dns.Msg)
+		request.SetQuestion("kept.example.", dns.TypeA)
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		if len(writer.msg.Answer) != 1 {
+			t.Fatalf("answered %v, want one A record", writer.msg.Answer)
+		}
+		return writer.msg
+	}
+
+	query()
+	// Entries are kept for -cache-ttl but clients are told to come back after -advertised-ttl
+	elapsed := time.Duration(0)
+	for _, step := range []time.Duration{0, 30 * time.Second, 569 * time.Second} {
+		fake.Advance(step)
+		elapsed += step
+		if ttl := query().Answer[0].Header().Ttl; ttl != 30 {
+			t.Errorf("hit after %s answered with TTL %d, want the advertised 30", elapsed, ttl)
+		}
+		if got := asked.Load(); got != 1 {
+			t.Fatalf("upstream asked %d times after %s, want the entry still cached", got, elapsed)
+		}
+	}
+
+	fake.Advance(time.Second)
+	query()
+	if got := asked.Load(); got != 2 {
+		t.Errorf("upstream asked %d times once the cache TTL ran out, want 2", got)
+	}
+}
+
+func TestNegativeSOAOnBlockedNXDOMAIN(t *testing.T) {
+	db := newTestDB(t)
+	disableLookups(t)
+	if err := dbfunc.AddToDatabase(db, dbfunc.Resolution{Domain: "allowed.example.", IP: "192.0.2.1", TTL: 300}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	list := blocklist.New()
+	list.Add("blocked.example")
+	blockList.Store(list)
+	blockMode = "nxdomain"
+	t.Cleanup(func() {
+		blockList.Store(nil)
+		blockMode = "null"
+		negativeSOA = false
+	})
+	query := func(name string) *dns.Msg {
+		t.Helper()
+		request := new(dns.Msg)
+		request.SetQuestion(name, dns.TypeA)
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		return writer.msg
+	}
+
+	if response := query("blocked.example."); response.Rcode != dns.RcodeNameError || len(response.Ns) != 0 {
+		t.Fatalf("blocked name without -negative-soa answered %s with authority %v, want a bare NXDOMAIN", dns.RcodeToString[response.Rcode], response.Ns)
+	}
+
+	negativeSOA = true
+	response := query("blocked.example.")
+	if response.Rcode != dns.RcodeNameError || len(response.Ns) != 1 {
+		t.Fatalf("blocked name answered %s with authority %v, want NXDOMAIN with an SOA", dns.RcodeToString[response.Rcode], response.Ns)
+	}
+	soa, ok := response.Ns[0].(*dns.SOA)
+	if !ok || soa.Hdr.Name != "blocked.example." || soa.Hdr.Ttl != soa.Minttl {
+		t.Errorf("authority section is %v, want an SOA for blocked.example. cached for its minimum TTL", response.Ns[0])
+	}
+	// Answers that aren't negative are left alone
+	if response := query("allowed.example."); len(response.Ns) != 0 {
+		t.Errorf("answered name got authority %v, want none", response.Ns)
+	}
+}
+
+func TestMalformedRecordGivesServfail(t *testing.T) {
+	logged := captureLog(t)
+	// A 3 byte address parses as a record but can't be packed
+	malformed := func(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+		return []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IP{192, 0, 2},
+		}}, nil
+	}
+	before := metrics.Get("dnstoy_pack_failures_total")
+
+	request := new(dns.Msg)
+	request.SetQuestion("broken.example.", dns.TypeTXT)
+	writer := newTestWriter()
+	resolveDNSRequestWith(nil, malformed)(writer, request)
+	if writer.msg == nil {
+		t.Fatal("no response written")
+	}
+	if writer.msg.Rcode != dns.RcodeServerFailure || len(writer.msg.Answer) != 0 {
+		t.Errorf("answered %s %v, want a bare SERVFAIL", dns.RcodeToString[writer.msg.Rcode], writer.msg.Answer)
+	}
+	if _, err := writer.msg.Pack(); err != nil {
+		t.Errorf("SERVFAIL doesn't pack: %s", err)
+	}
+	if got := metrics.Get("dnstoy_pack_failures_total"); got != before+1 {
+		t.Errorf("pack failures went from %v to %v, want one more", before, got)
+	}
+	if !strings.Contains(logged.String(), "sending SERVFAIL") {
+		t.Errorf("logged %q, want the pack failure", logged.String())
+	}
+
+	// Records appended through appendValid are checked up front and left out
+	response := new(dns.Msg)
+	bad, _ := malformed(context.Background(), "broken.example.", dns.TypeA)
+	if appendValid(response, bad[0]) || len(response.Answer) != 0 {
+		t.Errorf("appendValid took the malformed record, answer %v", response.Answer)
+	}
+}
+
+func TestNXDOMAINAndNODATA(t *testing.T) {
+	db := newTestDB(t)
+	useStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		question := request.Question[0]
+		response := new(dns.Msg)
+		response.SetReply(request)
+		header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: 300}
+		switch {
+		case question.Name == "missing.example.":
+			response.Rcode = dns.RcodeNameError
+		case question.Name == "v4only.example." && question.Qtype == dns.TypeA:
+			response.Answer = append(response.Answer, &dns.A{Hdr: header, A: net.IPv4(192, 0, 2, 1)})
+		case question.Name == "v6only.example." && question.Qtype == dns.TypeAAAA:
+			response.Answer = append(response.Answer, &dns.AAAA{Hdr: header, AAAA: net.ParseIP("2001:db8::1")})
+		}
+		if len(response.Answer) == 0 {
+			response.Ns = append(response.Ns, &dns.SOA{
+				Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+				Ns:  "ns.example.", Mbox: "hostmaster.example.", Serial: 1, Minttl: 60,
+			})
+		}
+		writer.WriteMsg(response)
+	})
+
+	for _, test := range []struct {
+		name  string
+		qtype uint16
+		rcode int
+	}{
+		// A name that doesn't exist at all
+		{"missing.example.", dns.TypeA, dns.RcodeNameError},
+		{"missing.example.", dns.TypeAAAA, dns.RcodeNameError},
+		// Names that exist, only without a record of the asked type
+		{"v4only.example.", dns.TypeAAAA, dns.RcodeSuccess},
+		{"v6only.example.", dns.TypeA, dns.RcodeSuccess},
+	} {
+		request := new(dns.Msg)
+		request.SetQuestion(test.name, test.qtype)
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		qtype := dns.TypeToString[test.qtype]
+		if writer.msg.Rcode != test.rcode || len(writer.msg.Answer) != 0 {
+			t.Errorf("%s %s answered %s %v, want %s with no answer", test.name, qtype, dns.RcodeToString[writer.msg.Rcode], writer.msg.Answer, dns.RcodeToString[test.rcode])
+		}
+		// Both negative answers carry the SOA clients cache them by
+		if len(writer.msg.Ns) != 1 || writer.msg.Ns[0].Header().Rrtype != dns.TypeSOA || writer.msg.Ns[0].Header().Ttl != 60 {
+			t.Errorf("%s %s authority is %v, want the upstream's SOA with its 60s minimum", test.name, qtype, writer.msg.Ns)
+		}
+	}
+}
+
+func TestJitterTTLStaysInRange(t *testing.T) {
+	for _, test := range []struct {
+		ttl       uint32
+		percent   uint
+		low, high uint32
+	}{
+		{300, 10, 270, 330},
+		{300, 100, 0, 600},
+		{60, 50, 30, 90},
+		{0, 50, 0, 0},
+		{math.MaxUint32, 100, 0, math.MaxUint32},
+	} {
+		shorter, longer := false, false
+		for i := 0; i < 10000; i++ {
+			got := jitterTTL(test.ttl, test.percent)
+			if got < test.low || got > test.high {
+				t.Fatalf("jitterTTL(%d, %d) = %d, want between %d and %d", test.ttl, test.percent, got, test.low, test.high)
+			}
+			shorter, longer = shorter || got < test.ttl, longer || got > test.ttl
+		}
+		// TTLs are spread both ways, unless there is no room to
+		if test.ttl > 0 && (!shorter || (!longer && test.ttl < math.MaxUint32)) {
+			t.Errorf("jitterTTL(%d, %d) shorter %v, longer %v, want the TTL moved both ways", test.ttl, test.percent, shorter, longer)
+		}
+	}
+
+	// The -min-serve-ttl floor still holds after the jitter
+	ttlJitter, minServeTTL = 50, 50
+	t.Cleanup(func() { ttlJitter, minServeTTL = 0, 0 })
+	for i := 0; i < 1000; i++ {
+		if got := serveTTL(60); got < 50 || got > 90 {
+			t.Fatalf("serveTTL(60) = %d, want between the floor of 50 and 90", got)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// maxHardenClients bounds the rate limit state, it starts over once this many clients are tracked
+const maxHardenClients = 10000
+
+// hardenUnprovenSize caps UDP responses to clients that haven't proven their address with a server
+// cookie, while -dns-cookies gives them the means to
+const hardenUnprovenSize = dns.MinMsgSize
+
+var (
+	hardenBuckets = make(map[string]*tokenBucket) // Client address to its token bucket
+	hardenMutex   sync.Mutex                      // Guards hardenBuckets
+)
+
+// Function to take a query from the client's -harden-rate bucket, false when the client is over its rate
+func allowUnproven(ip net.IP) bool {
+	if hardenRate <= 0 {
+		return true
+	}
+	now := appClock.Now()
+	key := ip.String()
+	hardenMutex.Lock()
+	defer hardenMutex.Unlock()
+	bucket, found := hardenBuckets[key]
+	if !found {
+		if len(hardenBuckets) >= maxHardenClients {
+			hardenBuckets = make(map[string]*tokenBucket)
+		}
+		bucket = &tokenBucket{tokens: float64(hardenRate), last: now}
+		hardenBuckets[key] = bucket
+	}
+	return bucket.take(now, hardenRate)
+}
+
+// Function to get the largest UDP response -harden-public allows for a request. Clients without a
+// server cookie only get hardenUnprovenSize when -dns-cookies hands cookies out, otherwise
+// nobody could prove their address and every client gets its EDNS0 size
+func hardenedUDPSize(request *dns.Msg, proven bool) int {
+	if !proven && dnsCookies {
+		return hardenUnprovenSize
+	}
+	return min(int(advertisedUDPSize(request)), hardenMaxUDPSize)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/chaoticcyber/dnsToy/internal/metrics"
+	"github.com/miekg/dns"
+)
+
+func TestHardenedUDPSize(t *testing.T) {
+	t.Cleanup(func() { dnsCookies = false })
+	withEDNS := new(dns.Msg)
+	withEDNS.SetQuestion("example.", dns.TypeA)
+	withEDNS.SetEdns0(4096, false)
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.", dns.TypeA)
+
+	for _, test := range []struct {
+		cookies bool
+		request *dns.Msg
+		proven  bool
+		want    int
+	}{
+		// Without -dns-cookies no client can prove its address, so none is held to 512 bytes
+		{false, withEDNS, false, hardenMaxUDPSize},
+		{false, plain, false, dns.MinMsgSize},
+		{true, withEDNS, false, hardenUnprovenSize},
+		{true, withEDNS, true, hardenMaxUDPSize},
+	} {
+		dnsCookies = test.cookies
+		if got := hardenedUDPSize(test.request, test.proven); got != test.want {
+			t.Errorf("hardenedUDPSize with cookies %v, EDNS0 %v, proven %v = %d, want %d",
+				test.cookies, test.request.IsEdns0() != nil, test.proven, got, test.want)
+		}
+	}
+}
+
+func TestHardenPublic(t *testing.T) {
+	hardenPublic, hardenRate = true, 0
+	t.Cleanup(func() { hardenPublic, hardenRate = false, 10 })
+	// An answer of 100 addresses, far larger than a UDP response may be
+	manyAddresses := func(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+		var records []dns.RR
+		for i := 0; i < 100; i++ {
+			records = append(records, &dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.IPv4(198, 51, 100, byte(i)),
+			})
+		}
+		return records, nil
+	}
+	handler := resolveDNSRequestWith(nil, manyAddresses)
+
+	// ANY is refused outright
+	before := metrics.Get("dnstoy_rejected_queries_total", "kind", "refused", "reason", "any")
+	request := new(dns.Msg)
+	request.SetQuestion("example.", dns.TypeANY)
+	writer := newTestWriter()
+	handler(writer, request)
+	if writer.msg == nil || writer.msg.Rcode != dns.RcodeRefused || len(writer.msg.Answer) != 0 {
+		t.Errorf("ANY answered %v, want REFUSED", writer.msg)
+	}
+	if got := metrics.Get("dnstoy_rejected_queries_total", "kind", "refused", "reason", "any"); got != before+1 {
+		t.Errorf("refused ANY queries went from %v to %v, want one more", before, got)
+	}
+
+	// Large UDP answers are cut to the client's size, at most -harden-max-udp-size, and marked truncated
+	for _, test := range []struct {
+		ednsSize uint16 // 0 for a client without EDNS0
+		want     int
+	}{
+		{0, dns.MinMsgSize},
+		{1000, 1000},
+		{4096, hardenMaxUDPSize},
+	} {
+		request := new(dns.Msg)
+		request.SetQuestion("big.example.", dns.TypeA)
+		if test.ednsSize > 0 {
+			request.SetEdns0(test.ednsSize, false)
+		}
+		writer := newTestWriter()
+		handler(writer, request)
+		packed, err := writer.msg.Pack()
+		if err != nil {
+			t.Fatalf("Pack: %s", err)
+		}
+		if len(packed) > test.want || !writer.msg.Truncated {
+			t.Errorf("client size %d got %d bytes (truncated %v), want at most %d and TC set", test.ednsSize, len(packed), writer.msg.Truncated, test.want)
+		}
+	}
+
+	// TCP clients get the whole answer
+	writer = &testWriter{remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 40000}}
+	request = new(dns.Msg)
+	request.SetQuestion("big.example.", dns.TypeA)
+	handler(writer, request)
+	if len(writer.msg.Answer) != 100 || writer.msg.Truncated {
+		t.Errorf("TCP answer has %d records (truncated %v), want all 100", len(writer.msg.Answer), writer.msg.Truncated)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/chaoticcyber/dnsToy/internal/metrics"
+	"github.com/miekg/dns"
+)
+
+// upstreamServer tracks the health of one configured upstream
+type upstreamServer struct {
+	addr     string
+	failures int  // Consecutive failed health probes
+	ejected  bool // Set while the upstream is out of rotation
+}
+
+var (
+	upstreamPool  []*upstreamServer // Upstreams from -udns in configured order
+	upstreamNext  int               // Round robin position in upstreamPool
+	upstreamMutex sync.Mutex        // Guards upstreamPool state and upstreamNext
+)
+
+// Function to build the upstream pool from the comma separated -udns value
+func parseUpstreams(value string) {
+	upstreamPool = nil
+	for _, addr := range strings.Split(value, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		upstreamPool = append(upstreamPool, &upstreamServer{addr: addr})
+		metrics.Set("dnstoy_upstream_up", 1, "upstream", addr)
+	}
+}
+
+// Function to check if any upstream is configured, an empty -udns runs the server cache-only
+func hasUpstreams() bool {
+	upstreamMutex.Lock()
+	defer upstreamMutex.Unlock()
+	return len(upstreamPool) > 0
+}
+
+// Function to pick the next healthy upstream in round robin order, falling back to
+// ejected ones when every upstream is failing
+func pickUpstream() string {
+	upstreamMutex.Lock()
+	defer upstreamMutex.Unlock()
+	if len(upstreamPool) == 0 {
+		return ""
+	}
+	for i := 0; i < len(upstreamPool); i++ {
+		server := upstreamPool[(upstreamNext+i)%len(upstreamPool)]
+		if !server.ejected {
+			upstreamNext = (upstreamNext + i + 1) % len(upstreamPool)
+			return server.addr
+		}
+	}
+	server := upstreamPool[upstreamNext%len(upstreamPool)]
+	upstreamNext = (upstreamNext + 1) % len(upstreamPool)
+	return server.addr
+}
+
+// Function to pick the upstream for a cache miss, the one set for the domain in the database
+// or else the next one from the pool
+func upstreamFor(db *sql.DB, domain string) string {
+	if server, found := dbfunc.GetUpstream(reader(db), domain); found {
+		return server
+	}
+	return pickUpstream()
+}
+
+// Function to probe every upstream on an interval, ejecting ones that keep failing
+func runHealthChecks(interval time.Duration) {
+	ticker := appClock.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C() {
+		checkUpstreams()
+	}
+}
+
+// Function to send the probe query to each upstream and update its health
+func checkUpstreams() {
+	c := &dns.Client{Timeout: healthCheckTimeout}
+	probe := new(dns.Msg)
+	probe.SetQuestion(dns.Fqdn(healthProbeDomain), dns.TypeA)
+
+	upstreamMutex.Lock()
+	servers := append([]*upstreamServer(nil), upstreamPool...)
+	upstreamMutex.Unlock()
+
+	for _, server := range servers {
+		resp, _, err := exchangeDirect(c, probe, server.addr)
+		healthy := err == nil && resp.Rcode != dns.RcodeServerFailure && resp.Rcode != dns.RcodeRefused
+
+		upstreamMutex.Lock()
+		if healthy {
+			if server.ejected {
+				log.Printf("Upstream %s recovered, returning it to rotation\n", server.addr)
+			}
+			server.failures = 0
+			server.ejected = false
+		} else {
+			server.failures++
+			metrics.Inc("dnstoy_upstream_health_failures_total", "upstream", server.addr)
+			if !server.ejected && server.failures >= healthMaxFailures {
+				log.Printf("Upstream %s failed %d health checks, ejecting it from rotation\n", server.addr, server.failures)
+				server.ejected = true
+			}
+		}
+		up := 1.0
+		if server.ejected {
+			up = 0
+		}
+		upstreamMutex.Unlock()
+		metrics.Set("dnstoy_upstream_up", up, "upstream", server.addr)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/miekg/dns"
+)
+
+func TestHealthChecksIgnoreUpstreamSlots(t *testing.T) {
+	server := startStubUpstream(t, answerStubA)
+	parseUpstreams(server)
+	t.Cleanup(func() { parseUpstreams("") })
+	saturateUpstreamSlots(t)
+
+	for i := 0; i < healthMaxFailures+1; i++ {
+		checkUpstreams()
+	}
+	if upstreamPool[0].failures != 0 || upstreamPool[0].ejected {
+		t.Errorf("healthy upstream got %d failures (ejected %v) while every slot was taken", upstreamPool[0].failures, upstreamPool[0].ejected)
+	}
+}
+
+func TestHealthChecksEjectAndRejoin(t *testing.T) {
+	healthy := startStubUpstream(t, answerStubA)
+	var failing atomic.Bool
+	flaky := startStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		if failing.Load() {
+			response := new(dns.Msg)
+			response.SetRcode(request, dns.RcodeServerFailure)
+			writer.WriteMsg(response)
+			return
+		}
+		answerStubA(writer, request)
+	})
+	parseUpstreams(healthy + "," + flaky)
+	t.Cleanup(func() { parseUpstreams("") })
+	picks := func() map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < 4; i++ {
+			counts[pickUpstream()]++
+		}
+		return counts
+	}
+
+	failing.Store(true)
+	for i := 1; i < healthMaxFailures; i++ {
+		checkUpstreams()
+	}
+	if upstreamPool[1].ejected {
+		t.Fatalf("flaky upstream ejected after %d failures, want %d", healthMaxFailures-1, healthMaxFailures)
+	}
+	checkUpstreams()
+	if !upstreamPool[1].ejected || upstreamPool[0].ejected {
+		t.Fatalf("after %d failed checks ejected = %v, %v, want only the flaky upstream", healthMaxFailures, upstreamPool[0].ejected, upstreamPool[1].ejected)
+	}
+	if counts := picks(); counts[healthy] != 4 {
+		t.Errorf("picked %v with the flaky upstream ejected, want only %s", counts, healthy)
+	}
+
+	// One good probe returns it to rotation
+	failing.Store(false)
+	checkUpstreams()
+	if upstreamPool[1].ejected || upstreamPool[1].failures != 0 {
+		t.Fatalf("recovered upstream still ejected %v with %d failures", upstreamPool[1].ejected, upstreamPool[1].failures)
+	}
+	if counts := picks(); counts[healthy] != 2 || counts[flaky] != 2 {
+		t.Errorf("picked %v after recovery, want both upstreams in turn", counts)
+	}
+}
+
+func TestUpstreamOverride(t *testing.T) {
+	db := newTestDB(t)
+	var defaultAsked atomic.Int32
+	useStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		defaultAsked.Add(1)
+		answerStubA(writer, request)
+	})
+	override := startStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		response := new(dns.Msg)
+		response.SetReply(request)
+		response.Answer = append(response.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: request.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(198, 51, 100, 7),
+		})
+		writer.WriteMsg(response)
+	})
+	if err := dbfunc.SetUpstream(db, "routed.example", override); err != nil {
+		t.Fatalf("SetUpstream: %s", err)
+	}
+
+	// Only the domain with its own upstream is forwarded there, the rest go to the configured one
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{"routed.example.", "198.51.100.7"},
+		{"other.example.", "192.0.2.1"},
+	} {
+		request := new(dns.Msg)
+		request.SetQuestion(test.name, dns.TypeA)
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		if got := answerIPs(writer.msg); len(got) != 1 || got[0] != test.want {
+			t.Errorf("%s answered %v, want %s", test.name, got, test.want)
+		}
+	}
+	if got := defaultAsked.Load(); got != 1 {
+		t.Errorf("configured upstream asked %d times, want only for other.example.", got)
+	}
+
+	// Clearing the override sends the domain back to the configured upstreams
+	if err := dbfunc.SetUpstream(db, "routed.example", ""); err != nil {
+		t.Fatalf("SetUpstream: %s", err)
+	}
+	if got := upstreamFor(db, "routed.example."); got == override {
+		t.Errorf("upstreamFor still picked %s after the override was cleared", got)
+	}
+}
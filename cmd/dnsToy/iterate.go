@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxIterations caps the referrals and minimized steps a single iterative lookup takes
+const maxIterations = 32
+
+// maxGluelessDepth caps how deep the lookups of nameservers delegated without glue may nest
+const maxGluelessDepth = 3
+
+// iterativeResolver resolves names with -recursive, walking the delegations down from the root
+// servers instead of forwarding the question to the -udns upstreams
+type iterativeResolver struct {
+	roots    []string     // Root server addresses the walk starts from
+	minimize bool         // Ask each zone's servers only for the next label (RFC 7816)
+	exchange exchangeFunc // Sends one query to one nameserver
+}
+
+// resolveIterative is the -recursive resolver the handler asks in place of the upstreams, nil to forward
+var resolveIterative resolveFunc
+
+// Function to create the -recursive resolver from comma separated -root-servers addresses, the port
+// defaulting to 53
+func newIterativeResolver(roots string, minimize bool) (*iterativeResolver, error) {
+	resolver := &iterativeResolver{minimize: minimize, exchange: exchangeUpstream}
+	for _, root := range strings.Split(roots, ",") {
+		root = strings.TrimSpace(root)
+		if root == "" {
+			continue
+		}
+		if net.ParseIP(root) != nil {
+			root = net.JoinHostPort(root, "53")
+		}
+		if _, _, err := net.SplitHostPort(root); err != nil {
+			return nil, err
+		}
+		resolver.roots = append(resolver.roots, root)
+	}
+	if len(resolver.roots) == 0 {
+		return nil, fmt.Errorf("no root servers given")
+	}
+	return resolver, nil
+}
+
+// Function to resolve a name from the root servers down, as a resolveFunc. CNAMEs in the final
+// answer are passed on as they are
+func (r *iterativeResolver) resolve(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	return r.lookup(ctx, strings.ToLower(dns.Fqdn(name)), qtype, 0)
+}
+
+// Function to walk the delegations towards name. With minimize the servers of each zone are only
+// asked for the NS records of the name one label below the zone, so no server sees more of the
+// name than it needs to refer us onwards
+func (r *iterativeResolver) lookup(ctx context.Context, name string, qtype uint16, nesting int) ([]dns.RR, error) {
+	labels := dns.CountLabel(name)
+	servers := r.roots
+	zone := "."
+	// depth is the number of labels of the name asked for next
+	depth := 1
+	for i := 0; i < maxIterations; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		qname, qt := name, qtype
+		if r.minimize && depth < labels {
+			qname, qt = lastLabels(name, depth), dns.TypeNS
+		}
+		response, err := r.query(servers, qname, qt)
+		if err != nil {
+			return nil, err
+		}
+		if cut, nameservers := referral(response, zone, qname); cut != "" {
+			next, err := r.nameserverAddresses(ctx, nameservers, response, nesting)
+			if err != nil {
+				return nil, err
+			}
+			zone, servers, depth = cut, next, dns.CountLabel(cut)+1
+			continue
+		}
+		if qname != name {
+			// Nothing exists below a name that doesn't exist (RFC 8020)
+			if response.Rcode == dns.RcodeNameError {
+				return nil, fmt.Errorf("%s: %w", name, errNXDOMAIN)
+			}
+			// No zone cut at this label, so ask the same servers for one label more
+			depth++
+			continue
+		}
+		switch response.Rcode {
+		case dns.RcodeSuccess:
+			return response.Answer, nil
+		case dns.RcodeNameError:
+			return nil, fmt.Errorf("%s: %w", name, errNXDOMAIN)
+		default:
+			return nil, fmt.Errorf("resolving %s: servers of %s answered %s", name, zone, dns.RcodeToString[response.Rcode])
+		}
+	}
+	return nil, fmt.Errorf("resolving %s took more than %d steps", name, maxIterations)
+}
+
+// Function to ask the servers of a zone one question without recursion, trying each until one answers
+func (r *iterativeResolver) query(servers []string, qname string, qtype uint16) (*dns.Msg, error) {
+	c := new(dns.Client)
+	m := new(dns.Msg)
+	m.SetQuestion(qname, qtype)
+	m.RecursionDesired = false
+	var lastErr error
+	for _, server := range servers {
+		response, _, err := r.exchange(c, m, server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if response.Rcode == dns.RcodeServerFailure || response.Rcode == dns.RcodeRefused {
+			lastErr = fmt.Errorf("%s answered %s for %s", server, dns.RcodeToString[response.Rcode], qname)
+			continue
+		}
+		return response, nil
+	}
+	return nil, fmt.Errorf("error querying %s %s: %w", qname, dns.TypeToString[qtype], lastErr)
+}
+
+// Function to get the zone cut a response refers us to and its nameservers, or an empty cut when it
+// isn't a referral. Only a cut below the current zone and at or above qname is followed, so a
+// server can't send the walk sideways or back up
+func referral(response *dns.Msg, zone, qname string) (string, []string) {
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) > 0 {
+		return "", nil
+	}
+	cut := ""
+	var nameservers []string
+	for _, rr := range response.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		owner := strings.ToLower(ns.Hdr.Name)
+		if owner == zone || !dns.IsSubDomain(zone, owner) || !dns.IsSubDomain(owner, qname) {
+			continue
+		}
+		if cut != "" && owner != cut {
+			continue
+		}
+		cut = owner
+		nameservers = append(nameservers, strings.ToLower(ns.Ns))
+	}
+	return cut, nameservers
+}
+
+// Function to get the addresses of the nameservers a referral names, from its glue or, for
+// nameservers delegated without glue, by resolving their names
+func (r *iterativeResolver) nameserverAddresses(ctx context.Context, nameservers []string, response *dns.Msg, nesting int) ([]string, error) {
+	var addresses []string
+	for _, rr := range response.Extra {
+		if a, ok := rr.(*dns.A); ok && containsName(nameservers, a.Hdr.Name) {
+			addresses = append(addresses, net.JoinHostPort(a.A.String(), "53"))
+		}
+	}
+	if len(addresses) > 0 {
+		return addresses, nil
+	}
+	if nesting >= maxGluelessDepth {
+		return nil, fmt.Errorf("nameservers %v have no glue and are nested too deep", nameservers)
+	}
+	var lastErr error
+	for _, nameserver := range nameservers {
+		records, err := r.lookup(ctx, nameserver, dns.TypeA, nesting+1)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, rr := range records {
+			if a, ok := rr.(*dns.A); ok {
+				addresses = append(addresses, net.JoinHostPort(a.A.String(), "53"))
+			}
+		}
+		if len(addresses) > 0 {
+			return addresses, nil
+		}
+	}
+	return nil, fmt.Errorf("no address for nameservers %v: %v", nameservers, lastErr)
+}
+
+// Function to check if names holds name, ignoring case
+func containsName(names []string, name string) bool {
+	for _, candidate := range names {
+		if strings.EqualFold(candidate, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to get the last count labels of a fully qualified name, e.g. 2 of www.example.com. is example.com.
+func lastLabels(name string, count int) string {
+	offsets := dns.Split(name)
+	if count >= len(offsets) {
+		return name
+	}
+	return name[offsets[len(offsets)-count]:]
+}
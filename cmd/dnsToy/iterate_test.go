@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeDelegation answers like the nameservers of a small delegation chain: the root refers
+// example. to 198.51.100.2, which refers www.example. to 198.51.100.3, which holds a.b.www.example.
+type fakeDelegation struct {
+	mu    sync.Mutex
+	asked map[string][]string // Server address to the questions it received, as "name TYPE"
+}
+
+func (f *fakeDelegation) exchange(c *dns.Client, m *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	question := m.Question[0]
+	f.mu.Lock()
+	f.asked[server] = append(f.asked[server], question.Name+" "+dns.TypeToString[question.Qtype])
+	f.mu.Unlock()
+	if m.RecursionDesired {
+		return nil, 0, fmt.Errorf("recursion desired sent to %s", server)
+	}
+	response := new(dns.Msg)
+	response.SetReply(m)
+	refer := func(zone, nameserver, ip string) {
+		ns, _ := dns.NewRR(fmt.Sprintf("%s 3600 IN NS %s", zone, nameserver))
+		glue, _ := dns.NewRR(fmt.Sprintf("%s 3600 IN A %s", nameserver, ip))
+		response.Ns = append(response.Ns, ns)
+		response.Extra = append(response.Extra, glue)
+	}
+	switch server {
+	case "198.51.100.1:53":
+		if !dns.IsSubDomain("example.", question.Name) {
+			response.Rcode = dns.RcodeNameError
+			break
+		}
+		refer("example.", "ns.example.", "198.51.100.2")
+	case "198.51.100.2:53":
+		switch {
+		case dns.IsSubDomain("www.example.", question.Name):
+			refer("www.example.", "ns.www.example.", "198.51.100.3")
+		case question.Name != "example.":
+			response.Rcode = dns.RcodeNameError
+		}
+	case "198.51.100.3:53":
+		response.Authoritative = true
+		switch question.Name {
+		case "a.b.www.example.":
+			if question.Qtype == dns.TypeA {
+				a, _ := dns.NewRR("a.b.www.example. 300 IN A 192.0.2.80")
+				response.Answer = append(response.Answer, a)
+			}
+		case "b.www.example.", "www.example.":
+			// An empty non-terminal or the apex, NOERROR with no answer
+		default:
+			response.Rcode = dns.RcodeNameError
+		}
+	default:
+		return nil, 0, &net.OpError{Op: "dial", Net: "udp", Err: errors.New("unknown server " + server)}
+	}
+	return response, 0, nil
+}
+
+func newFakeDelegation(t *testing.T, minimize bool) (*iterativeResolver, *fakeDelegation) {
+	t.Helper()
+	fake := &fakeDelegation{asked: make(map[string][]string)}
+	resolver, err := newIterativeResolver("198.51.100.1", minimize)
+	if err != nil {
+		t.Fatalf("newIterativeResolver: %s", err)
+	}
+	resolver.exchange = fake.exchange
+	return resolver, fake
+}
+
+func TestQNAMEMinimization(t *testing.T) {
+	resolver, fake := newFakeDelegation(t, true)
+	records, err := resolver.resolve(context.Background(), "A.b.WWW.example", dns.TypeA)
+	if err != nil {
+		t.Fatalf("resolve: %s", err)
+	}
+	if len(records) != 1 || records[0].(*dns.A).A.String() != "192.0.2.80" {
+		t.Errorf("resolve = %v, want the A record of a.b.www.example.", records)
+	}
+	// Each parent only learns the label below its own zone
+	for server, want := range map[string][]string{
+		"198.51.100.1:53": {"example. NS"},
+		"198.51.100.2:53": {"www.example. NS"},
+		"198.51.100.3:53": {"b.www.example. NS", "a.b.www.example. A"},
+	} {
+		if !slices.Equal(fake.asked[server], want) {
+			t.Errorf("%s was asked %v, want %v", server, fake.asked[server], want)
+		}
+	}
+}
+
+func TestIterativeWithoutMinimization(t *testing.T) {
+	resolver, fake := newFakeDelegation(t, false)
+	if _, err := resolver.resolve(context.Background(), "a.b.www.example.", dns.TypeA); err != nil {
+		t.Fatalf("resolve: %s", err)
+	}
+	if asked := fake.asked["198.51.100.1:53"]; !slices.Equal(asked, []string{"a.b.www.example. A"}) {
+		t.Errorf("root was asked %v, want the full name", asked)
+	}
+}
+
+func TestMinimizedNXDOMAINStopsEarly(t *testing.T) {
+	resolver, fake := newFakeDelegation(t, true)
+	_, err := resolver.resolve(context.Background(), "deep.name.missing.example.", dns.TypeA)
+	if !errors.Is(err, errNXDOMAIN) {
+		t.Fatalf("resolve error = %v, want NXDOMAIN", err)
+	}
+	// Nothing exists below missing.example., so deeper labels are never sent
+	if asked := fake.asked["198.51.100.2:53"]; !slices.Equal(asked, []string{"missing.example. NS"}) {
+		t.Errorf("example. servers were asked %v, want only missing.example. NS", asked)
+	}
+}
+
+func TestRecursiveHandler(t *testing.T) {
+	db := newTestDB(t)
+	resolver, _ := newFakeDelegation(t, true)
+	request := new(dns.Msg)
+	request.SetQuestion("a.b.www.example.", dns.TypeA)
+	writer := newTestWriter()
+	resolveDNSRequestWith(db, resolver.resolve)(writer, request)
+	if ips := answerIPs(writer.msg); len(ips) != 1 || ips[0] != "192.0.2.80" {
+		t.Errorf("handler answered %v, want 192.0.2.80", ips)
+	}
+}
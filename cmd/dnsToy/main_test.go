@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/chaoticcyber/dnsToy/internal/metrics"
+	"github.com/miekg/dns"
+)
+
+// Function to set -bind-retries and -bind-retry-interval for a test
+func setBindRetries(t *testing.T, retries int, interval time.Duration) {
+	t.Helper()
+	oldRetries, oldInterval := bindRetries, bindRetryInterval
+	bindRetries, bindRetryInterval = retries, interval
+	t.Cleanup(func() { bindRetries, bindRetryInterval = oldRetries, oldInterval })
+}
+
+func TestListenAndServeRetriesBusyAddress(t *testing.T) {
+	setBindRetries(t, 5, 20*time.Millisecond)
+	// An old listener still holds the address when the server starts, and goes away shortly after
+	held, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	addr := held.LocalAddr().String()
+	server := &dns.Server{Addr: addr, Net: "udp", Handler: dns.HandlerFunc(answerStubA)}
+	served := make(chan error, 1)
+	go func() { served <- listenAndServeWithRetry(server) }()
+	time.Sleep(50 * time.Millisecond)
+	held.Close()
+
+	// The server answers once a retry gets the address
+	client := &dns.Client{Timeout: 200 * time.Millisecond}
+	request := new(dns.Msg)
+	request.SetQuestion("retry.example.", dns.TypeA)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if response, _, err := client.Exchange(request, addr); err == nil && len(answerIPs(response)) == 1 {
+			break
+		}
+		select {
+		case err := <-served:
+			t.Fatalf("listenAndServeWithRetry gave up: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server never answered after the address was freed")
+		}
+	}
+	if err := server.Shutdown(); err != nil {
+		t.Errorf("Shutdown: %s", err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("listenAndServeWithRetry = %v after shutdown, want nil", err)
+	}
+}
+
+func TestListenAndServeGivesUpAfterRetries(t *testing.T) {
+	setBindRetries(t, 2, 10*time.Millisecond)
+	held, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	defer held.Close()
+	server := &dns.Server{Addr: held.LocalAddr().String(), Net: "udp", Handler: dns.HandlerFunc(answerStubA)}
+	start := time.Now()
+	if err := listenAndServeWithRetry(server); err == nil {
+		t.Fatal("listenAndServeWithRetry bound an address that is in use")
+	}
+	// Two retries wait 10ms and then 20ms
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("gave up after %s, want the 2 retries to wait at least 30ms", elapsed)
+	}
+}
+
+// Function to find a free loopback port for both UDP and TCP
+func freeLoopbackAddr(t *testing.T) string {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("ListenPacket: %s", err)
+		}
+		addr := conn.LocalAddr().String()
+		conn.Close()
+		if listener, err := net.Listen("tcp", addr); err == nil {
+			listener.Close()
+			return addr
+		}
+	}
+	t.Fatal("no free loopback port for UDP and TCP")
+	return ""
+}
+
+func TestServeSeveralAddresses(t *testing.T) {
+	db := newTestDB(t)
+	disableLookups(t)
+	if err := dbfunc.AddToDatabase(db, dbfunc.Resolution{Domain: "both.example.", IP: "192.0.2.5", TTL: 300}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	first, second := freeLoopbackAddr(t), freeLoopbackAddr(t)
+	servers := newDNSServers(first+", "+second, resolveDNSRequest(db))
+	if len(servers) != 4 {
+		t.Fatalf("got %d servers for 2 addresses, want UDP and TCP on each", len(servers))
+	}
+	for _, server := range servers {
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		go func(server *dns.Server) {
+			if err := listenAndServe(server); err != nil {
+				t.Errorf("serving %s %s: %s", server.Net, server.Addr, err)
+			}
+		}(server)
+		<-started
+	}
+	defer func() {
+		for _, server := range servers {
+			server.Shutdown()
+		}
+	}()
+
+	request := new(dns.Msg)
+	request.SetQuestion("both.example.", dns.TypeA)
+	for _, addr := range []string{first, second} {
+		for _, network := range []string{"udp", "tcp"} {
+			client := &dns.Client{Net: network, Timeout: 2 * time.Second}
+			response, _, err := client.Exchange(request, addr)
+			if err != nil {
+				t.Errorf("%s %s: %s", network, addr, err)
+				continue
+			}
+			if ips := answerIPs(response); len(ips) != 1 || ips[0] != "192.0.2.5" {
+				t.Errorf("%s %s answered %v, want 192.0.2.5", network, addr, ips)
+			}
+		}
+	}
+}
+
+// Function to replace stdin with a pipe for a test, returning its write end
+func pipeStdin(t *testing.T) *os.File {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %s", err)
+	}
+	stdin := os.Stdin
+	os.Stdin = reader
+	t.Cleanup(func() {
+		writer.Close()
+		reader.Close()
+		os.Stdin = stdin
+	})
+	return writer
+}
+
+func TestNoInteractiveLeavesStdinAlone(t *testing.T) {
+	db := newTestDB(t)
+	t.Cleanup(func() { noInteractive = false; enableDNSLookup.Store(true) })
+	for _, test := range []struct {
+		noInteractive bool
+		lookups       bool
+	}{
+		{true, true},
+		{false, false},
+	} {
+		noInteractive = test.noInteractive
+		enableDNSLookup.Store(true)
+		stdin := pipeStdin(t)
+		if started := startConsole(db); started == test.noInteractive {
+			t.Errorf("-no-interactive=%t started the console %t", test.noInteractive, started)
+		}
+		if _, err := stdin.WriteString("disable\n"); err != nil {
+			t.Fatalf("writing to stdin: %s", err)
+		}
+		// Only a console reading stdin turns lookups off
+		deadline := time.Now().Add(200 * time.Millisecond)
+		for enableDNSLookup.Load() && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if got := enableDNSLookup.Load(); got != test.lookups {
+			t.Errorf("-no-interactive=%t left lookups %t after a disable command on stdin, want %t", test.noInteractive, got, test.lookups)
+		}
+		stdin.Close()
+	}
+}
+
+func TestBindPermissionMessage(t *testing.T) {
+	// The error a non-root listen on port 53 fails with
+	err := &net.OpError{Op: "listen", Net: "udp", Err: os.NewSyscallError("bind", syscall.EACCES)}
+	if !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("%v isn't recognized as a permission error", err)
+	}
+	message := bindPermissionMessage(":53", err)
+	for _, want := range []string{
+		"Permission denied binding :53 (listen udp: bind: permission denied)",
+		"sudo setcap cap_net_bind_service=+ep " + os.Args[0],
+		"-addr 127.0.0.1:5353",
+		"run dnsToy as root",
+	} {
+		if !strings.Contains(message, want) {
+			t.Errorf("message is missing %q:\n%s", want, message)
+		}
+	}
+}
+
+func TestNoDBForwardsWithoutDatabase(t *testing.T) {
+	noDB = true
+	t.Cleanup(func() { noDB = false })
+	path := filepath.Join(t.TempDir(), "dns.db")
+	db, err := openDatabase(path)
+	if err != nil || db != nil {
+		t.Fatalf("openDatabase with -no-db = %v, %v, want no database", db, err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("-no-db left a database file at %s: %v", path, err)
+	}
+
+	var asked atomic.Int32
+	useStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		asked.Add(1)
+		answerStubA(writer, request)
+	})
+	// Every query is forwarded, nothing is cached in between
+	for i := 1; i <= 2; i++ {
+		request := new(dns.Msg)
+		request.SetQuestion("forwarded.example.", dns.TypeA)
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		if got := answerIPs(writer.msg); len(got) != 1 || got[0] != "192.0.2.1" {
+			t.Fatalf("query %d answered %v, want the upstream's 192.0.2.1", i, got)
+		}
+		if got := asked.Load(); got != int32(i) {
+			t.Errorf("upstream asked %d times after %d queries, want every query forwarded", got, i)
+		}
+	}
+}
+
+func TestAdvertisedUDPSize(t *testing.T) {
+	for _, test := range []struct {
+		clientSize uint16 // 0 for a client without EDNS0
+		want       uint16
+	}{
+		{0, 512},
+		{1000, 1000},
+		{1232, 1232},
+		{65535, 1232},
+	} {
+		request := new(dns.Msg)
+		request.SetQuestion("example.", dns.TypeA)
+		if test.clientSize > 0 {
+			request.SetEdns0(test.clientSize, false)
+		}
+		if got := advertisedUDPSize(request); got != test.want {
+			t.Errorf("advertisedUDPSize for a client size of %d = %d, want %d", test.clientSize, got, test.want)
+		}
+	}
+}
+
+func TestUDPReadSizeBoundsServer(t *testing.T) {
+	db := newTestDB(t)
+	disableLookups(t)
+	if err := dbfunc.AddToDatabase(db, dbfunc.Resolution{Domain: "sized.example.", IP: "192.0.2.5", TTL: 300}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	debugCacheInfo = true
+	t.Cleanup(func() { debugCacheInfo = false })
+	addr := freeLoopbackAddr(t)
+	server := newDNSServers(addr, resolveDNSRequest(db))[0]
+	if server.Net != "udp" || server.UDPSize != udpReadSize {
+		t.Fatalf("%s server reads %d bytes, want udp with -udp-read-size %d", server.Net, server.UDPSize, udpReadSize)
+	}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go listenAndServe(server)
+	<-started
+	defer server.Shutdown()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer conn.Close()
+
+	// Function to send a query padded to size bytes, returning the answer or nil when there is none
+	exchange := func(size int) *dns.Msg {
+		t.Helper()
+		request := new(dns.Msg)
+		request.SetQuestion("sized.example.", dns.TypeA)
+		request.SetEdns0(65535, false)
+		request.IsEdns0().Option = append(request.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, size-request.Len()-4)})
+		packet, err := request.Pack()
+		if err != nil || len(packet) != size {
+			t.Fatalf("packed %d bytes (%v), want %d", len(packet), err, size)
+		}
+		if _, err := conn.Write(packet); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, dns.MaxMsgSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil
+		}
+		response := new(dns.Msg)
+		if err := response.Unpack(buf[:n]); err != nil {
+			t.Fatalf("Unpack: %s", err)
+		}
+		return response
+	}
+
+	// A query that fits is answered, advertising no more than the server reads however much the client offers
+	response := exchange(udpReadSize)
+	if response == nil || len(answerIPs(response)) != 1 {
+		t.Fatalf("query of %d bytes answered %v, want the stored address", udpReadSize, response)
+	}
+	if opt := response.IsEdns0(); opt == nil || int(opt.UDPSize()) != udpReadSize {
+		t.Errorf("answer advertises %v, want an EDNS0 size of %d", opt, udpReadSize)
+	}
+	// A larger one is cut off at the read buffer, so it can't be parsed and isn't answered
+	if response := exchange(udpReadSize + 500); response != nil && response.Rcode != dns.RcodeFormatError {
+		t.Errorf("query of %d bytes answered %s, want it rejected", udpReadSize+500, dns.RcodeToString[response.Rcode])
+	}
+	// The server keeps serving after it
+	if response := exchange(600); response == nil || len(answerIPs(response)) != 1 {
+		t.Errorf("query after the oversized one answered %v, want the stored address", response)
+	}
+}
+
+func TestInstanceNameTagsLogsAndMetrics(t *testing.T) {
+	logged := captureLog(t)
+	setInstanceName("resolver-2")
+	t.Cleanup(func() {
+		log.SetPrefix("")
+		metrics.SetConstLabels()
+	})
+	metrics.Inc("dnstoy_instance_test_total")
+
+	// The miss the handler logs for a new name carries the instance name
+	db := newTestDB(t)
+	useStubUpstream(t, answerStubA)
+	logMissesOnly = true
+	t.Cleanup(func() { logMissesOnly = false })
+	request := new(dns.Msg)
+	request.SetQuestion("tagged.example.", dns.TypeA)
+	resolveDNSRequest(db)(newTestWriter(), request)
+	if !strings.Contains(logged.String(), "miss tagged.example. A") {
+		t.Fatalf("the miss logged %q, want a miss line", logged.String())
+	}
+	for _, line := range strings.Split(strings.TrimSpace(logged.String()), "\n") {
+		if !strings.HasPrefix(line, "instance=resolver-2 ") {
+			t.Errorf("log line %q doesn't start with the instance name", line)
+		}
+	}
+
+	var text strings.Builder
+	if err := metrics.WriteText(&text); err != nil {
+		t.Fatalf("WriteText: %s", err)
+	}
+	if !strings.Contains(text.String(), `dnstoy_instance_test_total{instance="resolver-2"} 1`) {
+		t.Errorf("metrics don't carry the instance label:\n%s", text.String())
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/chaoticcyber/dnsToy/internal/metrics"
+)
+
+// Function to serve the metrics endpoint on -metrics-addr
+func startMetricsServer(addr string) {
+	mux := newMetricsMux()
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Error starting metrics server: %s\n", err)
+		}
+	}()
+}
+
+// Function to build the handler for /metrics and /stats.json
+func newMetricsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := metrics.WriteText(w); err != nil {
+			log.Printf("Error writing metrics: %s\n", err)
+		}
+	})
+	mux.HandleFunc("/stats.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(currentStats()); err != nil {
+			log.Printf("Error writing stats: %s\n", err)
+		}
+	})
+	return mux
+}
+
+// statsSnapshot is the JSON form of the main counters served on /stats.json
+type statsSnapshot struct {
+	Queries        uint64            `json:"queries"`
+	CacheHits      uint64            `json:"cache_hits"`
+	CacheMisses    uint64            `json:"cache_misses"`
+	UpstreamErrors uint64            `json:"upstream_errors"`
+	Rcodes         map[string]uint64 `json:"rcodes"`
+}
+
+// Function to read the main counters from the metrics registry
+func currentStats() statsSnapshot {
+	stats := statsSnapshot{
+		Queries:        uint64(metrics.Total("dnstoy_queries_total")),
+		CacheHits:      uint64(metrics.Total("dnstoy_cache_hits_total")),
+		CacheMisses:    uint64(metrics.Total("dnstoy_cache_misses_total")),
+		UpstreamErrors: uint64(metrics.Total("dnstoy_upstream_errors_total")),
+		Rcodes:         make(map[string]uint64),
+	}
+	for rcode, count := range metrics.ByLabel("dnstoy_responses_total", "rcode") {
+		stats.Rcodes[rcode] = uint64(count)
+	}
+	return stats
+}
+
+// Function to get the counts taken since an earlier snapshot, so a caller can measure the
+// queries it sent itself while other ones are counted too
+func (s statsSnapshot) since(earlier statsSnapshot) statsSnapshot {
+	delta := statsSnapshot{
+		Queries:        s.Queries - earlier.Queries,
+		CacheHits:      s.CacheHits - earlier.CacheHits,
+		CacheMisses:    s.CacheMisses - earlier.CacheMisses,
+		UpstreamErrors: s.UpstreamErrors - earlier.UpstreamErrors,
+		Rcodes:         make(map[string]uint64),
+	}
+	for rcode, count := range s.Rcodes {
+		if count > earlier.Rcodes[rcode] {
+			delta.Rcodes[rcode] = count - earlier.Rcodes[rcode]
+		}
+	}
+	return delta
+}
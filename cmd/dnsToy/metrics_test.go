@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/metrics"
+	"github.com/miekg/dns"
+)
+
+func TestStatsAfterQueries(t *testing.T) {
+	db := newTestDB(t)
+	server := startStubUpstream(t, answerStubA)
+	handler := chainMiddlewares(resolveDNSRequest(db), countQueries)
+	before := currentStats()
+
+	// The first query for a name misses and is resolved, the rest are answered from the cache
+	parseUpstreams(server)
+	t.Cleanup(func() { parseUpstreams("") })
+	request := new(dns.Msg)
+	request.SetQuestion("stats.example.", dns.TypeA)
+	for i := 0; i < 4; i++ {
+		handler.ServeDNS(newTestWriter(), request)
+	}
+
+	// Nothing listens on a port that was just closed, so the lookup fails upstream
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	parseUpstreams(closed.LocalAddr().String())
+	closed.Close()
+	request.SetQuestion("unreachable.example.", dns.TypeA)
+	handler.ServeDNS(newTestWriter(), request)
+
+	stats := currentStats().since(before)
+	if stats.Queries != 5 || stats.CacheHits != 3 || stats.CacheMisses != 2 || stats.UpstreamErrors != 1 {
+		t.Errorf("stats after 5 queries = %+v, want 5 queries, 3 hits, 2 misses and 1 upstream error", stats)
+	}
+	if stats.Rcodes["NOERROR"] != 4 || stats.Rcodes["SERVFAIL"] != 1 {
+		t.Errorf("rcodes %v, want 4 NOERROR and the failed lookup SERVFAIL", stats.Rcodes)
+	}
+}
+
+func TestStatsJSONEndpoint(t *testing.T) {
+	db := newTestDB(t)
+	disableLookups(t)
+	server := httptest.NewServer(newMetricsMux())
+	defer server.Close()
+	fetch := func() statsSnapshot {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/stats.json")
+		if err != nil {
+			t.Fatalf("GET /stats.json: %s", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+			t.Fatalf("GET /stats.json = %s, %q", resp.Status, resp.Header.Get("Content-Type"))
+		}
+		var stats statsSnapshot
+		if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+			t.Fatalf("decoding /stats.json: %s", err)
+		}
+		return stats
+	}
+
+	before := fetch()
+	request := new(dns.Msg)
+	request.SetQuestion("missing.example.", dns.TypeA)
+	handler := chainMiddlewares(resolveDNSRequest(db), countQueries)
+	handler.ServeDNS(newTestWriter(), request)
+	handler.ServeDNS(newTestWriter(), request)
+
+	stats := fetch().since(before)
+	if stats.Queries != 2 || stats.Rcodes["NXDOMAIN"] != 2 {
+		t.Errorf("/stats.json counted %+v, want 2 queries answered NXDOMAIN", stats)
+	}
+}
+
+func TestMalformedQueriesCounted(t *testing.T) {
+	db := newTestDB(t)
+	disableLookups(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: conn, Handler: resolveDNSRequest(db), MsgAcceptFunc: acceptMsg, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	defer server.Shutdown()
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	defer client.Close()
+
+	for _, test := range []struct {
+		name   string
+		packet []byte
+		reason string
+	}{
+		// A query header with no question is turned away before it is parsed
+		{"no question", []byte{0x12, 0x34, 0x01, 0x00, 0, 0, 0, 0, 0, 0, 0, 0}, "header"},
+		// More questions than maxQuestions
+		{"too many questions", []byte{0x12, 0x35, 0x01, 0x00, 0, maxQuestions + 1, 0, 0, 0, 0, 0, 0}, "header"},
+	} {
+		before := metrics.Get("dnstoy_rejected_queries_total", "kind", "formerr", "reason", test.reason)
+		if _, err := client.Write(test.packet); err != nil {
+			t.Fatalf("%s: Write: %s", test.name, err)
+		}
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 512)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("%s: no answer: %s", test.name, err)
+		}
+		response := new(dns.Msg)
+		if err := response.Unpack(buf[:n]); err != nil || response.Rcode != dns.RcodeFormatError {
+			t.Errorf("%s answered %v (%v), want FORMERR", test.name, response.Rcode, err)
+		}
+		if got := metrics.Get("dnstoy_rejected_queries_total", "kind", "formerr", "reason", test.reason); got != before+1 {
+			t.Errorf("%s: formerr counter for %s went from %v to %v, want one more", test.name, test.reason, before, got)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/chaoticcyber/dnsToy/internal/metrics"
+	"github.com/miekg/dns"
+)
+
+// Middleware wraps a handler with one step of request processing, it either passes the request
+// on to next or answers (or drops) it itself
+type Middleware func(next dns.Handler) dns.Handler
+
+// defaultMiddlewares is the -middleware order the server runs its built in steps in
+const defaultMiddlewares = "metrics,log,drop,ratelimit"
+
+// builtinMiddlewares are the steps -middleware can select by name
+var builtinMiddlewares = map[string]Middleware{
+	"metrics":   countQueries,
+	"log":       logQueries,
+	"drop":      dropForTesting,
+	"ratelimit": limitGlobalRate,
+}
+
+// requiredMiddlewares always run after the -middleware steps, whatever it lists: draining has to
+// refuse every new query, and a NOTIFY must never be resolved like a query
+var requiredMiddlewares = []Middleware{refuseWhileDraining, answerNotify}
+
+// middlewares run in order in front of the resolving handler, set from -middleware
+var middlewares []Middleware
+
+// Function to parse the comma separated -middleware names into the middlewares to run, in order
+func parseMiddlewares(value string) ([]Middleware, error) {
+	var chain []Middleware
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		middleware, found := builtinMiddlewares[name]
+		if !found {
+			return nil, fmt.Errorf("unknown middleware %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("middleware %q is listed twice", name)
+		}
+		seen[name] = true
+		chain = append(chain, middleware)
+	}
+	return chain, nil
+}
+
+// Function to get the middlewares the server runs, the -middleware steps followed by the required ones
+func serverMiddlewares() []Middleware {
+	return append(append([]Middleware(nil), middlewares...), requiredMiddlewares...)
+}
+
+// Function to wrap a handler in middlewares, the first one sees each request first
+func chainMiddlewares(handler dns.Handler, chain ...Middleware) dns.Handler {
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = chain[i](handler)
+	}
+	return handler
+}
+
+// Function to answer a request with REFUSED before it reaches the resolving handler
+func refuseRequest(writer dns.ResponseWriter, request *dns.Msg, reason string) {
+	countRejected("refused", reason)
+	response := new(dns.Msg)
+	response.SetRcode(request, dns.RcodeRefused)
+	metrics.Inc("dnstoy_responses_total", "rcode", dns.RcodeToString[response.Rcode])
+	if err := writer.WriteMsg(response); err != nil {
+		log.Printf("Error writing DNS response: %s\n", err)
+	}
+}
+
+// Function to count every query the server receives
+func countQueries(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(writer dns.ResponseWriter, request *dns.Msg) {
+		metrics.Inc("dnstoy_queries_total")
+		next.ServeDNS(writer, request)
+	})
+}
+
+// Function to log every decoded query with -debug-wire
+func logQueries(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(writer dns.ResponseWriter, request *dns.Msg) {
+		logWire("query from", writer, request)
+		next.ServeDNS(writer, request)
+	})
+}
+
+// Function to refuse new work while draining, so load balancers route away from the server
+func refuseWhileDraining(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(writer dns.ResponseWriter, request *dns.Msg) {
+		if !startQuery() {
+			refuseRequest(writer, request, "draining")
+			return
+		}
+		defer finishQuery()
+		next.ServeDNS(writer, request)
+	})
+}
+
+// Function to simulate packet loss for -drop-rate by never answering
+func dropForTesting(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(writer dns.ResponseWriter, request *dns.Msg) {
+		if shouldDrop(request) {
+			countRejected("dropped", "drop_rate")
+			return
+		}
+		next.ServeDNS(writer, request)
+	})
+}
+
+// Function to shed load past -global-rate-limit no matter who is asking
+func limitGlobalRate(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(writer dns.ResponseWriter, request *dns.Msg) {
+		if allowGlobal() {
+			next.ServeDNS(writer, request)
+			return
+		}
+		if globalRateAction == "drop" {
+			countRejected("dropped", "global_rate")
+			return
+		}
+		refuseRequest(writer, request, "global_rate")
+	})
+}
+
+// Function to acknowledge or refuse zone change notifications, which are never resolved
+func answerNotify(next dns.Handler) dns.Handler {
+	return dns.HandlerFunc(func(writer dns.ResponseWriter, request *dns.Msg) {
+		if request.Opcode == dns.OpcodeNotify {
+			handleNotify(writer, request)
+			return
+		}
+		next.ServeDNS(writer, request)
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMiddlewareAnswersItself(t *testing.T) {
+	resolved := false
+	handler := dns.HandlerFunc(func(writer dns.ResponseWriter, request *dns.Msg) { resolved = true })
+	answer := func(next dns.Handler) dns.Handler {
+		return dns.HandlerFunc(func(writer dns.ResponseWriter, request *dns.Msg) {
+			response := new(dns.Msg)
+			response.SetRcode(request, dns.RcodeNameError)
+			writer.WriteMsg(response)
+		})
+	}
+
+	request := new(dns.Msg)
+	request.SetQuestion("answered.example.", dns.TypeA)
+	writer := newTestWriter()
+	chainMiddlewares(handler, countQueries, answer).ServeDNS(writer, request)
+	if resolved {
+		t.Error("handler ran after a middleware answered the request")
+	}
+	if writer.msg == nil || writer.msg.Rcode != dns.RcodeNameError {
+		t.Errorf("response = %v, want the middleware's NXDOMAIN", writer.msg)
+	}
+}
+
+func TestRequiredMiddlewaresNotConfigurable(t *testing.T) {
+	for _, name := range []string{"drain", "notify"} {
+		if _, err := parseMiddlewares("metrics," + name); err == nil {
+			t.Errorf("-middleware accepted %q, which always runs", name)
+		}
+	}
+	if _, err := parseMiddlewares(defaultMiddlewares); err != nil {
+		t.Errorf("default -middleware: %s", err)
+	}
+}
+
+func TestNotifyHandledWithEmptyMiddlewareList(t *testing.T) {
+	db := newTestDB(t)
+	saved := middlewares
+	middlewares = nil
+	t.Cleanup(func() { middlewares = saved })
+
+	request := new(dns.Msg)
+	request.SetQuestion("example.", dns.TypeSOA)
+	request.Opcode = dns.OpcodeNotify
+	writer := newTestWriter()
+	handleDNSRequest(db).ServeDNS(writer, request)
+	// -allow-notify is off, so the NOTIFY is refused rather than resolved
+	if writer.msg == nil || writer.msg.Rcode != dns.RcodeRefused || writer.msg.Opcode != dns.OpcodeNotify {
+		t.Errorf("NOTIFY with no -middleware answered %v, want REFUSED by the NOTIFY handler", writer.msg)
+	}
+}
+
+func TestDebugWireLogsMessages(t *testing.T) {
+	db := newTestDB(t)
+	disableLookups(t)
+	logged := captureLog(t)
+	handler := chainMiddlewares(resolveDNSRequest(db), logQueries)
+	request := new(dns.Msg)
+	request.SetQuestion("wire.example.", dns.TypeA)
+
+	handler.ServeDNS(newTestWriter(), request)
+	if logged.Len() != 0 {
+		t.Errorf("without -debug-wire the query logged %q", logged.String())
+	}
+
+	debugWire = true
+	t.Cleanup(func() { debugWire = false })
+	handler.ServeDNS(newTestWriter(), request)
+	for _, want := range []string{"query from 192.0.2.10:40000", "response to 192.0.2.10:40000", ";wire.example.\tIN\t A", "status: NXDOMAIN"} {
+		if !strings.Contains(logged.String(), want) {
+			t.Errorf("-debug-wire log is missing %q:\n%s", want, logged.String())
+		}
+	}
+}
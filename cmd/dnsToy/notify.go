@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/chaoticcyber/dnsToy/internal/metrics"
+	"github.com/miekg/dns"
+)
+
+// notifyACL are the client networks allowed to send NOTIFY messages with -allow-notify
+var notifyACL []*net.IPNet
+
+// Function to answer a NOTIFY (RFC 1996) instead of resolving it like a query, acknowledging
+// it for clients in -notify-acl and refusing it otherwise
+func handleNotify(writer dns.ResponseWriter, request *dns.Msg) {
+	response := new(dns.Msg)
+	reason := ""
+	switch {
+	case !allowNotify:
+		reason = "notify_disabled"
+	case !aclAllows(notifyACL, clientIP(writer)):
+		reason = "notify_acl"
+	}
+	if reason != "" {
+		countRejected("refused", reason)
+		metrics.Inc("dnstoy_notify_total", "result", "refused")
+		response.SetRcode(request, dns.RcodeRefused)
+	} else {
+		// There is no secondary zone to refresh, the acknowledgment only stops the primary resending
+		metrics.Inc("dnstoy_notify_total", "result", "acknowledged")
+		response.SetReply(request)
+		response.Authoritative = true
+		zone := "."
+		if len(request.Question) > 0 {
+			zone = request.Question[0].Name
+		}
+		log.Printf("Received NOTIFY for %s from %s\n", zone, clientIP(writer))
+	}
+	metrics.Inc("dnstoy_responses_total", "rcode", dns.RcodeToString[response.Rcode])
+	logWire("response to", writer, response)
+	if err := writer.WriteMsg(response); err != nil {
+		log.Printf("Error writing DNS response: %s\n", err)
+	}
+}
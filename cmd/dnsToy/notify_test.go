@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/chaoticcyber/dnsToy/internal/metrics"
+	"github.com/miekg/dns"
+)
+
+func TestNotify(t *testing.T) {
+	resolved := 0
+	handler := answerNotify(dns.HandlerFunc(func(writer dns.ResponseWriter, request *dns.Msg) {
+		resolved++
+	}))
+	t.Cleanup(func() { allowNotify, notifyACL = false, nil })
+
+	for _, test := range []struct {
+		name   string
+		allow  bool
+		acl    string
+		rcode  int
+		result string
+	}{
+		{"disabled", false, "192.0.2.0/24", dns.RcodeRefused, "refused"},
+		{"client outside the ACL", true, "198.51.100.0/24", dns.RcodeRefused, "refused"},
+		{"client in the ACL", true, "198.51.100.0/24, 192.0.2.10", dns.RcodeSuccess, "acknowledged"},
+	} {
+		acl, err := parseACL(test.acl)
+		if err != nil {
+			t.Fatalf("parseACL(%s): %s", test.acl, err)
+		}
+		allowNotify, notifyACL = test.allow, acl
+		before := metrics.Get("dnstoy_notify_total", "result", test.result)
+
+		request := new(dns.Msg)
+		request.SetNotify("corp.example.")
+		writer := newTestWriter()
+		handler.ServeDNS(writer, request)
+		if writer.msg == nil || writer.msg.Rcode != test.rcode || writer.msg.Opcode != dns.OpcodeNotify || writer.msg.Id != request.Id {
+			t.Errorf("%s: NOTIFY answered %v, want a NOTIFY reply with %s", test.name, writer.msg, dns.RcodeToString[test.rcode])
+		} else if test.rcode == dns.RcodeSuccess && !writer.msg.Authoritative {
+			t.Errorf("%s: acknowledgment isn't authoritative", test.name)
+		}
+		if got := metrics.Get("dnstoy_notify_total", "result", test.result); got != before+1 {
+			t.Errorf("%s: %s NOTIFYs went from %v to %v, want one more", test.name, test.result, before, got)
+		}
+	}
+	if resolved != 0 {
+		t.Errorf("%d NOTIFYs were resolved like queries", resolved)
+	}
+
+	// Queries go on to be resolved
+	request := new(dns.Msg)
+	request.SetQuestion("corp.example.", dns.TypeA)
+	handler.ServeDNS(newTestWriter(), request)
+	if resolved != 1 {
+		t.Error("a query wasn't passed on to be resolved")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxIdleConnsPerUpstream caps how many idle TCP connections are kept open to each upstream
+const maxIdleConnsPerUpstream = 4
+
+// upstreamDialTimeout bounds connecting to an upstream over TCP
+const upstreamDialTimeout = 2 * time.Second
+
+// idleConn is a TCP connection to an upstream waiting to be reused
+type idleConn struct {
+	conn      *dns.Conn
+	idleSince time.Time
+}
+
+// connPool keeps idle TCP connections to the upstreams so queries skip the handshake
+type connPool struct {
+	mutex sync.Mutex
+	idle  map[string][]idleConn // Idle connections by upstream address, most recently used last
+}
+
+// upstreamConns holds the connections reused for TCP upstream queries
+var upstreamConns = &connPool{idle: make(map[string][]idleConn)}
+
+// Function to take an idle connection to server, closing any that sat longer than -upstream-idle-timeout
+func (p *connPool) get(server string) *dns.Conn {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	conns := p.idle[server]
+	for len(conns) > 0 {
+		last := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		if appClock.Now().Sub(last.idleSince) < upstreamIdleTimeout {
+			p.idle[server] = conns
+			return last.conn
+		}
+		last.conn.Close()
+	}
+	delete(p.idle, server)
+	return nil
+}
+
+// Function to return a connection to the pool once its query is answered
+func (p *connPool) put(server string, conn *dns.Conn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.idle[server]) >= maxIdleConnsPerUpstream {
+		conn.Close()
+		return
+	}
+	p.idle[server] = append(p.idle[server], idleConn{conn: conn, idleSince: appClock.Now()})
+}
+
+// Function to open a TCP connection to an upstream, through the SOCKS5 proxy when one is set
+func dialUpstream(server string) (*dns.Conn, error) {
+	var conn net.Conn
+	var err error
+	if upstreamDialer != nil {
+		conn, err = upstreamDialer.Dial("tcp", server)
+	} else {
+		conn, err = net.DialTimeout("tcp", server, upstreamDialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// Function to send a query over a pooled TCP connection, reusing an idle one when there is one
+func exchangePooled(c *dns.Client, m *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	if conn := upstreamConns.get(server); conn != nil {
+		resp, rtt, err := c.ExchangeWithConn(m, conn)
+		if err == nil {
+			upstreamConns.put(server, conn)
+			return resp, rtt, nil
+		}
+		// The upstream may have closed the idle connection, so retry on a fresh one
+		conn.Close()
+	}
+	conn, err := dialUpstream(server)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, rtt, err := c.ExchangeWithConn(m, conn)
+	if err != nil {
+		conn.Close()
+		return nil, 0, err
+	}
+	upstreamConns.put(server, conn)
+	return resp, rtt, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// countingListener counts the connections a TCP test server accepts
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+// Function to start a TCP DNS server answering with answerStubA, returning its address and listener
+func startCountingTCPServer(tb testing.TB) (string, *countingListener) {
+	tb.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("Listen: %s", err)
+	}
+	listener := &countingListener{Listener: inner}
+	started := make(chan struct{})
+	server := &dns.Server{Listener: listener, Handler: dns.HandlerFunc(answerStubA), NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	addr := inner.Addr().String()
+	tb.Cleanup(func() {
+		for conn := upstreamConns.get(addr); conn != nil; conn = upstreamConns.get(addr) {
+			conn.Close()
+		}
+		server.Shutdown()
+	})
+	return addr, listener
+}
+
+func TestExchangePooledReusesConnections(t *testing.T) {
+	fake := useFakeClock(t, time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	server, listener := startCountingTCPServer(t)
+	c := new(dns.Client)
+	query := func(name string) {
+		t.Helper()
+		request := new(dns.Msg)
+		request.SetQuestion(name, dns.TypeA)
+		response, _, err := exchangePooled(c, request, server)
+		if err != nil {
+			t.Fatalf("exchangePooled(%s): %s", name, err)
+		}
+		// Each answer has to belong to its own query, not one left on a reused connection
+		if response.Id != request.Id || len(response.Answer) != 1 || response.Answer[0].Header().Name != name {
+			t.Fatalf("query %d for %s got answer %d %v", request.Id, name, response.Id, response.Answer)
+		}
+	}
+
+	for _, name := range []string{"one.example.", "two.example.", "three.example."} {
+		query(name)
+	}
+	if got := listener.accepted.Load(); got != 1 {
+		t.Errorf("3 queries opened %d connections, want 1 reused", got)
+	}
+
+	// A connection the upstream dropped while idle is replaced
+	conn := upstreamConns.get(server)
+	conn.Conn.Close()
+	upstreamConns.put(server, conn)
+	query("four.example.")
+	if got := listener.accepted.Load(); got != 2 {
+		t.Errorf("after the idle connection was dropped %d connections were opened, want 2", got)
+	}
+
+	// One idle past -upstream-idle-timeout is closed instead of reused
+	fake.Advance(upstreamIdleTimeout)
+	query("five.example.")
+	if got := listener.accepted.Load(); got != 3 {
+		t.Errorf("after the idle timeout %d connections were opened, want 3", got)
+	}
+}
+
+func BenchmarkUpstreamTCP(b *testing.B) {
+	server, _ := startCountingTCPServer(b)
+	request := new(dns.Msg)
+	request.SetQuestion("bench.example.", dns.TypeA)
+	b.Run("Pooled", func(b *testing.B) {
+		c := new(dns.Client)
+		for i := 0; i < b.N; i++ {
+			if _, _, err := exchangePooled(c, request, server); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("PerQuery", func(b *testing.B) {
+		c := &dns.Client{Net: "tcp"}
+		for i := 0; i < b.N; i++ {
+			if _, _, err := c.Exchange(request, server); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
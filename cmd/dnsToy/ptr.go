@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/miekg/dns"
+)
+
+// privateNetworks are the RFC1918 ranges whose reverse lookups are answered locally by -local-ptr,
+// along with loopback addresses
+var privateNetworks = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// Function to turn a full in-addr.arpa or ip6.arpa name back into the address it describes
+func reverseToIP(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+	if strings.HasSuffix(name, ".ip6.arpa.") {
+		return reverse6ToIP(name)
+	}
+	if !strings.HasSuffix(name, ".in-addr.arpa.") {
+		return nil
+	}
+	labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+	if len(labels) != 4 {
+		return nil
+	}
+	// The octets are stored in reverse order
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return net.ParseIP(strings.Join(labels, ".")).To4()
+}
+
+// Function to turn a full ip6.arpa name, one label per nibble, back into the IPv6 address it describes
+func reverse6ToIP(name string) net.IP {
+	labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
+	if len(labels) != 32 {
+		return nil
+	}
+	var hex strings.Builder
+	for i := len(labels) - 1; i >= 0; i-- {
+		if len(labels[i]) != 1 {
+			return nil
+		}
+		hex.WriteString(labels[i])
+		if i%4 == 0 && i > 0 {
+			hex.WriteByte(':')
+		}
+	}
+	return net.ParseIP(hex.String())
+}
+
+// Function to check if an address is loopback (127.0.0.0/8 or ::1) or in one of the private ranges
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to answer a private PTR query from the database, or NXDOMAIN when nothing maps to the address
+func answerLocalPTR(db *sql.DB, response *dns.Msg, question dns.Question, ip net.IP) {
+	domain, err := dbfunc.GetDomainForIP(db, ip.String())
+	if err == dbfunc.ErrNotFound {
+		response.Rcode = dns.RcodeNameError
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		response.Rcode = dns.RcodeServerFailure
+		return
+	}
+	answerRecord := dns.PTR{
+		Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: serveTTL(defaultTTL)},
+		Ptr: dns.Fqdn(domain),
+	}
+	response.Answer = append(response.Answer, &answerRecord)
+}
+
+// selfReverseNames are the reverse lookup names of the addresses the server listens on, for -self-ptr
+var selfReverseNames = make(map[string]bool)
+
+// Function to collect the addresses the listeners are bound to, expanding wildcard addresses
+// to those of every interface
+func listenIPs(addrs string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			ips = append(ips, ip)
+			continue
+		}
+		if host != "" && net.ParseIP(host) == nil {
+			resolved, err := net.LookupIP(host)
+			if err != nil {
+				return nil, err
+			}
+			ips = append(ips, resolved...)
+			continue
+		}
+		interfaceAddrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, interfaceAddr := range interfaceAddrs {
+			if network, ok := interfaceAddr.(*net.IPNet); ok {
+				ips = append(ips, network.IP)
+			}
+		}
+	}
+	return ips, nil
+}
+
+// Function to remember the reverse names of the listen addresses answered by -self-ptr
+func setupSelfPTR(addrs string) error {
+	ips, err := listenIPs(addrs)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if name, err := dns.ReverseAddr(ip.String()); err == nil {
+			selfReverseNames[name] = true
+		}
+	}
+	return nil
+}
+
+// Function to answer a PTR query for one of the server's own addresses with the -self-ptr name
+func answerSelfPTR(response *dns.Msg, question dns.Question) bool {
+	if selfPTR == "" || !selfReverseNames[strings.ToLower(dns.Fqdn(question.Name))] {
+		return false
+	}
+	answerRecord := dns.PTR{
+		Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: serveTTL(defaultTTL)},
+		Ptr: dns.Fqdn(selfPTR),
+	}
+	response.Answer = append(response.Answer, &answerRecord)
+	return true
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestReverseToIP(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		want string
+	}{
+		{"10.2.0.192.in-addr.arpa.", "192.0.2.10"},
+		{"1.0.0.127.IN-ADDR.ARPA", "127.0.0.1"},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.ip6.arpa.", "::1"},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", "2001:db8::1"},
+		{"0.192.in-addr.arpa.", ""},
+		{"1.0.ip6.arpa.", ""},
+		{"example.", ""},
+	} {
+		got := reverseToIP(test.name)
+		if (got == nil && test.want != "") || (got != nil && got.String() != test.want) {
+			t.Errorf("reverseToIP(%s) = %v, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLoopbackPTRAnsweredLocally(t *testing.T) {
+	db := newTestDB(t)
+	for _, address := range []string{"127.0.0.1", "127.1.2.3", "::1", "192.168.1.1"} {
+		name, err := dns.ReverseAddr(address)
+		if err != nil {
+			t.Fatalf("ReverseAddr(%s): %s", address, err)
+		}
+		ip := reverseToIP(name)
+		if ip == nil || !isPrivateIP(ip) {
+			t.Errorf("%s isn't answered locally", address)
+		}
+		request := new(dns.Msg)
+		request.SetQuestion(name, dns.TypePTR)
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		if writer.msg == nil || writer.msg.Rcode != dns.RcodeNameError {
+			t.Errorf("PTR for %s wasn't answered with a local NXDOMAIN", address)
+		}
+	}
+	if isPrivateIP(reverseToIP("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.")) {
+		t.Error("2001:db8::1 counted as private")
+	}
+}
+
+func TestSelfPTR(t *testing.T) {
+	db := newTestDB(t)
+	disableLookups(t)
+	selfPTR = "resolver.lan"
+	t.Cleanup(func() {
+		selfPTR = ""
+		selfReverseNames = make(map[string]bool)
+	})
+	if err := setupSelfPTR("192.0.2.53:53, [2001:db8::53]:53"); err != nil {
+		t.Fatalf("setupSelfPTR: %s", err)
+	}
+
+	for _, test := range []struct {
+		address string
+		self    bool
+	}{
+		{"192.0.2.53", true},
+		{"2001:db8::53", true},
+		{"192.0.2.54", false},
+	} {
+		name, err := dns.ReverseAddr(test.address)
+		if err != nil {
+			t.Fatalf("ReverseAddr(%s): %s", test.address, err)
+		}
+		request := new(dns.Msg)
+		request.SetQuestion(name, dns.TypePTR)
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		answered := false
+		if len(writer.msg.Answer) == 1 {
+			ptr, ok := writer.msg.Answer[0].(*dns.PTR)
+			answered = ok && ptr.Ptr == "resolver.lan."
+		}
+		if answered != test.self {
+			t.Errorf("PTR for %s answered %v, want the -self-ptr name %v", test.address, writer.msg.Answer, test.self)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/miekg/dns"
+)
+
+var (
+	queryLog      *json.Encoder // Writes -query-log lines, nil without a query log
+	queryLogMutex sync.Mutex    // Keeps lines from concurrent queries apart
+)
+
+// Function to open -query-log for appending
+func openQueryLog(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	queryLog = json.NewEncoder(file)
+	return nil
+}
+
+// Function to write a line to the query log for each question of an answered request
+func logQuery(writer dns.ResponseWriter, request, response *dns.Msg) {
+	if queryLog == nil {
+		return
+	}
+	entry := dbfunc.QueryLogEntry{Time: appClock.Now().UTC(), Rcode: dns.RcodeToString[response.Rcode]}
+	if ip := clientIP(writer); ip != nil {
+		entry.Client = ip.String()
+	}
+	queryLogMutex.Lock()
+	defer queryLogMutex.Unlock()
+	for _, question := range request.Question {
+		entry.Name, entry.Qtype = question.Name, dns.TypeToString[question.Qtype]
+		if err := queryLog.Encode(entry); err != nil {
+			log.Printf("Error writing query log: %s\n", err)
+			return
+		}
+	}
+}
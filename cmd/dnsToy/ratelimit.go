@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket allows a rate of queries per second with bursts of up to one second's worth
+type tokenBucket struct {
+	tokens float64   // Queries that may still be sent right away
+	last   time.Time // Time the bucket was last refilled
+}
+
+// Function to refill the bucket for the time passed and take a token, false when it is empty
+func (b *tokenBucket) take(now time.Time, rate int) bool {
+	b.tokens = min(float64(rate), b.tokens+now.Sub(b.last).Seconds()*float64(rate))
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+var (
+	globalBucket *tokenBucket // Bucket shared by every query for -global-rate-limit, created on first use
+	globalMutex  sync.Mutex   // Guards globalBucket
+)
+
+// Function to take a query from the -global-rate-limit bucket, false when the server is over its rate
+func allowGlobal() bool {
+	if globalRateLimit <= 0 {
+		return true
+	}
+	now := appClock.Now()
+	globalMutex.Lock()
+	defer globalMutex.Unlock()
+	if globalBucket == nil {
+		globalBucket = &tokenBucket{tokens: float64(globalRateLimit), last: now}
+	}
+	return globalBucket.take(now, globalRateLimit)
+}
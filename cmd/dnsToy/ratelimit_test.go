@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestGlobalRateLimit(t *testing.T) {
+	fake := useFakeClock(t, time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	globalRateLimit, globalBucket = 5, nil
+	t.Cleanup(func() { globalRateLimit, globalRateAction, globalBucket = 0, "refuse", nil })
+	answered := 0
+	handler := limitGlobalRate(dns.HandlerFunc(func(writer dns.ResponseWriter, request *dns.Msg) {
+		answered++
+		response := new(dns.Msg)
+		response.SetReply(request)
+		writer.WriteMsg(response)
+	}))
+
+	// Function to fire a burst of queries, each from its own client, counting the answered and refused ones
+	burst := func(queries int) (int, int) {
+		t.Helper()
+		before, refused := answered, 0
+		for i := 0; i < queries; i++ {
+			request := new(dns.Msg)
+			request.SetQuestion("example.", dns.TypeA)
+			writer := &testWriter{remote: &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(i)), Port: 40000}}
+			handler.ServeDNS(writer, request)
+			if writer.msg != nil && writer.msg.Rcode == dns.RcodeRefused {
+				refused++
+			}
+		}
+		return answered - before, refused
+	}
+
+	// The bucket holds one second of queries, however many clients they come from
+	if got, refused := burst(20); got != 5 || refused != 15 {
+		t.Errorf("first burst answered %d and refused %d, want 5 and 15", got, refused)
+	}
+	fake.Advance(200 * time.Millisecond)
+	if got, _ := burst(20); got != 1 {
+		t.Errorf("burst after 200ms answered %d, want the 1 query refilled", got)
+	}
+	fake.Advance(10 * time.Second)
+	if got, _ := burst(20); got != 5 {
+		t.Errorf("burst after a long pause answered %d, want no more than a full bucket of 5", got)
+	}
+
+	// Dropped queries get no answer at all
+	globalRateAction = "drop"
+	if got, refused := burst(3); got != 0 || refused != 0 {
+		t.Errorf("over the limit with drop answered %d and refused %d, want nothing sent", got, refused)
+	}
+}
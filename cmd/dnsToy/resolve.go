@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// resolveFunc resolves a name and query type to the records answering it, standing in for the
+// upstream servers in a handler built with resolveDNSRequestWith. Returning an error wrapping
+// errNXDOMAIN answers NXDOMAIN, any other error SERVFAIL
+type resolveFunc func(ctx context.Context, name string, qtype uint16) ([]dns.RR, error)
+
+// Function to resolve an A question with an injected resolver the way DnsLookup does with an
+// upstream, adding its records to response and returning the A record IPs and their lowest TTL
+func lookupWith(resolve resolveFunc, response *dns.Msg, domain string) ([]net.IP, uint32, error) {
+	records, err := resolve(context.Background(), dns.Fqdn(domain), dns.TypeA)
+	if err != nil {
+		return nil, 0, err
+	}
+	var ips []net.IP
+	var ttl uint32
+	for _, rr := range records {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+		if len(ips) == 0 || a.Hdr.Ttl < ttl {
+			ttl = a.Hdr.Ttl
+		}
+		ips = append(ips, a.A)
+	}
+	if len(ips) == 0 {
+		return nil, 0, errNoData
+	}
+	for _, rr := range records {
+		rr.Header().Ttl = serveTTL(rr.Header().Ttl)
+	}
+	response.Answer = append(response.Answer, records...)
+	return ips, ttl, nil
+}
+
+// Function to answer a question with an injected resolver the way forwardToResponse does with an upstream
+func forwardWith(resolve resolveFunc, response *dns.Msg, question dns.Question) {
+	records, err := resolve(context.Background(), question.Name, question.Qtype)
+	if errors.Is(err, errNXDOMAIN) {
+		response.Rcode = dns.RcodeNameError
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		response.Rcode = dns.RcodeServerFailure
+		return
+	}
+	for _, rr := range records {
+		rr.Header().Ttl = serveTTL(rr.Header().Ttl)
+	}
+	response.Answer = append(response.Answer, records...)
+}
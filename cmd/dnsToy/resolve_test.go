@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/miekg/dns"
+)
+
+// Function to resolve from canned records alone, every other name doesn't exist
+func cannedResolver(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	switch {
+	case name == "canned.example." && qtype == dns.TypeA:
+		rr, _ := dns.NewRR("canned.example. 120 IN A 198.51.100.7")
+		return []dns.RR{rr}, nil
+	case name == "canned.example." && qtype == dns.TypeTXT:
+		rr, _ := dns.NewRR(`canned.example. 120 IN TXT "hello"`)
+		return []dns.RR{rr}, nil
+	}
+	return nil, fmt.Errorf("%s: %w", name, errNXDOMAIN)
+}
+
+func TestHandlerWithInjectedResolver(t *testing.T) {
+	db := newTestDB(t)
+	if hasUpstreams() {
+		t.Fatal("test needs no upstream servers configured")
+	}
+	handler := resolveDNSRequestWith(db, cannedResolver)
+
+	for _, test := range []struct {
+		name  string
+		qtype uint16
+		rcode int
+		want  string
+	}{
+		{"canned.example.", dns.TypeA, dns.RcodeSuccess, "198.51.100.7"},
+		{"canned.example.", dns.TypeTXT, dns.RcodeSuccess, "hello"},
+		{"missing.example.", dns.TypeA, dns.RcodeNameError, ""},
+	} {
+		request := new(dns.Msg)
+		request.SetQuestion(test.name, test.qtype)
+		writer := newTestWriter()
+		handler(writer, request)
+		response := writer.msg
+		if response.Rcode != test.rcode {
+			t.Errorf("%s %s: rcode %s, want %s", test.name, dns.TypeToString[test.qtype], dns.RcodeToString[response.Rcode], dns.RcodeToString[test.rcode])
+			continue
+		}
+		got := ""
+		for _, rr := range response.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				got = rr.A.String()
+			case *dns.TXT:
+				got = rr.Txt[0]
+			}
+		}
+		if got != test.want {
+			t.Errorf("%s %s answered %q, want %q", test.name, dns.TypeToString[test.qtype], got, test.want)
+		}
+	}
+
+	// The A answer was stored like an upstream one
+	r, _, err := dbfunc.GetWithExpiry(db, "canned.example", 0, 0)
+	if err != nil || r.IP != "198.51.100.7" || r.TTL != 120 {
+		t.Errorf("stored %+v, %v", r, err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// maxRotationEntries bounds the rotation index, it starts over once this many names are tracked
+const maxRotationEntries = 10000
+
+var (
+	rotation      = make(map[string]uint64) // Name and type to the number of answers rotated for it so far
+	rotationMutex sync.Mutex                // Guards rotation
+)
+
+// Function to rotate the address records answering a question for -rr-rotate, so each query
+// leads with the next address in round-robin order
+func rotateAnswers(response *dns.Msg, question dns.Question) {
+	if question.Qtype != dns.TypeA && question.Qtype != dns.TypeAAAA {
+		return
+	}
+	var positions []int
+	for i, rr := range response.Answer {
+		if rr.Header().Rrtype == question.Qtype && strings.EqualFold(rr.Header().Name, question.Name) {
+			positions = append(positions, i)
+		}
+	}
+	if len(positions) < 2 {
+		return
+	}
+
+	key := strings.ToLower(question.Name) + "/" + dns.TypeToString[question.Qtype]
+	rotationMutex.Lock()
+	if len(rotation) >= maxRotationEntries {
+		rotation = make(map[string]uint64)
+	}
+	offset := int(rotation[key] % uint64(len(positions)))
+	rotation[key]++
+	rotationMutex.Unlock()
+
+	records := make([]dns.RR, len(positions))
+	for i, pos := range positions {
+		records[i] = response.Answer[pos]
+	}
+	for i, pos := range positions {
+		response.Answer[pos] = records[(i+offset)%len(records)]
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRotationLeadsWithNextAddress(t *testing.T) {
+	db := newTestDB(t)
+	useStubUpstream(t, answerStubMultiA)
+	rrRotate = true
+	t.Cleanup(func() { rrRotate = false })
+
+	request := new(dns.Msg)
+	request.SetQuestion("rotate.example.", dns.TypeA)
+	// The first query resolves upstream, the rest are answered from the stored addresses
+	var leads []string
+	for i := 0; i < 4; i++ {
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		ips := answerIPs(writer.msg)
+		if len(ips) != 3 {
+			t.Fatalf("query %d answered %v, want all three addresses", i, ips)
+		}
+		leads = append(leads, ips[0])
+	}
+	if want := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.1"}; !slices.Equal(leads, want) {
+		t.Errorf("lead addresses %v, want %v", leads, want)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/chaoticcyber/dnsToy/internal/metrics"
+	"github.com/chaoticcyber/dnsToy/internal/rpz"
+	"github.com/miekg/dns"
+)
+
+// rpzPolicy is the response policy zone loaded from -rpz, nil when there is none
+var rpzPolicy *rpz.Policy
+
+// Function to load the -rpz zone
+func loadRPZ() error {
+	if rpzFile == "" {
+		return nil
+	}
+	policy, err := rpz.Load(rpzFile)
+	if err != nil {
+		return err
+	}
+	rpzPolicy = policy
+	log.Printf("Loaded %d RPZ triggers from %s\n", rpzPolicy.Len(), rpzFile)
+	return nil
+}
+
+// Function to find the RPZ rule for a question, a rule for the client's address wins over one for the name
+func matchRPZ(writer dns.ResponseWriter, name string) *rpz.Rule {
+	if rule := rpzPolicy.MatchClientIP(clientIP(writer)); rule != nil {
+		return rule
+	}
+	return rpzPolicy.MatchQName(name)
+}
+
+// Function to answer a question with an RPZ rule that rewrites it, passthru and drop are up to the caller
+func answerRPZ(response *dns.Msg, question dns.Question, rule *rpz.Rule) {
+	metrics.Inc("dnstoy_rpz_hits_total", "action", rule.Action.String())
+	switch rule.Action {
+	case rpz.ActionNXDOMAIN:
+		response.Rcode = dns.RcodeNameError
+	case rpz.ActionLocalData:
+		for _, rr := range rule.Answer(question.Name, question.Qtype) {
+			rr.Header().Ttl = serveTTL(rr.Header().Ttl)
+			response.Answer = append(response.Answer, rr)
+		}
+	}
+}
+
+// Function to find the RPZ rule for the addresses in a response's answers, nil when none triggers one
+func matchRPZAnswer(response *dns.Msg) *rpz.Rule {
+	if rpzPolicy == nil {
+		return nil
+	}
+	for _, rr := range response.Answer {
+		var ip net.IP
+		switch record := rr.(type) {
+		case *dns.A:
+			ip = record.A
+		case *dns.AAAA:
+			ip = record.AAAA
+		default:
+			continue
+		}
+		if rule := rpzPolicy.MatchIP(ip); rule != nil && rule.Action != rpz.ActionPassthru {
+			return rule
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRPZRewritesThroughHandler(t *testing.T) {
+	db := newTestDB(t)
+	var asked atomic.Int32
+	useStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		asked.Add(1)
+		response := new(dns.Msg)
+		response.SetReply(request)
+		ip := net.IPv4(192, 0, 2, 1)
+		if request.Question[0].Name == "bad-ip.example." {
+			ip = net.IPv4(203, 0, 113, 5)
+		}
+		response.Answer = append(response.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: request.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   ip,
+		})
+		writer.WriteMsg(response)
+	})
+	rpzFile = "testdata/policy.rpz"
+	t.Cleanup(func() { rpzFile, rpzPolicy = "", nil })
+	if err := loadRPZ(); err != nil {
+		t.Fatalf("loadRPZ: %s", err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		rcode    int
+		answer   string // Text of the one answer record, empty for none
+		upstream bool   // Whether the upstream is asked
+	}{
+		{"rewritten.example.", dns.RcodeSuccess, "rewritten.example.\t300\tIN\tA\t192.0.2.99", false},
+		{"walled.example.", dns.RcodeSuccess, "walled.example.\t300\tIN\tCNAME\tportal.example.", false},
+		{"gone.example.", dns.RcodeNameError, "", false},
+		// An answer pointing into a network with an IP trigger is rewritten after resolution
+		{"bad-ip.example.", dns.RcodeNameError, "", true},
+		{"other.example.", dns.RcodeSuccess, "other.example.\t300\tIN\tA\t192.0.2.1", true},
+	} {
+		before := asked.Load()
+		request := new(dns.Msg)
+		request.SetQuestion(test.name, dns.TypeA)
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		if writer.msg == nil {
+			t.Errorf("%s got no response", test.name)
+			continue
+		}
+		answer := ""
+		if len(writer.msg.Answer) == 1 {
+			answer = writer.msg.Answer[0].String()
+		}
+		if writer.msg.Rcode != test.rcode || answer != test.answer || len(writer.msg.Answer) > 1 {
+			t.Errorf("%s answered %s %v, want %s %q", test.name, dns.RcodeToString[writer.msg.Rcode], writer.msg.Answer, dns.RcodeToString[test.rcode], test.answer)
+		}
+		if forwarded := asked.Load() != before; forwarded != test.upstream {
+			t.Errorf("%s asked the upstream: %v, want %v", test.name, forwarded, test.upstream)
+		}
+	}
+
+	// A drop rule sends nothing at all
+	request := new(dns.Msg)
+	request.SetQuestion("silent.example.", dns.TypeA)
+	writer := newTestWriter()
+	resolveDNSRequest(db)(writer, request)
+	if writer.msg != nil {
+		t.Errorf("silent.example. answered %v, want no response", writer.msg)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log"
+
+	"github.com/chaoticcyber/dnsToy/internal/schedule"
+)
+
+// scheduleRules are the time windows loaded from -schedule, nil when there are none
+var scheduleRules *schedule.Rules
+
+// Function to load the -schedule rules
+func loadSchedule() error {
+	if scheduleFile == "" {
+		return nil
+	}
+	rules, err := schedule.Load(scheduleFile)
+	if err != nil {
+		return err
+	}
+	scheduleRules = rules
+	log.Printf("Loaded schedules for %d domains from %s\n", scheduleRules.Len(), scheduleFile)
+	return nil
+}
+
+// Function to check if a name is outside its allowed time windows, by the server's local clock
+func scheduleBlocked(name string) bool {
+	return scheduleRules.Blocked(name, appClock.Now().Local())
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Function to load -schedule rules from the given lines for a test
+func useSchedule(t *testing.T, rules string) {
+	t.Helper()
+	scheduleFile = filepath.Join(t.TempDir(), "schedule")
+	if err := os.WriteFile(scheduleFile, []byte(rules), 0o600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	t.Cleanup(func() { scheduleFile, scheduleRules = "", nil })
+	captureLog(t)
+	if err := loadSchedule(); err != nil {
+		t.Fatalf("loadSchedule: %s", err)
+	}
+}
+
+func TestScheduleBlocksOutsideWindow(t *testing.T) {
+	db := newTestDB(t)
+	useStubUpstream(t, answerStubA)
+	useSchedule(t, "kids.example mon-fri 08:00-18:00\n")
+	// 16 October 2026 is a Friday
+	fake := useFakeClock(t, time.Date(2026, 10, 16, 9, 0, 0, 0, time.Local))
+
+	query := func(name string) *dns.Msg {
+		t.Helper()
+		request := new(dns.Msg)
+		request.SetQuestion(name, dns.TypeA)
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		return writer.msg
+	}
+	answered := func(response *dns.Msg, ip net.IP) bool {
+		if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 {
+			return false
+		}
+		a, ok := response.Answer[0].(*dns.A)
+		return ok && a.A.Equal(ip)
+	}
+	upstreamIP, nullIP := net.IPv4(192, 0, 2, 1), net.IPv4zero
+
+	for _, step := range []struct {
+		advance time.Duration
+		when    string
+		allowed bool
+	}{
+		{0, "Friday 09:00", true},
+		{8*time.Hour + 59*time.Minute, "Friday 17:59", true},
+		{time.Minute, "Friday 18:00", false},
+		{14 * time.Hour, "Saturday 08:00", false},
+		{47*time.Hour + 59*time.Minute, "Monday 07:59", false},
+		{time.Minute, "Monday 08:00", true},
+	} {
+		fake.Advance(step.advance)
+		for _, name := range []string{"kids.example.", "www.kids.example."} {
+			response := query(name)
+			if step.allowed && !answered(response, upstreamIP) {
+				t.Errorf("%s on %s answered %v, want the upstream's address inside the window", name, step.when, response.Answer)
+			}
+			if !step.allowed && !answered(response, nullIP) {
+				t.Errorf("%s on %s answered %v, want it null routed outside the window", name, step.when, response.Answer)
+			}
+		}
+		// Names without a rule are answered at any time
+		if response := query("other.example."); !answered(response, upstreamIP) {
+			t.Errorf("other.example. on %s answered %v, want the upstream's address", step.when, response.Answer)
+		}
+	}
+
+	// The block uses -block-mode like the block lists do
+	fake.Advance(10 * time.Hour)
+	blockMode = "nxdomain"
+	t.Cleanup(func() { blockMode = "null" })
+	if response := query("kids.example."); response.Rcode != dns.RcodeNameError {
+		t.Errorf("kids.example. outside the window with -block-mode nxdomain answered %s, want NXDOMAIN", dns.RcodeToString[response.Rcode])
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/chaoticcyber/dnsToy/internal/blocklist"
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/miekg/dns"
+)
+
+// Function to check the configuration for -selftest, printing a pass/fail report and
+// returning whether every check passed
+func runSelftest(dbPath string) bool {
+	passed := true
+	report := func(name string, err error) {
+		if err != nil {
+			passed = false
+			fmt.Printf("FAIL  %-50s %s\n", name, err)
+			return
+		}
+		fmt.Printf("PASS  %s\n", name)
+	}
+
+	fmt.Println("Running self-test:")
+	if !noDB {
+		report("database "+dbPath+" is writable", checkDatabaseWritable(dbPath))
+	}
+
+	if blocklistFile != "" {
+		_, err := blocklist.LoadSources(blocklistFile, listCacheDir)
+		report("blocklist "+blocklistFile+" parses", err)
+	}
+	if allowlistFile != "" {
+		_, err := blocklist.LoadSources(allowlistFile, listCacheDir)
+		report("allowlist "+allowlistFile+" parses", err)
+	}
+
+	servers := upstreamDNS
+	if useResolvConf {
+		var err error
+		servers, err = resolvConfUpstreams(resolvConfPath)
+		report("resolv.conf "+resolvConfPath+" has nameservers", err)
+	}
+	for _, server := range strings.Split(servers, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			report("upstream "+server+" answers "+healthProbeDomain, checkUpstream(server))
+		}
+	}
+
+	for _, addr := range strings.Split(listenAddrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			report("listen address "+addr+" can be bound", checkBind(addr))
+		}
+	}
+
+	if passed {
+		fmt.Println("Self-test passed")
+	} else {
+		fmt.Println("Self-test failed")
+	}
+	return passed
+}
+
+// Function to check that the database can be opened and written to, leaving it unchanged
+func checkDatabaseWritable(path string) error {
+	db, err := dbfunc.Open(path, dbBusyTimeoutMs)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := dbfunc.CreateTables(db); err != nil {
+		return err
+	}
+	return rollbackWrite(db)
+}
+
+// Function to take the write lock with a throwaway insert that is rolled back
+func rollbackWrite(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("INSERT INTO queries(domain, qtype, query_count) VALUES('selftest.invalid.', 'A', 0)")
+	return err
+}
+
+// Function to send the health probe query to an upstream and check it answers
+func checkUpstream(server string) error {
+	c := &dns.Client{Timeout: healthCheckTimeout}
+	probe := new(dns.Msg)
+	probe.SetQuestion(dns.Fqdn(healthProbeDomain), dns.TypeA)
+	resp, _, err := exchangeDirect(c, probe, server)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+		return fmt.Errorf("answered %s", dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+// Function to check that the DNS listeners could bind an address, releasing it right away
+func checkBind(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	if !serveTCP {
+		return nil
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return listener.Close()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// Function to run the self-test, returning its result and the report it printed
+func runSelftestReport(t *testing.T, dbPath string) (bool, string) {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %s", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	passed := runSelftest(dbPath)
+	os.Stdout = stdout
+	writer.Close()
+	report, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading the report: %s", err)
+	}
+	return passed, string(report)
+}
+
+func TestSelftest(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "blocklist.txt")
+	if err := os.WriteFile(list, []byte("0.0.0.0 ads.example\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	healthy := startStubUpstream(t, answerStubA)
+	refusing := startStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		response := new(dns.Msg)
+		writer.WriteMsg(response.SetRcode(request, dns.RcodeRefused))
+	})
+	free := freeLoopbackAddr(t)
+	oldUpstreams, oldListen, oldBlocklist := upstreamDNS, listenAddrs, blocklistFile
+	t.Cleanup(func() { upstreamDNS, listenAddrs, blocklistFile = oldUpstreams, oldListen, oldBlocklist })
+
+	upstreamDNS, listenAddrs, blocklistFile = healthy, free, list
+	passed, report := runSelftestReport(t, filepath.Join(dir, "dns.db"))
+	if !passed || strings.Contains(report, "FAIL") {
+		t.Errorf("self-test of a good configuration failed:\n%s", report)
+	}
+	for _, check := range []string{"database", "blocklist", "upstream " + healthy, "listen address " + free} {
+		if !strings.Contains(report, "PASS  "+check) {
+			t.Errorf("report has no passed %s check:\n%s", check, report)
+		}
+	}
+
+	// A refusing upstream and an address already in use each fail their check
+	held, err := net.ListenPacket("udp", free)
+	if err != nil {
+		t.Fatalf("holding %s: %s", free, err)
+	}
+	defer held.Close()
+	upstreamDNS = healthy + "," + refusing
+	passed, report = runSelftestReport(t, filepath.Join(dir, "dns.db"))
+	if passed {
+		t.Errorf("self-test passed with a refusing upstream and a bound address:\n%s", report)
+	}
+	for _, check := range []string{"upstream " + refusing, "listen address " + free} {
+		if !strings.Contains(report, "FAIL  "+check) {
+			t.Errorf("report has no failed %s check:\n%s", check, report)
+		}
+	}
+	if !strings.Contains(report, "PASS  upstream "+healthy) {
+		t.Errorf("report no longer passes the healthy upstream:\n%s", report)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/miekg/dns"
+)
+
+// staticRecord is a record pushed through the /zone API
+type staticRecord struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	TTL   uint32 `json:"ttl"`
+}
+
+var (
+	staticRecords = make(map[string][]dns.RR) // Records pushed through the /zone API by normalized name
+	staticMutex   sync.RWMutex                // Guards staticRecords
+)
+
+// Function to turn a pushed record into a resource record, checking its type and value parse
+func (r staticRecord) toRR() (dns.RR, error) {
+	if r.Name == "" || r.Type == "" || r.Value == "" {
+		return nil, fmt.Errorf("record needs a name, type and value")
+	}
+	if _, ok := dns.StringToType[strings.ToUpper(r.Type)]; !ok {
+		return nil, fmt.Errorf("unknown record type %q", r.Type)
+	}
+	ttl := r.TTL
+	if ttl == 0 {
+		ttl = defaultTTL
+	}
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dbfunc.NormalizeDomain(r.Name), ttl, strings.ToUpper(r.Type), r.Value))
+	if err != nil {
+		return nil, err
+	}
+	if rr == nil {
+		return nil, fmt.Errorf("record %s has no data", r.Name)
+	}
+	return rr, nil
+}
+
+// Function to answer a question from the records pushed through the /zone API, returning false
+// when none are held for the name
+func answerStatic(response *dns.Msg, question dns.Question) bool {
+	staticMutex.RLock()
+	records, found := staticRecords[dbfunc.NormalizeDomain(question.Name)]
+	staticMutex.RUnlock()
+	if !found {
+		return false
+	}
+	response.Authoritative = true
+	for _, rr := range records {
+		rrtype := rr.Header().Rrtype
+		if rrtype != question.Qtype && rrtype != dns.TypeCNAME && question.Qtype != dns.TypeANY {
+			continue
+		}
+		answer := dns.Copy(rr)
+		answer.Header().Name = question.Name
+		answer.Header().Ttl = serveTTL(answer.Header().Ttl)
+		response.Answer = append(response.Answer, answer)
+	}
+	// A name without records of the asked type is answered with no data
+	return true
+}
+
+// Function to register the /zone API for managing static records at runtime
+func registerZoneAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/zone", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(listStaticRecords()); err != nil {
+				log.Printf("Error writing zone records: %s\n", err)
+			}
+		case http.MethodPost:
+			var records []staticRecord
+			if err := json.NewDecoder(r.Body).Decode(&records); err != nil {
+				http.Error(w, "expected a JSON list of records: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			// Check every record before adding any, so a bad request changes nothing
+			rrs := make([]dns.RR, 0, len(records))
+			for _, record := range records {
+				rr, err := record.toRR()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				rrs = append(rrs, rr)
+			}
+			staticMutex.Lock()
+			for _, rr := range rrs {
+				staticRecords[rr.Header().Name] = append(staticRecords[rr.Header().Name], rr)
+			}
+			staticMutex.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/zone/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := dbfunc.NormalizeDomain(strings.TrimPrefix(r.URL.Path, "/zone/"))
+		staticMutex.Lock()
+		_, found := staticRecords[name]
+		delete(staticRecords, name)
+		staticMutex.Unlock()
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Function to list the static records sorted by name
+func listStaticRecords() []staticRecord {
+	staticMutex.RLock()
+	defer staticMutex.RUnlock()
+	records := []staticRecord{}
+	for _, rrs := range staticRecords {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			// The value is everything after the header in the record's text form
+			value := strings.TrimPrefix(rr.String(), hdr.String())
+			records = append(records, staticRecord{Name: hdr.Name, Type: dns.TypeToString[hdr.Rrtype], Value: value, TTL: hdr.Ttl})
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// Function to clear the records pushed through the /zone API when a test ends
+func clearStaticRecords(t *testing.T) {
+	t.Helper()
+	t.Cleanup(func() {
+		staticMutex.Lock()
+		staticRecords = make(map[string][]dns.RR)
+		staticMutex.Unlock()
+	})
+}
+
+func TestZoneAPI(t *testing.T) {
+	clearStaticRecords(t)
+	db := newTestDB(t)
+	disableLookups(t)
+	mux := http.NewServeMux()
+	registerZoneAPI(mux)
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return recorder
+	}
+	ask := func() *dns.Msg {
+		request := new(dns.Msg)
+		request.SetQuestion("pushed.example.", dns.TypeA)
+		writer := newTestWriter()
+		resolveDNSRequest(db).ServeDNS(writer, request)
+		return writer.msg
+	}
+
+	if got := serve(http.MethodPost, "/zone", `[{"name":"pushed.example","type":"A","value":"192.0.2.44","ttl":120}]`); got.Code != http.StatusCreated {
+		t.Fatalf("POST /zone = %d %s", got.Code, got.Body)
+	}
+	// A bad record rejects the whole request
+	if got := serve(http.MethodPost, "/zone", `[{"name":"other.example","type":"A","value":"192.0.2.45"},{"name":"bad.example","type":"BOGUS","value":"x"}]`); got.Code != http.StatusBadRequest {
+		t.Errorf("POST /zone with an unknown type = %d, want 400", got.Code)
+	}
+
+	got := serve(http.MethodGet, "/zone", "")
+	var records []staticRecord
+	if err := json.NewDecoder(got.Body).Decode(&records); err != nil {
+		t.Fatalf("decoding GET /zone: %s", err)
+	}
+	want := []staticRecord{{Name: "pushed.example.", Type: "A", Value: "192.0.2.44", TTL: 120}}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("GET /zone = %+v, want %+v", records, want)
+	}
+
+	response := ask()
+	if ips := answerIPs(response); response.Rcode != dns.RcodeSuccess || !response.Authoritative || len(ips) != 1 || ips[0] != "192.0.2.44" {
+		t.Errorf("pushed record answered %s %v (aa %t), want authoritative 192.0.2.44", dns.RcodeToString[response.Rcode], ips, response.Authoritative)
+	}
+
+	if got := serve(http.MethodDelete, "/zone/pushed.example", ""); got.Code != http.StatusNoContent {
+		t.Errorf("DELETE /zone/pushed.example = %d, want 204", got.Code)
+	}
+	if got := serve(http.MethodDelete, "/zone/pushed.example", ""); got.Code != http.StatusNotFound {
+		t.Errorf("second DELETE /zone/pushed.example = %d, want 404", got.Code)
+	}
+	if response := ask(); response.Rcode != dns.RcodeNameError {
+		t.Errorf("deleted record answered %s, want NXDOMAIN", dns.RcodeToString[response.Rcode])
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/chaoticcyber/dnsToy/internal/geoip"
+	"github.com/chaoticcyber/dnsToy/internal/metrics"
+	"github.com/chaoticcyber/dnsToy/internal/redis"
+	"github.com/miekg/dns"
+)
+
+// geoDB annotates stored IPs with their country when -geoip-db is set
+var geoDB *geoip.Reader
+
+// readDB is the -db-read-dsn replica that lookups are read from, nil to read from the primary
+var readDB *sql.DB
+
+// sharedCache is the Redis cache shared between resolvers when -redis-addr is set
+var sharedCache *redis.Client
+
+// Function to build the shared cache key for a name and query type
+func sharedCacheKey(domain string, qtype uint16) string {
+	return "dnstoy:" + dbfunc.NormalizeDomain(domain) + ":" + dns.TypeToString[qtype]
+}
+
+// Function to look up the stored addresses for a domain, trying the shared cache before SQLite,
+// returning the TTL to advertise and the seconds left of the stored TTL. With fresh set, entries
+// past their cache TTL are treated as missing so they get resolved again
+func lookupResolution(db *sql.DB, domain string, fresh bool) ([]string, uint32, uint32, bool) {
+	if sharedCache != nil {
+		key := sharedCacheKey(domain, dns.TypeA)
+		value, found, err := sharedCache.Get(key)
+		if err != nil {
+			metrics.Inc("dnstoy_shared_cache_errors_total")
+			log.Printf("Error reading shared cache for %s: %s\n", domain, err)
+		} else if found {
+			ttl := defaultTTL
+			if remaining, err := sharedCache.TTL(key); err == nil && remaining > 0 {
+				ttl = uint32(remaining / time.Second)
+			}
+			metrics.Inc("dnstoy_shared_cache_hits_total")
+			return strings.Split(value, ","), ttl, ttl, true
+		}
+	}
+	resolution, expired, err := dbfunc.GetWithExpiry(reader(db), domain, uint32(cacheTTL), adaptiveMax())
+	if err != nil {
+		// A failing database is treated as a miss so the name still gets resolved upstream
+		if err != dbfunc.ErrNotFound {
+			log.Println(err)
+		}
+		return nil, 0, 0, false
+	}
+	if expired && fresh {
+		return nil, 0, 0, false
+	}
+	// Counts are writes, so they always go to the primary, and go to the wildcard entry when that answered
+	if err := dbfunc.IncrementQueryCount(db, resolution.Domain); err != nil {
+		log.Printf("Error incrementing query count for %s: %s\n", resolution.Domain, err)
+	}
+	return resolution.Addresses, uint32(advertisedTTL), resolution.Remaining(), true
+}
+
+// Function to get the database lookups read from, the -db-read-dsn replica when there is one
+func reader(db *sql.DB) *sql.DB {
+	if readDB != nil {
+		return readDB
+	}
+	return db
+}
+
+// Function to get the cap for adaptive cache TTLs, 0 when -adaptive-ttl is off
+func adaptiveMax() uint32 {
+	if !adaptiveTTL {
+		return 0
+	}
+	return uint32(maxTTL)
+}
+
+// Function to store the freshly resolved addresses of a domain, annotating the entry with the
+// country of the first one, reporting whether the domain was stored already
+func storeResolution(db *sql.DB, domain string, ips []net.IP, ttl uint32) (bool, error) {
+	if sharedCache != nil {
+		addresses := make([]string, len(ips))
+		for i, ip := range ips {
+			addresses[i] = ip.String()
+		}
+		// Redis expires the entry itself once the upstream TTL runs out
+		if err := sharedCache.SetEX(sharedCacheKey(domain, dns.TypeA), strings.Join(addresses, ","), time.Duration(ttl)*time.Second); err != nil {
+			metrics.Inc("dnstoy_shared_cache_errors_total")
+			log.Printf("Error writing shared cache for %s: %s\n", domain, err)
+		}
+	}
+	exists, err := dbfunc.ExistsInDatabaseIncrementCount(db, domain, ips, ttl)
+	if err != nil || geoDB == nil {
+		return exists, err
+	}
+	country, err := geoDB.Country(ips[0])
+	if err != nil {
+		log.Printf("Error looking up country for %s: %s\n", ips[0], err)
+		return exists, nil
+	}
+	return exists, dbfunc.SetCountry(db, domain, country)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/clock"
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/miekg/dns"
+)
+
+func TestLookupResolutionCountsWildcardEntry(t *testing.T) {
+	db := newTestDB(t)
+	if err := dbfunc.AddToDatabase(db, dbfunc.Resolution{Domain: "*.test.local", IP: "10.0.0.9", Static: true}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	for _, name := range []string{"a.test.local.", "b.test.local.", "a.test.local."} {
+		if addresses, _, _, found := lookupResolution(db, name, true); !found || len(addresses) != 1 || addresses[0] != "10.0.0.9" {
+			t.Fatalf("lookupResolution(%s) = %q, %v", name, addresses, found)
+		}
+	}
+	resolutions, err := dbfunc.ListResolutions(db)
+	if err != nil || len(resolutions) != 1 {
+		t.Fatalf("ListResolutions = %v, %v, want only the wildcard entry", resolutions, err)
+	}
+	if resolutions[0].QueryCount != 4 {
+		t.Errorf("wildcard entry counted %d queries, want 4 (one add and three lookups)", resolutions[0].QueryCount)
+	}
+}
+
+func TestEveryAddressStoredAndServed(t *testing.T) {
+	db := newTestDB(t)
+	useStubUpstream(t, answerStubMultiA)
+	want := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+
+	request := new(dns.Msg)
+	request.SetQuestion("multi.example.", dns.TypeA)
+	for _, status := range []string{"miss", "hit"} {
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		if got := answerIPs(writer.msg); !slices.Equal(got, want) {
+			t.Errorf("cache %s answered %v, want %v", status, got, want)
+		}
+	}
+	resolutions, err := dbfunc.ListResolutions(db)
+	if err != nil || len(resolutions) != 1 || resolutions[0].QueryCount != 2 {
+		t.Errorf("stored %+v, %v, want one entry counted twice", resolutions, err)
+	}
+}
+
+// Function to make a second empty database the -db-read-dsn replica for a test
+func useReplica(t *testing.T) *sql.DB {
+	t.Helper()
+	replica := newTestDB(t)
+	readDB = replica
+	t.Cleanup(func() { readDB = nil })
+	return replica
+}
+
+func TestReadsGoToReplica(t *testing.T) {
+	primary := newTestDB(t)
+	replica := useReplica(t)
+	// Both handles hold the entry, with different addresses so the answer shows which was read
+	for db, ip := range map[*sql.DB]string{primary: "10.0.0.1", replica: "10.0.0.2"} {
+		if err := dbfunc.AddToDatabase(db, dbfunc.Resolution{Domain: "host.lan", IP: ip, Static: true}); err != nil {
+			t.Fatalf("AddToDatabase: %s", err)
+		}
+		if err := dbfunc.SetUpstream(db, "corp.example", "upstream-"+ip+":53"); err != nil {
+			t.Fatalf("SetUpstream: %s", err)
+		}
+	}
+
+	if addresses, _, _, _ := lookupResolution(primary, "host.lan.", true); !slices.Equal(addresses, []string{"10.0.0.2"}) {
+		t.Errorf("lookupResolution answered %v, want the replica's address", addresses)
+	}
+	response := new(dns.Msg)
+	answerLocalZone(primary, response, dns.Question{Name: "host.lan.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, "lan.")
+	if ips := answerIPs(response); !slices.Equal(ips, []string{"10.0.0.2"}) {
+		t.Errorf("answerLocalZone answered %v, want the replica's address", ips)
+	}
+	if server := upstreamFor(primary, "corp.example."); server != "upstream-10.0.0.2:53" {
+		t.Errorf("upstreamFor = %s, want the replica's upstream", server)
+	}
+
+	// The counts are writes, so they land on the primary
+	r, _, _ := dbfunc.GetWithExpiry(primary, "host.lan", 0, 0)
+	if r.QueryCount != 3 {
+		t.Errorf("primary counted %d queries, want 3 (one add and two reads)", r.QueryCount)
+	}
+	r, _, _ = dbfunc.GetWithExpiry(replica, "host.lan", 0, 0)
+	if r.QueryCount != 1 {
+		t.Errorf("replica counted %d queries, want only the add", r.QueryCount)
+	}
+}
+
+func TestExpiredEntryResolvedAgain(t *testing.T) {
+	db := newTestDB(t)
+	fake := clock.NewFake(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	dbfunc.Clock = fake
+	t.Cleanup(func() { dbfunc.Clock = clock.Real{} })
+	ttl := cacheTTL
+	cacheTTL = 300
+	t.Cleanup(func() { cacheTTL = ttl })
+	var asked atomic.Int32
+	useStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		asked.Add(1)
+		answerStubA(writer, request)
+	})
+
+	request := new(dns.Msg)
+	request.SetQuestion("expiring.example.", dns.TypeA)
+	for _, step := range []struct {
+		advance time.Duration
+		asked   int32
+	}{
+		{0, 1},                 // Resolved and stored
+		{299 * time.Second, 1}, // Answered from the database
+		{2 * time.Second, 2},   // Past the cache TTL, resolved again
+		{10 * time.Second, 2},  // Fresh again
+	} {
+		fake.Advance(step.advance)
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		if ips := answerIPs(writer.msg); len(ips) != 1 {
+			t.Fatalf("answered %v, want the stub's address", ips)
+		}
+		if got := asked.Load(); got != step.asked {
+			t.Errorf("after %s more, upstream asked %d times, want %d", step.advance, got, step.asked)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/chaoticcyber/dnsToy/internal/metrics"
+	"github.com/miekg/dns"
+)
+
+// Function to answer an HTTPS or SVCB question from the records table, forwarding it and
+// caching the upstream's answer on a miss, so browsers get their ECH and alt-svc hints
+func answerServiceBinding(db *sql.DB, response *dns.Msg, question dns.Question, lookups bool, subnet *dns.EDNS0_SUBNET) {
+	qtype := dns.TypeToString[question.Qtype]
+	records, ttl, err := dbfunc.GetRecords(db, question.Name, qtype)
+	if err != nil {
+		log.Printf("Error reading %s records for %s: %s\n", qtype, question.Name, err)
+	}
+	if len(records) > 0 {
+		for _, record := range records {
+			rr, err := dns.NewRR(record)
+			if err != nil || rr == nil {
+				log.Printf("Error parsing stored %s record for %s: %v\n", qtype, question.Name, err)
+				continue
+			}
+			rr.Header().Name = question.Name
+			rr.Header().Ttl = serveTTL(ttl)
+			response.Answer = append(response.Answer, rr)
+		}
+		metrics.Inc("dnstoy_cache_hits_total")
+		return
+	}
+	// Without upstreams a miss gets the -cache-only-miss answer, as A questions do
+	if answerCacheOnlyMiss(response) {
+		return
+	}
+	if !lookups {
+		countRejected("refused", "qtype")
+		response.Rcode = dns.RcodeRefused
+		return
+	}
+
+	metrics.Inc("dnstoy_cache_misses_total")
+	answer, err := forwardQuestion(question, subnet)
+	if err != nil {
+		log.Println(err)
+		response.Rcode = dns.RcodeServerFailure
+		return
+	}
+	var texts []string
+	var minTTL uint32
+	for _, rr := range answer.Answer {
+		if rr.Header().Rrtype != question.Qtype {
+			continue
+		}
+		if len(texts) == 0 || rr.Header().Ttl < minTTL {
+			minTTL = rr.Header().Ttl
+		}
+		texts = append(texts, rr.String())
+	}
+	if answer.Rcode == dns.RcodeSuccess && len(texts) > 0 {
+		if err := dbfunc.SetRecords(db, question.Name, qtype, texts, minTTL); err != nil {
+			log.Printf("Error storing %s records for %s: %s\n", qtype, question.Name, err)
+		}
+	}
+	for _, rr := range answer.Answer {
+		rr.Header().Ttl = serveTTL(rr.Header().Ttl)
+	}
+	response.Answer = append(response.Answer, answer.Answer...)
+	copyUpstreamSections(response, answer)
+	if answer.Rcode != dns.RcodeSuccess {
+		response.Rcode = answer.Rcode
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestServiceBindingForwardedIntact(t *testing.T) {
+	db := newTestDB(t)
+	records := map[uint16]string{
+		dns.TypeHTTPS: `svc.example. 300 IN HTTPS 1 . alpn="h3,h2" ipv4hint="192.0.2.1" ech="AEX+DQBBpQAgACBLxs0g" ipv6hint="2001:db8::1"`,
+		dns.TypeSVCB:  `_dns.svc.example. 300 IN SVCB 1 dns.example. alpn="dot" port="853"`,
+	}
+	var asked atomic.Int32
+	useStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		asked.Add(1)
+		response := new(dns.Msg)
+		response.SetReply(request)
+		if rr, err := dns.NewRR(records[request.Question[0].Qtype]); err == nil {
+			response.Answer = append(response.Answer, rr)
+		}
+		writer.WriteMsg(response)
+	})
+
+	for qtype, record := range records {
+		want, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatalf("NewRR(%s): %s", record, err)
+		}
+		before := asked.Load()
+		// The miss is forwarded and the hit answered from the records table, both unchanged
+		for _, status := range []string{"miss", "hit"} {
+			request := new(dns.Msg)
+			request.SetQuestion(want.Header().Name, qtype)
+			writer := newTestWriter()
+			resolveDNSRequest(db)(writer, request)
+			if len(writer.msg.Answer) != 1 || writer.msg.Answer[0].String() != want.String() {
+				t.Errorf("%s cache %s answered %v, want %s", dns.TypeToString[qtype], status, writer.msg.Answer, want)
+			}
+		}
+		if got := asked.Load() - before; got != 1 {
+			t.Errorf("%s asked the upstream %d times, want once", dns.TypeToString[qtype], got)
+		}
+	}
+}
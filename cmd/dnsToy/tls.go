@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/miekg/dns"
+)
+
+// certReloader serves the -tls-cert certificate, swapped in whole when it is reloaded so
+// handshakes never see a half loaded one
+type certReloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+// Function to load the certificate and key for the DNS over TLS and QUIC listeners
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Function to read the certificate and key from disk again, keeping the current pair when they fail to load
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert.Store(&cert)
+	return nil
+}
+
+// Function to hand the current certificate to a TLS handshake, used as tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// Function to reload the certificate on SIGHUP, so rotating it doesn't need a restart
+func (r *certReloader) reloadOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		if err := r.reload(); err != nil {
+			log.Printf("Error reloading -tls-cert, keeping the current certificate: %s\n", err)
+			continue
+		}
+		log.Printf("Reloaded TLS certificate from %s\n", r.certFile)
+	}
+}
+
+// Function to create the DNS over TLS (RFC 7858) servers for each comma separated -tls-addr
+func newTLSServers(addrs string, handler dns.Handler, reloader *certReloader) []*dns.Server {
+	var servers []*dns.Server
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		config := &tls.Config{GetCertificate: reloader.GetCertificate, MinVersion: tls.VersionTLS12}
+		servers = append(servers, &dns.Server{Addr: addr, Net: "tcp-tls", Handler: handler, MsgAcceptFunc: acceptMsg, TLSConfig: config})
+	}
+	return servers
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"testing"
+)
+
+// Function to complete a TLS handshake with a server using the reloader, returning the serial
+// number of the certificate it presented
+func handshakeSerial(t *testing.T, reloader *certReloader) int64 {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	server := tls.Server(serverConn, &tls.Config{GetCertificate: reloader.GetCertificate, MinVersion: tls.VersionTLS12})
+	go server.Handshake()
+	client := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true, ServerName: "localhost"})
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("Handshake: %s", err)
+	}
+	return client.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestCertReloaderSwapsCertificate(t *testing.T) {
+	reloader := newTestCertReloader(t)
+	if got := handshakeSerial(t, reloader); got != 1 {
+		t.Fatalf("presented certificate %d, want the loaded 1", got)
+	}
+
+	// A rotated certificate is only presented once it is reloaded
+	writeTestCert(t, reloader.certFile, reloader.keyFile, 2)
+	if got := handshakeSerial(t, reloader); got != 1 {
+		t.Errorf("presented certificate %d before the reload, want 1", got)
+	}
+	if err := reloader.reload(); err != nil {
+		t.Fatalf("reload: %s", err)
+	}
+	if got := handshakeSerial(t, reloader); got != 2 {
+		t.Errorf("presented certificate %d after the reload, want the rotated 2", got)
+	}
+
+	// A certificate that fails to load keeps the current one in place
+	if err := os.WriteFile(reloader.certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if err := reloader.reload(); err == nil {
+		t.Error("reload of a broken certificate succeeded")
+	}
+	if got := handshakeSerial(t, reloader); got != 2 {
+		t.Errorf("presented certificate %d after a failed reload, want 2 kept", got)
+	}
+}
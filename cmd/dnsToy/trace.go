@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/blocklist"
+	"github.com/miekg/dns"
+)
+
+// traceList are the domains -trace is scoped to, nil for every domain
+var traceList *blocklist.List
+
+// traceStep is one step taken while answering a traced query
+type traceStep struct {
+	Elapsed time.Duration // Time since the query arrived
+	Step    string        // What answered or passed on the question, e.g. blocklist, cache-hit or forward
+	Detail  string        // Name, upstream or result the step worked with
+}
+
+// queryTrace collects the resolution path of one query for -trace, a nil trace records nothing
+type queryTrace struct {
+	start time.Time
+	steps []traceStep
+}
+
+// Function to start a trace for a request, nil unless -trace is on and a question matches -trace-domains
+func newTrace(request *dns.Msg) *queryTrace {
+	if !traceQueries || !chaosScopeMatches(traceList, request) {
+		return nil
+	}
+	return &queryTrace{start: appClock.Now()}
+}
+
+// Function to record a step of the resolution path
+func (t *queryTrace) add(step, format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.steps = append(t.steps, traceStep{Elapsed: appClock.Now().Sub(t.start), Step: step, Detail: fmt.Sprintf(format, args...)})
+}
+
+// Function to format the trace as one line, each step with its time since the query arrived
+func (t *queryTrace) String() string {
+	parts := make([]string, len(t.steps))
+	for i, step := range t.steps {
+		parts[i] = fmt.Sprintf("+%s %s", step.Elapsed.Round(time.Microsecond), step.Step)
+		if step.Detail != "" {
+			parts[i] += " " + step.Detail
+		}
+	}
+	return strings.Join(parts, " | ")
+}
+
+// Function to log the trace once the response is ready
+func (t *queryTrace) finish(writer dns.ResponseWriter, response *dns.Msg) {
+	if t == nil {
+		return
+	}
+	t.add("response", "%s with %d answers", dns.RcodeToString[response.Rcode], len(response.Answer))
+	log.Printf("trace from %s: %s\n", writer.RemoteAddr(), t)
+}
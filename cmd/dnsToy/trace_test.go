@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// Function to get the trace lines logged since the buffer was last read
+func traceLines(buf *bytes.Buffer) []string {
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.Contains(line, "trace from ") {
+			lines = append(lines, line[strings.Index(line, "trace from "):])
+		}
+	}
+	buf.Reset()
+	return lines
+}
+
+func TestTraceRecordsResolutionPath(t *testing.T) {
+	db := newTestDB(t)
+	server := useStubUpstream(t, answerStubA)
+	traceQueries, traceList = true, parseDomainList("traced.example")
+	t.Cleanup(func() { traceQueries, traceList = false, nil })
+	logged := captureLog(t)
+
+	query := func(name string) {
+		t.Helper()
+		request := new(dns.Msg)
+		request.SetQuestion(name, dns.TypeA)
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		if len(writer.msg.Answer) != 1 {
+			t.Fatalf("%s answered %v, want one A record", name, writer.msg.Answer)
+		}
+	}
+
+	// The first query misses the cache and is forwarded to the upstream
+	query("traced.example.")
+	lines := traceLines(logged)
+	if len(lines) != 1 {
+		t.Fatalf("forwarded query logged traces %q, want one", lines)
+	}
+	steps := strings.Split(lines[0], " | ")
+	want := []string{"question traced.example. A", "cache-miss", "forward " + server + " answered [192.0.2.1]", "response NOERROR with 1 answers"}
+	if len(steps) != len(want) {
+		t.Fatalf("forwarded query traced %q, want steps %q", lines[0], want)
+	}
+	for i, step := range want {
+		if !strings.Contains(steps[i], step) {
+			t.Errorf("forwarded query step %d = %q, want %q", i, steps[i], step)
+		}
+	}
+	if !strings.HasPrefix(lines[0], "trace from 192.0.2.10:40000: +") {
+		t.Errorf("trace %q doesn't name the client and time its steps", lines[0])
+	}
+
+	// The second is answered from the cache without asking the upstream
+	query("traced.example.")
+	lines = traceLines(logged)
+	if len(lines) != 1 {
+		t.Fatalf("cached query logged traces %q, want one", lines)
+	}
+	steps = strings.Split(lines[0], " | ")
+	want = []string{"question traced.example. A", "cache-hit 192.0.2.1", "response NOERROR with 1 answers"}
+	if len(steps) != len(want) {
+		t.Fatalf("cached query traced %q, want steps %q", lines[0], want)
+	}
+	for i, step := range want {
+		if !strings.Contains(steps[i], step) {
+			t.Errorf("cached query step %d = %q, want %q", i, steps[i], step)
+		}
+	}
+
+	// Names outside -trace-domains aren't traced
+	query("other.example.")
+	if lines := traceLines(logged); len(lines) != 0 {
+		t.Errorf("query outside -trace-domains logged traces %q", lines)
+	}
+}
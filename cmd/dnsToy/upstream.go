@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/metrics"
+	"github.com/miekg/dns"
+	"golang.org/x/net/proxy"
+)
+
+// maxCNAMEHops caps how many names, the queried one included, a single lookup visits along a CNAME chain
+const maxCNAMEHops = 16
+
+// errCNAMELoop is returned when the upstream hands back a cyclic or overly long CNAME chain
+var errCNAMELoop = errors.New("CNAME loop detected")
+
+// Negative answers from the upstream, told apart so the client gets NXDOMAIN or NODATA like it would from the upstream
+var (
+	errNXDOMAIN = errors.New("domain does not exist")
+	errNoData   = errors.New("domain has no A record")
+)
+
+// upstreamDialer dials upstream connections through the -socks5 proxy, nil to dial directly
+var upstreamDialer proxy.Dialer
+
+// errUpstreamBusy is returned when -max-upstream-queue queries are already waiting for an upstream slot
+var errUpstreamBusy = errors.New("too many upstream queries waiting")
+
+var (
+	upstreamSlots   chan struct{} // One token per upstream query in flight, nil without -max-upstream-conns
+	upstreamWaiting atomic.Int64  // Queries waiting for a slot
+)
+
+// Function to take an upstream slot for -max-upstream-conns, waiting for one unless the queue is full
+func acquireUpstream() error {
+	if upstreamSlots == nil {
+		return nil
+	}
+	select {
+	case upstreamSlots <- struct{}{}:
+	default:
+		if upstreamWaiting.Add(1) > int64(maxUpstreamQueue) {
+			upstreamWaiting.Add(-1)
+			metrics.Inc("dnstoy_upstream_rejected_total")
+			return errUpstreamBusy
+		}
+		upstreamSlots <- struct{}{}
+		upstreamWaiting.Add(-1)
+	}
+	metrics.Set("dnstoy_upstream_in_flight", float64(len(upstreamSlots)))
+	return nil
+}
+
+// Function to give back an upstream slot taken with acquireUpstream
+func releaseUpstream() {
+	if upstreamSlots == nil {
+		return
+	}
+	<-upstreamSlots
+	metrics.Set("dnstoy_upstream_in_flight", float64(len(upstreamSlots)))
+}
+
+// Function to build the dialer for a -socks5 proxy given as host:port or a socks5:// URL with credentials
+func newSOCKS5Dialer(value string) (proxy.Dialer, error) {
+	if !strings.Contains(value, "://") {
+		value = "socks5://" + value
+	}
+	proxyURL, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme != "socks5" && proxyURL.Scheme != "socks5h" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+	return proxy.FromURL(proxyURL, &net.Dialer{Timeout: 5 * time.Second})
+}
+
+// exchangeFunc sends one query to an upstream server
+type exchangeFunc func(c *dns.Client, m *dns.Msg, server string) (*dns.Msg, time.Duration, error)
+
+// Function to send a client's query to an upstream server, holding a -max-upstream-conns slot while it is in flight
+func exchangeUpstream(c *dns.Client, m *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	if err := acquireUpstream(); err != nil {
+		return nil, 0, err
+	}
+	defer releaseUpstream()
+	return exchangeDirect(c, m, server)
+}
+
+// Function to send a query to an upstream server, over pooled TCP connections with -upstream-tcp,
+// when going through the SOCKS5 proxy or when the UDP answer comes back truncated.
+// Health probes and warmup call it directly, so a busy server never makes them fail
+func exchangeDirect(c *dns.Client, m *dns.Msg, server string) (*dns.Msg, time.Duration, error) {
+	if upstreamDialer == nil && !upstreamTCP {
+		resp, rtt, err := c.Exchange(m, server)
+		if err != nil || !resp.Truncated {
+			return resp, rtt, err
+		}
+		// The answer didn't fit in a datagram, so ask the same upstream again over TCP
+		metrics.Inc("dnstoy_upstream_tcp_retries_total", "upstream", server)
+	}
+	// SOCKS5 proxies only carry streams here, so those queries are framed for TCP too
+	return exchangePooled(c, m, server)
+}
+
+// Function to resolve domain with the given upstream server, adding its A records to response
+// and returning their IPs in upstream order and the lowest upstream TTL, with the client subnet
+// attached when it isn't nil
+func DnsLookup(server string, response *dns.Msg, domain string, subnet *dns.EDNS0_SUBNET) ([]net.IP, uint32, error) {
+	return lookupA(exchangeUpstream, server, response, domain, subnet)
+}
+
+// Function to resolve domain like DnsLookup, sending the queries with exchange
+func lookupA(exchange exchangeFunc, server string, response *dns.Msg, domain string, subnet *dns.EDNS0_SUBNET) ([]net.IP, uint32, error) {
+	c := new(dns.Client)
+	// Track every name we have asked about so a cyclic chain can't keep us spinning
+	visited := make(map[string]bool)
+	targetName := domain
+	for {
+		mA := new(dns.Msg)
+		mA.SetQuestion(dns.Fqdn(targetName), dns.TypeA) // A record query for the current name
+		withSubnet(mA, subnet)
+		// Send the A record query
+		respA, _, err := exchange(c, mA, server)
+		if err != nil {
+			metrics.Inc("dnstoy_upstream_errors_total", "upstream", server)
+			return nil, 0, fmt.Errorf("error querying A record: %s", err)
+		}
+		// Follow any CNAMEs in the answer section towards an A record
+		record, next, err := chaseCNAME(respA.Answer, targetName, visited)
+		if err != nil {
+			return nil, 0, err
+		}
+		if record != nil {
+			// Every A record of the name the chain ended at answers for the queried domain
+			var ips []net.IP
+			ttl := record.Hdr.Ttl
+			for _, rr := range respA.Answer {
+				a, ok := rr.(*dns.A)
+				if !ok || !strings.EqualFold(a.Hdr.Name, record.Hdr.Name) {
+					continue
+				}
+				ips = append(ips, a.A)
+				ttl = min(ttl, a.Hdr.Ttl)
+			}
+			for _, ip := range ips {
+				response.Answer = append(response.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: domain, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: serveTTL(ttl)},
+					A:   ip,
+				})
+			}
+			copyUpstreamSections(response, respA)
+			return ips, ttl, nil
+		}
+		if next == targetName {
+			// No A record and no CNAME to follow, so pass on why along with the upstream's SOA
+			copyNegativeSOA(response, respA)
+			if respA.Rcode == dns.RcodeNameError {
+				return nil, 0, errNXDOMAIN
+			}
+			if respA.Rcode != dns.RcodeSuccess {
+				return nil, 0, CustomError("No IP address returned for the domain: " + dns.RcodeToString[respA.Rcode])
+			}
+			return nil, 0, errNoData
+		}
+		// The chain left the answer section, so ask the upstream about the new target
+		targetName = next
+	}
+}
+
+// Function to walk the CNAME chain starting at name, returning the first A record reached
+// or the last name in the chain when the answer section doesn't resolve it
+func chaseCNAME(answers []dns.RR, name string, visited map[string]bool) (*dns.A, string, error) {
+	for {
+		key := strings.ToLower(dns.Fqdn(name))
+		if visited[key] || len(visited) >= maxCNAMEHops {
+			return nil, name, errCNAMELoop
+		}
+		visited[key] = true
+
+		var cname string
+		for _, ans := range answers {
+			if !strings.EqualFold(dns.Fqdn(ans.Header().Name), key) {
+				continue
+			}
+			switch rr := ans.(type) {
+			case *dns.A:
+				return rr, name, nil
+			case *dns.CNAME:
+				cname = rr.Target
+			}
+		}
+		if cname == "" {
+			// Leave the name unmarked so the caller can query it directly
+			delete(visited, key)
+			return nil, name, nil
+		}
+		name = cname
+	}
+}
+
+// Function to copy the upstream's authority and additional sections into response for -preserve-sections,
+// leaving out the upstream's own EDNS0 record
+func copyUpstreamSections(response, upstream *dns.Msg) {
+	if !preserveSections {
+		return
+	}
+	for _, rr := range upstream.Ns {
+		rr.Header().Ttl = serveTTL(rr.Header().Ttl)
+		response.Ns = append(response.Ns, rr)
+	}
+	for _, rr := range upstream.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		rr.Header().Ttl = serveTTL(rr.Header().Ttl)
+		response.Extra = append(response.Extra, rr)
+	}
+}
+
+// Function to copy the SOA of a negative upstream answer into the authority section (RFC 2308),
+// so clients can cache that the name or type doesn't exist
+func copyNegativeSOA(response, upstream *dns.Msg) {
+	if preserveSections {
+		// The whole authority section is copied already
+		copyUpstreamSections(response, upstream)
+		return
+	}
+	for _, rr := range upstream.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			soa.Hdr.Ttl = serveTTL(min(soa.Hdr.Ttl, soa.Minttl))
+			response.Ns = append(response.Ns, soa)
+		}
+	}
+}
+
+// Function to pass a single question through to the upstream server unchanged, apart from the client subnet
+func forwardQuestion(question dns.Question, subnet *dns.EDNS0_SUBNET) (*dns.Msg, error) {
+	c := new(dns.Client)
+	m := new(dns.Msg)
+	m.SetQuestion(question.Name, question.Qtype)
+	m.Question[0].Qclass = question.Qclass
+	withSubnet(m, subnet)
+	server := pickUpstream()
+	resp, _, err := exchangeUpstream(c, m, server)
+	if err != nil {
+		metrics.Inc("dnstoy_upstream_errors_total", "upstream", server)
+		return nil, fmt.Errorf("error forwarding %s query for %s: %s", dns.TypeToString[question.Qtype], question.Name, err)
+	}
+	return resp, nil
+}
+
+// Function to read the nameservers from a resolv.conf file as a comma separated upstream list
+func resolvConfUpstreams(path string) (string, error) {
+	config, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return "", err
+	}
+	if len(config.Servers) == 0 {
+		return "", fmt.Errorf("no nameservers in %s", path)
+	}
+	servers := make([]string, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		servers = append(servers, net.JoinHostPort(server, config.Port))
+	}
+	return strings.Join(servers, ","), nil
+}
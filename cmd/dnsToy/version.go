@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// version is the build version, set with -ldflags "-X main.version=..."
+var version = "dev"
+
+// Function to answer CHAOS class TXT queries for version.bind and hostname.bind
+func answerChaos(response *dns.Msg, question dns.Question) {
+	if question.Qtype != dns.TypeTXT || hideVersion {
+		countRejected("refused", "chaos")
+		response.Rcode = dns.RcodeRefused
+		return
+	}
+	var text string
+	switch strings.ToLower(question.Name) {
+	case "version.bind.":
+		text = versionString
+		if text == "" {
+			text = "dnsToy " + version
+		}
+	case "hostname.bind.":
+		hostname, err := os.Hostname()
+		if err != nil {
+			response.Rcode = dns.RcodeServerFailure
+			return
+		}
+		text = hostname
+	default:
+		countRejected("refused", "chaos")
+		response.Rcode = dns.RcodeRefused
+		return
+	}
+	answerRecord := dns.TXT{
+		Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0},
+		Txt: []string{text},
+	}
+	response.Answer = append(response.Answer, &answerRecord)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestChaosAnswers(t *testing.T) {
+	db := newTestDB(t)
+	disableLookups(t)
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("Hostname: %s", err)
+	}
+	t.Cleanup(func() { versionString, hideVersion = "", false })
+
+	for _, test := range []struct {
+		name   string
+		qtype  uint16
+		custom string
+		hide   bool
+		rcode  int
+		answer string
+	}{
+		{"version.bind.", dns.TypeTXT, "", false, dns.RcodeSuccess, "dnsToy " + version},
+		{"VERSION.BIND.", dns.TypeTXT, "", false, dns.RcodeSuccess, "dnsToy " + version},
+		{"version.bind.", dns.TypeTXT, "resolver", false, dns.RcodeSuccess, "resolver"},
+		{"hostname.bind.", dns.TypeTXT, "", false, dns.RcodeSuccess, hostname},
+		{"version.bind.", dns.TypeTXT, "", true, dns.RcodeRefused, ""},
+		{"version.bind.", dns.TypeA, "", false, dns.RcodeRefused, ""},
+		{"id.server.", dns.TypeTXT, "", false, dns.RcodeRefused, ""},
+	} {
+		versionString, hideVersion = test.custom, test.hide
+		request := new(dns.Msg)
+		request.SetQuestion(test.name, test.qtype)
+		request.Question[0].Qclass = dns.ClassCHAOS
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		response := writer.msg
+		if response.Rcode != test.rcode {
+			t.Errorf("CH %s %s answered %s, want %s", test.name, dns.TypeToString[test.qtype], dns.RcodeToString[response.Rcode], dns.RcodeToString[test.rcode])
+			continue
+		}
+		if test.answer == "" {
+			if len(response.Answer) != 0 {
+				t.Errorf("CH %s %s answered %v, want no records", test.name, dns.TypeToString[test.qtype], response.Answer)
+			}
+			continue
+		}
+		if len(response.Answer) != 1 {
+			t.Fatalf("CH %s TXT answered %v, want one record", test.name, response.Answer)
+		}
+		txt, ok := response.Answer[0].(*dns.TXT)
+		if !ok || txt.Hdr.Class != dns.ClassCHAOS || txt.Hdr.Name != test.name || len(txt.Txt) != 1 || txt.Txt[0] != test.answer {
+			t.Errorf("CH %s TXT answered %v, want CH TXT %q", test.name, response.Answer[0], test.answer)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"slices"
+	"sync/atomic"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/miekg/dns"
+)
+
+// warming is set while the cache is being warmed up at startup
+var warming atomic.Bool
+
+// Function to re-resolve the domains of the restored cache snapshot that expired while the server was
+// stopped, then the most queried domains, so the cache is fresh before normal service
+func warmup(db *sql.DB, count int, expired []string) {
+	warming.Store(true)
+	defer warming.Store(false)
+
+	if !hasUpstreams() {
+		log.Println("Skipping warmup, no upstream servers are configured")
+		return
+	}
+	domains := expired
+	if count > 0 {
+		top, err := dbfunc.TopDomains(db, count)
+		if err != nil {
+			log.Printf("Error reading domains to warm up: %s\n", err)
+		}
+		for _, domain := range top {
+			if !slices.Contains(expired, domain) {
+				domains = append(domains, domain)
+			}
+		}
+	}
+	log.Printf("Warming up %d domains...\n", len(domains))
+	for _, domain := range domains {
+		// Warmup runs one query at a time, so it doesn't compete with clients for upstream slots
+		ips, ttl, err := lookupA(exchangeDirect, pickUpstream(), new(dns.Msg), domain, nil)
+		if err != nil {
+			log.Printf("Error warming up %s: %s\n", domain, err)
+			continue
+		}
+		if _, err := storeResolution(db, domain, ips, ttl); err != nil {
+			log.Printf("Error storing resolved IP in database: %s\n", err)
+		}
+	}
+	log.Println("Warmup complete.")
+}
+
+// Function to restore the -cache-snapshot saved at the last shutdown, returning the domains whose
+// TTL ran out while the server was stopped. The others are answered from the database as they are
+func restoreSnapshot(db *sql.DB) []string {
+	fresh, expired, err := dbfunc.LoadSnapshot(db)
+	if err != nil {
+		log.Printf("Error loading the cache snapshot: %s\n", err)
+		return nil
+	}
+	log.Printf("Restored the cache snapshot, %d entries are still fresh and %d expired while stopped\n", len(fresh), len(expired))
+	return expired
+}
+
+// Function to save the -cache-snapshot restored by the next start
+func saveSnapshot(db *sql.DB) {
+	saved, err := dbfunc.SaveSnapshot(db)
+	if err != nil {
+		log.Printf("Error saving the cache snapshot: %s\n", err)
+		return
+	}
+	log.Printf("Saved %d fresh entries to the cache snapshot\n", saved)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/clock"
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/miekg/dns"
+)
+
+func TestWarmupSkipsOperatorEntries(t *testing.T) {
+	db := newTestDB(t)
+	var mu sync.Mutex
+	var asked []string
+	useStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		mu.Lock()
+		asked = append(asked, request.Question[0].Name)
+		mu.Unlock()
+		answerStubA(writer, request)
+	})
+	for _, r := range []dbfunc.Resolution{
+		{Domain: "resolved.example", IP: "192.0.2.9", TTL: 300},
+		{Domain: "nas.lan", IP: "192.168.1.2", Static: true},
+		{Domain: "*.test.local", IP: "10.0.0.9", Static: true},
+	} {
+		if err := dbfunc.AddToDatabase(db, r); err != nil {
+			t.Fatalf("AddToDatabase(%s): %s", r.Domain, err)
+		}
+	}
+
+	warmup(db, 10, nil)
+	if len(asked) != 1 || asked[0] != "resolved.example." {
+		t.Errorf("warmup asked upstream for %v, want only resolved.example.", asked)
+	}
+	if warming.Load() {
+		t.Error("still warming after warmup returned")
+	}
+}
+
+func TestWarmupServfail(t *testing.T) {
+	db := newTestDB(t)
+	useStubUpstream(t, answerStubA)
+	warmupMode = "servfail"
+	warming.Store(true)
+	t.Cleanup(func() {
+		warmupMode = "cache"
+		warming.Store(false)
+	})
+
+	request := new(dns.Msg)
+	request.SetQuestion("example.com.", dns.TypeA)
+	writer := newTestWriter()
+	resolveDNSRequest(db)(writer, request)
+	if writer.msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("query during warmup got %s, want SERVFAIL", dns.RcodeToString[writer.msg.Rcode])
+	}
+
+	warming.Store(false)
+	writer = newTestWriter()
+	resolveDNSRequest(db)(writer, request)
+	if writer.msg.Rcode != dns.RcodeSuccess || len(answerIPs(writer.msg)) != 1 {
+		t.Errorf("query after warmup got %s", writer.msg)
+	}
+}
+
+func TestCacheSnapshotRestoredOnStart(t *testing.T) {
+	db := newTestDB(t)
+	fake := clock.NewFake(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	dbfunc.Clock = fake
+	t.Cleanup(func() { dbfunc.Clock = clock.Real{} })
+	for _, r := range []dbfunc.Resolution{
+		{Domain: "short.example", IP: "192.0.2.50", TTL: 60},
+		{Domain: "long.example", IP: "192.0.2.51", TTL: 3600},
+	} {
+		if err := dbfunc.AddToDatabase(db, r); err != nil {
+			t.Fatalf("AddToDatabase(%s): %s", r.Domain, err)
+		}
+	}
+	saveSnapshot(db)
+
+	// Restarted after short.example's TTL ran out
+	fake.Advance(5 * time.Minute)
+	var mu sync.Mutex
+	var asked []string
+	useStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		mu.Lock()
+		asked = append(asked, request.Question[0].Name)
+		mu.Unlock()
+		answerStubA(writer, request)
+	})
+	expired := restoreSnapshot(db)
+	if len(expired) != 1 || expired[0] != "short.example." {
+		t.Fatalf("restoreSnapshot = %v, want short.example. expired", expired)
+	}
+	warmup(db, 0, expired)
+	if len(asked) != 1 || asked[0] != "short.example." {
+		t.Errorf("warmup asked upstream for %v, want only the expired short.example.", asked)
+	}
+	if ip, err := dbfunc.GetFromDatabase(db, "short.example"); err != nil || ip != "192.0.2.1" {
+		t.Errorf("short.example = %q, %v after warmup, want the re-resolved 192.0.2.1", ip, err)
+	}
+}
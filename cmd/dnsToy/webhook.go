@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/metrics"
+)
+
+const (
+	webhookQueueSize = 1000            // Block events waiting to be posted before new ones are dropped
+	webhookAttempts  = 3               // Times a post is tried before the event is given up on
+	webhookTimeout   = 5 * time.Second // Time a single post may take
+)
+
+// blockEvent is the JSON body posted to -block-webhook for each blocked query
+type blockEvent struct {
+	ClientIP  string    `json:"client_ip"`
+	Domain    string    `json:"domain"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// webhookQueue holds the block events for the poster, nil without -block-webhook
+var webhookQueue chan blockEvent
+
+// Function to start posting block events to url in the background
+func startBlockWebhook(url string) {
+	webhookQueue = make(chan blockEvent, webhookQueueSize)
+	go postBlockEvents(url, webhookQueue)
+}
+
+// Function to queue a block event for the webhook, dropping it when the poster has fallen behind
+// so the query is never held up
+func notifyBlocked(clientIP net.IP, domain string) {
+	if webhookQueue == nil {
+		return
+	}
+	event := blockEvent{Domain: domain, Timestamp: appClock.Now().UTC()}
+	if clientIP != nil {
+		event.ClientIP = clientIP.String()
+	}
+	select {
+	case webhookQueue <- event:
+	default:
+		metrics.Inc("dnstoy_block_webhook_total", "result", "dropped")
+	}
+}
+
+// Function to post every queued block event, retrying failures with a growing delay
+func postBlockEvents(url string, queue <-chan blockEvent) {
+	client := &http.Client{Timeout: webhookTimeout}
+	for event := range queue {
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Error encoding block event: %s\n", err)
+			continue
+		}
+		for attempt := 1; ; attempt++ {
+			err = postBlockEvent(client, url, body)
+			if err == nil {
+				metrics.Inc("dnstoy_block_webhook_total", "result", "sent")
+				break
+			}
+			if attempt == webhookAttempts {
+				log.Printf("Error posting block event for %s: %s\n", event.Domain, err)
+				metrics.Inc("dnstoy_block_webhook_total", "result", "failed")
+				break
+			}
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+}
+
+// Function to post one encoded block event, treating any non-2xx status as a failure
+func postBlockEvent(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
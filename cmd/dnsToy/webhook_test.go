@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/schedule"
+	"github.com/miekg/dns"
+)
+
+// Function to point -block-webhook at a test server, returning the events it receives
+func startTestWebhook(t *testing.T) <-chan blockEvent {
+	t.Helper()
+	events := make(chan blockEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event blockEvent
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook got %s with %q, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("decoding block event: %s", err)
+		}
+		events <- event
+	}))
+	startBlockWebhook(server.URL)
+	t.Cleanup(func() {
+		close(webhookQueue)
+		webhookQueue = nil
+		server.Close()
+	})
+	return events
+}
+
+// Function to wait for the next event posted to the test webhook
+func receiveEvent(t *testing.T, events <-chan blockEvent) blockEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook received no block event")
+		return blockEvent{}
+	}
+}
+
+func TestBlockWebhookPosts(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	useFakeClock(t, now)
+	events := startTestWebhook(t)
+
+	notifyBlocked(net.IPv4(192, 0, 2, 10), "ads.example.")
+	event := receiveEvent(t, events)
+	if event.ClientIP != "192.0.2.10" || event.Domain != "ads.example." || !event.Timestamp.Equal(now) {
+		t.Errorf("webhook received %+v", event)
+	}
+}
+
+func TestScheduledBlockFiresWebhook(t *testing.T) {
+	db := newTestDB(t)
+	disableLookups(t)
+	// The only window is in the early morning, and the clock stands at noon
+	useFakeClock(t, time.Date(2026, 10, 16, 12, 0, 0, 0, time.Local))
+	rules, err := schedule.Parse(strings.NewReader("games.example * 06:00-07:00\n"), "test")
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	scheduleRules = rules
+	t.Cleanup(func() { scheduleRules = nil })
+	events := startTestWebhook(t)
+
+	request := new(dns.Msg)
+	request.SetQuestion("games.example.", dns.TypeA)
+	resolveDNSRequest(db)(newTestWriter(), request)
+	if event := receiveEvent(t, events); event.Domain != "games.example." || event.ClientIP != "192.0.2.10" {
+		t.Errorf("webhook received %+v for the scheduled block", event)
+	}
+}
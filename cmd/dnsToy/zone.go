@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/miekg/dns"
+)
+
+// localZones are the -zone names answered authoritatively from the database, lowercase and fully qualified
+var localZones []string
+
+// Function to parse the comma separated -zone value
+func parseZones(value string) []string {
+	var zones []string
+	for _, zone := range strings.Split(value, ",") {
+		zone = strings.TrimSpace(zone)
+		if zone == "" {
+			continue
+		}
+		zones = append(zones, strings.ToLower(dns.Fqdn(zone)))
+	}
+	return zones
+}
+
+// Function to find the local zone a name belongs to, preferring the most specific one,
+// or an empty string when it is in none of them
+func findLocalZone(name string) string {
+	name = strings.ToLower(dns.Fqdn(name))
+	match := ""
+	for _, zone := range localZones {
+		if dns.IsSubDomain(zone, name) && len(zone) > len(match) {
+			match = zone
+		}
+	}
+	return match
+}
+
+// Function to get the name server advertised for a local zone
+func zoneNameServer(zone string) string {
+	if zoneNS != "" {
+		return dns.Fqdn(zoneNS)
+	}
+	return "ns." + zone
+}
+
+// Function to build the SOA record of a local zone from the -soa-* settings
+func zoneSOA(zone string) *dns.SOA {
+	mbox := "hostmaster." + zone
+	if zoneMbox != "" {
+		mbox = dns.Fqdn(strings.Replace(zoneMbox, "@", ".", 1))
+	}
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: serveTTL(defaultTTL)},
+		Ns:      zoneNameServer(zone),
+		Mbox:    mbox,
+		Serial:  uint32(soaSerial),
+		Refresh: uint32(soaRefresh),
+		Retry:   uint32(soaRetry),
+		Expire:  uint32(soaExpire),
+		Minttl:  uint32(soaMinimum),
+	}
+}
+
+// Function to pick the startup SOA serial in the usual YYYYMMDDnn form when -soa-serial isn't set
+func defaultSOASerial(now time.Time) uint {
+	year, month, day := now.Date()
+	return uint(year*1000000+int(month)*10000+day*100) + 1
+}
+
+// Function to answer a question for a local zone authoritatively, never forwarding it upstream
+func answerLocalZone(db *sql.DB, response *dns.Msg, question dns.Question, zone string) {
+	response.Authoritative = true
+	name := strings.ToLower(dns.Fqdn(question.Name))
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: serveTTL(defaultTTL)}
+
+	if name == zone {
+		switch question.Qtype {
+		case dns.TypeSOA:
+			soa := zoneSOA(zone)
+			soa.Hdr.Name = question.Name
+			response.Answer = append(response.Answer, soa)
+			return
+		case dns.TypeNS:
+			response.Answer = append(response.Answer, &dns.NS{Hdr: hdr, Ns: zoneNameServer(zone)})
+			return
+		}
+	}
+
+	// Read like lookupResolution, from the replica when there is one, and count on the primary
+	resolution, _, err := dbfunc.GetWithExpiry(reader(db), name, 0, 0)
+	if err != nil && err != dbfunc.ErrNotFound {
+		log.Println(err)
+		response.Rcode = dns.RcodeServerFailure
+		return
+	}
+	if err == dbfunc.ErrNotFound && name != zone {
+		// Nothing is stored under the name, so it doesn't exist in the zone
+		response.Rcode = dns.RcodeNameError
+		response.Ns = append(response.Ns, zoneSOA(zone))
+		return
+	}
+	if err == nil {
+		if err := dbfunc.IncrementQueryCount(db, resolution.Domain); err != nil {
+			log.Printf("Error incrementing query count for %s: %s\n", resolution.Domain, err)
+		}
+	}
+	for _, address := range resolution.Addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); question.Qtype == dns.TypeA && ip4 != nil {
+			response.Answer = append(response.Answer, &dns.A{Hdr: hdr, A: ip4})
+		} else if question.Qtype == dns.TypeAAAA && ip4 == nil {
+			response.Answer = append(response.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	if len(response.Answer) > 0 {
+		return
+	}
+	// The name exists but has no records of the asked type
+	response.Ns = append(response.Ns, zoneSOA(zone))
+}
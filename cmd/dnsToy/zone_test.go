@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/dbfunc"
+	"github.com/miekg/dns"
+)
+
+// Function to serve the comma separated zones locally for a test
+func useLocalZones(t *testing.T, zones string) {
+	t.Helper()
+	localZones = parseZones(zones)
+	t.Cleanup(func() { localZones = nil })
+}
+
+func TestLocalZoneNSAndSOA(t *testing.T) {
+	db := newTestDB(t)
+	disableLookups(t)
+	useLocalZones(t, "Corp.Example")
+	oldSerial, oldMbox := soaSerial, zoneMbox
+	soaSerial, zoneMbox = 2026101601, "admin@corp.example"
+	t.Cleanup(func() { soaSerial, zoneMbox = oldSerial, oldMbox })
+
+	ask := func(name string, qtype uint16) *dns.Msg {
+		t.Helper()
+		request := new(dns.Msg)
+		request.SetQuestion(name, qtype)
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		if !writer.msg.Authoritative || writer.msg.Rcode != dns.RcodeSuccess {
+			t.Fatalf("%s %s answered %s (aa %t), want an authoritative NOERROR", name, dns.TypeToString[qtype], dns.RcodeToString[writer.msg.Rcode], writer.msg.Authoritative)
+		}
+		if len(writer.msg.Answer) != 1 {
+			t.Fatalf("%s %s answered %v, want one record", name, dns.TypeToString[qtype], writer.msg.Answer)
+		}
+		return writer.msg
+	}
+
+	ns, ok := ask("corp.example.", dns.TypeNS).Answer[0].(*dns.NS)
+	if !ok || ns.Ns != "ns.corp.example." || ns.Hdr.Name != "corp.example." {
+		t.Errorf("NS answered %v, want ns.corp.example.", ns)
+	}
+
+	soa, ok := ask("CORP.example.", dns.TypeSOA).Answer[0].(*dns.SOA)
+	want := &dns.SOA{Ns: "ns.corp.example.", Mbox: "admin.corp.example.", Serial: 2026101601, Refresh: uint32(soaRefresh), Retry: uint32(soaRetry), Expire: uint32(soaExpire), Minttl: uint32(soaMinimum)}
+	if !ok || soa.Hdr.Name != "CORP.example." || soa.Ns != want.Ns || soa.Mbox != want.Mbox || soa.Serial != want.Serial ||
+		soa.Refresh != want.Refresh || soa.Retry != want.Retry || soa.Expire != want.Expire || soa.Minttl != want.Minttl {
+		t.Errorf("SOA answered %v, want the -soa-* values %v", soa, want)
+	}
+
+	// A name below the zone that isn't stored doesn't exist, and the SOA says how long to remember that
+	request := new(dns.Msg)
+	request.SetQuestion("missing.corp.example.", dns.TypeNS)
+	writer := newTestWriter()
+	resolveDNSRequest(db)(writer, request)
+	if writer.msg.Rcode != dns.RcodeNameError || !writer.msg.Authoritative || len(writer.msg.Ns) != 1 {
+		t.Errorf("missing name answered %s (aa %t) with authority %v, want an authoritative NXDOMAIN with the SOA",
+			dns.RcodeToString[writer.msg.Rcode], writer.msg.Authoritative, writer.msg.Ns)
+	}
+}
+
+func TestDefaultSOASerial(t *testing.T) {
+	if got := defaultSOASerial(time.Date(2026, 10, 16, 23, 59, 0, 0, time.UTC)); got != 2026101601 {
+		t.Errorf("defaultSOASerial = %d, want 2026101601", got)
+	}
+}
+
+func TestAuthoritativeOnly(t *testing.T) {
+	db := newTestDB(t)
+	var asked atomic.Int32
+	useStubUpstream(t, func(writer dns.ResponseWriter, request *dns.Msg) {
+		asked.Add(1)
+		answerStubA(writer, request)
+	})
+	useLocalZones(t, "corp.example")
+	authoritativeOnly = true
+	t.Cleanup(func() { authoritativeOnly = false })
+	if err := dbfunc.AddToDatabase(db, dbfunc.Resolution{Domain: "host.corp.example.", IP: "10.0.0.5", TTL: 300, Static: true}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	clearStaticRecords(t)
+	staticMutex.Lock()
+	staticRecords["api.example."] = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "api.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(192, 0, 2, 20),
+	}}
+	staticMutex.Unlock()
+
+	for _, test := range []struct {
+		name  string
+		rcode int
+		want  string // The answered address, empty for none
+	}{
+		{"host.corp.example.", dns.RcodeSuccess, "10.0.0.5"},
+		{"api.example.", dns.RcodeSuccess, "192.0.2.20"},
+		{"missing.corp.example.", dns.RcodeNameError, ""},
+		{"example.com.", dns.RcodeRefused, ""},
+	} {
+		request := new(dns.Msg)
+		request.SetQuestion(test.name, dns.TypeA)
+		writer := newTestWriter()
+		resolveDNSRequest(db)(writer, request)
+		got := answerIPs(writer.msg)
+		if writer.msg.Rcode != test.rcode || (test.want == "" && len(got) != 0) || (test.want != "" && (len(got) != 1 || got[0] != test.want)) {
+			t.Errorf("%s answered %s %v, want %s %s", test.name, dns.RcodeToString[writer.msg.Rcode], got, dns.RcodeToString[test.rcode], test.want)
+		}
+		if writer.msg.RecursionAvailable {
+			t.Errorf("%s answered with recursion available", test.name)
+		}
+	}
+	if got := asked.Load(); got != 0 {
+		t.Errorf("upstream asked %d times, want never", got)
+	}
+}
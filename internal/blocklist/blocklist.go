@@ -0,0 +1,131 @@
+package blocklist
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// List is a set of domains where an entry also covers every subdomain below it
+type List struct {
+	domains map[string]struct{}
+	bloom   *bloomFilter // Prefilter so names that aren't listed skip the map lookups
+}
+
+// initialBloomSize is the number of entries the prefilter of a new list is sized for
+const initialBloomSize = 1024
+
+// New creates an empty list
+func New() *List {
+	return &List{domains: make(map[string]struct{}), bloom: newBloomFilter(initialBloomSize)}
+}
+
+// Function to load a list from a file in hosts or plain domain-per-line format
+func Load(path string) (*List, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	list := New()
+	if err := list.Parse(file); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Function to read entries from r and add them to the list
+func (l *List) Parse(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// Drop comments
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// Hosts format lines start with the address the names point to
+		if len(fields) > 1 {
+			fields = fields[1:]
+		}
+		for _, domain := range fields {
+			l.Add(domain)
+		}
+	}
+	return scanner.Err()
+}
+
+// Function to add a domain to the list, a leading "*." is accepted and ignored
+func (l *List) Add(domain string) {
+	domain = strings.TrimPrefix(strings.ToLower(domain), "*.")
+	if domain == "" || domain == "localhost" {
+		return
+	}
+	domain = dns.Fqdn(domain)
+	l.domains[domain] = struct{}{}
+	if len(l.domains) <= l.bloom.target {
+		l.bloom.add(domain)
+		return
+	}
+	// The filter is full, resize it so the false positive rate stays low
+	l.bloom = newBloomFilter(l.bloom.target * 4)
+	for entry := range l.domains {
+		l.bloom.add(entry)
+	}
+}
+
+// Function to check if a name or any of its parent domains is on the list
+func (l *List) Contains(name string) bool {
+	if l == nil {
+		return false
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if !l.bloom.mayContain(name[off:]) {
+			continue
+		}
+		if _, found := l.domains[name[off:]]; found {
+			return true
+		}
+	}
+	return false
+}
+
+// Function to get the number of entries on the list
+func (l *List) Len() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.domains)
+}
+
+// Function to count the entries of next that aren't on the list and the entries of the list
+// that aren't on next, either list may be nil
+func (l *List) Diff(next *List) (added, removed int) {
+	for domain := range next.entries() {
+		if _, found := l.entries()[domain]; !found {
+			added++
+		}
+	}
+	for domain := range l.entries() {
+		if _, found := next.entries()[domain]; !found {
+			removed++
+		}
+	}
+	return added, removed
+}
+
+// Function to get the entries of a list, none for a nil list
+func (l *List) entries() map[string]struct{} {
+	if l == nil {
+		return nil
+	}
+	return l.domains
+}
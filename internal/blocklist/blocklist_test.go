@@ -0,0 +1,148 @@
+package blocklist
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	list := New()
+	err := list.Parse(strings.NewReader(`# hosts format
+0.0.0.0 ads.example tracker.example
+127.0.0.1 localhost
+# plain domains
+Malware.Example.
+*.wild.example   # trailing comment
+`))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if list.Len() != 4 {
+		t.Errorf("Len = %d, want 4 entries", list.Len())
+	}
+	for _, test := range []struct {
+		name string
+		want bool
+	}{
+		{"ads.example.", true},
+		{"tracker.example", true},
+		{"MALWARE.example", true},
+		{"cdn.ads.example.", true},
+		{"a.b.wild.example.", true},
+		{"wild.example.", true},
+		{"example.", false},
+		{"notads.example.", false},
+		{"localhost.", false},
+	} {
+		if got := list.Contains(test.name); got != test.want {
+			t.Errorf("Contains(%s) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNilList(t *testing.T) {
+	var list *List
+	if list.Contains("ads.example.") || list.Len() != 0 {
+		t.Error("nil list isn't empty")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old, next := New(), New()
+	for _, domain := range []string{"a.example", "b.example", "c.example"} {
+		old.Add(domain)
+	}
+	for _, domain := range []string{"b.example", "c.example", "d.example", "e.example"} {
+		next.Add(domain)
+	}
+	if added, removed := old.Diff(next); added != 2 || removed != 1 {
+		t.Errorf("Diff = %d added, %d removed, want 2 and 1", added, removed)
+	}
+	if added, removed := (*List)(nil).Diff(next); added != 4 || removed != 0 {
+		t.Errorf("Diff from nil = %d added, %d removed, want 4 and 0", added, removed)
+	}
+}
+
+func TestListGrowsPastBloomSize(t *testing.T) {
+	list := New()
+	count := initialBloomSize * 5
+	for i := 0; i < count; i++ {
+		list.Add(fmt.Sprintf("host%d.example", i))
+	}
+	// The prefilter is rebuilt as the list grows and must never hide an entry
+	for i := 0; i < count; i++ {
+		if name := fmt.Sprintf("sub.host%d.example.", i); !list.Contains(name) {
+			t.Fatalf("Contains(%s) = false after the filter was resized", name)
+		}
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	filter := newBloomFilter(1000)
+	for i := 0; i < 1000; i++ {
+		filter.add(fmt.Sprintf("listed%d.", i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !filter.mayContain(fmt.Sprintf("listed%d.", i)) {
+			t.Fatalf("false negative for listed%d.", i)
+		}
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.mayContain(fmt.Sprintf("unlisted%d.", i)) {
+			falsePositives++
+		}
+	}
+	// The filter is sized for 1%, leave room for chance
+	if rate := float64(falsePositives) / 10000; rate > 3*bloomFalsePositiveRate {
+		t.Errorf("false positive rate %.3f, want about %.2f", rate, bloomFalsePositiveRate)
+	}
+}
+
+func TestNoFalseBlocks(t *testing.T) {
+	list := New()
+	for i := 0; i < 100000; i++ {
+		list.Add(fmt.Sprintf("ads%d.example", i))
+	}
+	// Bloom filter hits on names that aren't listed fall through to the exact set
+	for i := 0; i < 100000; i++ {
+		for _, name := range []string{fmt.Sprintf("news%d.example.", i), fmt.Sprintf("ads%d.example.net.", i)} {
+			if list.Contains(name) {
+				t.Fatalf("Contains(%s) = true for a name that isn't listed", name)
+			}
+		}
+	}
+}
+
+// Function to build a list of count entries named host<i>.example for benchmarks
+func benchmarkList(count int) *List {
+	list := New()
+	for i := 0; i < count; i++ {
+		list.Add(fmt.Sprintf("host%d.example", i))
+	}
+	return list
+}
+
+func BenchmarkContains(b *testing.B) {
+	list := benchmarkList(1000000)
+	for _, bench := range []struct {
+		name   string
+		format string
+	}{
+		{"Miss", "www.unlisted%d.example.org."},
+		{"Hit", "host%d.example."},
+		{"SubdomainHit", "a.b.host%d.example."},
+	} {
+		names := make([]string, 1024)
+		for i := range names {
+			names[i] = fmt.Sprintf(bench.format, i*977)
+		}
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				list.Contains(names[i%len(names)])
+			}
+		})
+	}
+}
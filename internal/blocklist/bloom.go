@@ -0,0 +1,60 @@
+package blocklist
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// bloomFalsePositiveRate is the target false positive rate of the prefilter
+const bloomFalsePositiveRate = 0.01
+
+// bloomFilter is a probabilistic set that answers "definitely not present" cheaply
+type bloomFilter struct {
+	bits   []uint64
+	m      uint64 // Number of bits
+	k      uint64 // Number of hash functions
+	target int    // Number of entries the filter was sized for
+}
+
+// Function to create a filter sized for n entries at the target false positive rate
+func newBloomFilter(n int) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(bloomFalsePositiveRate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{bits: make([]uint64, (m+63)/64), m: m, k: k, target: n}
+}
+
+// Function to derive the two base hashes used for double hashing
+func bloomHashes(s string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	h1 := h.Sum64()
+	// Mix the first hash to get an independent second one
+	h2 := h1*0x9E3779B97F4A7C15 ^ h1>>29 | 1
+	return h1, h2
+}
+
+func (b *bloomFilter) add(s string) {
+	h1, h2 := bloomHashes(s)
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Function to check if s may be in the set, false means it definitely isn't
+func (b *bloomFilter) mayContain(s string) bool {
+	h1, h2 := bloomHashes(s)
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
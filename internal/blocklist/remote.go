@@ -0,0 +1,117 @@
+package blocklist
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fetchTimeout bounds how long fetching one remote list may take
+const fetchTimeout = 30 * time.Second
+
+// maxListSize caps the size of a fetched list so a broken source can't exhaust memory
+var maxListSize int64 = 64 << 20
+
+// Function to check if a list source is an http(s) URL rather than a file path
+func IsRemote(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// Function to load and merge the lists from comma separated sources, each a file path or an
+// http(s) URL. Fetched lists are kept in cacheDir and read from there when their source is down
+func LoadSources(sources, cacheDir string) (*List, error) {
+	list := New()
+	for _, source := range strings.Split(sources, ",") {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		var err error
+		if IsRemote(source) {
+			err = loadRemote(list, source, cacheDir)
+		} else {
+			err = loadFile(list, source)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// Function to add the entries of a list file to list
+func loadFile(list *List, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return list.Parse(file)
+}
+
+// Function to fetch a remote list into list, refreshing its cached copy, or falling back
+// to the cached copy when the fetch fails
+func loadRemote(list *List, url, cacheDir string) error {
+	cachePath := filepath.Join(cacheDir, cacheName(url))
+	body, err := fetch(url)
+	if err != nil {
+		cached, cacheErr := os.ReadFile(cachePath)
+		if cacheErr != nil {
+			return fmt.Errorf("fetching %s: %s", url, err)
+		}
+		log.Printf("Error fetching %s, using the cached copy: %s\n", url, err)
+		body = cached
+	} else if err := writeCache(cacheDir, cachePath, body); err != nil {
+		log.Printf("Error caching %s: %s\n", url, err)
+	}
+	return list.Parse(bytes.NewReader(body))
+}
+
+// Function to download a remote list
+func fetch(url string) ([]byte, error) {
+	client := &http.Client{Timeout: fetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server answered %s", resp.Status)
+	}
+	// Read one byte past the cap, so an oversized list fails rather than being cut short
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxListSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxListSize {
+		return nil, fmt.Errorf("list is larger than %d bytes", maxListSize)
+	}
+	return body, nil
+}
+
+// Function to replace the cached copy of a list, writing it to a temporary file first
+// so a crash never leaves a truncated cache behind
+func writeCache(cacheDir, cachePath string, body []byte) error {
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return err
+	}
+	tmp := cachePath + ".tmp"
+	if err := os.WriteFile(tmp, body, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cachePath)
+}
+
+// Function to name the cache file of a URL
+func cacheName(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:8]) + ".list"
+}
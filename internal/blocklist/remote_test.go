@@ -0,0 +1,56 @@
+package blocklist
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Function to serve body as a list over HTTP, returning the list's URL
+func serveList(t *testing.T, body *string) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(*body))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/list.txt"
+}
+
+func TestFetchSizeLimit(t *testing.T) {
+	limit := maxListSize
+	maxListSize = 32
+	t.Cleanup(func() { maxListSize = limit })
+
+	body := strings.Repeat("x", 32)
+	url := serveList(t, &body)
+	if got, err := fetch(url); err != nil || string(got) != body {
+		t.Errorf("list at the limit: got %d bytes, %v", len(got), err)
+	}
+	body += "x"
+	if got, err := fetch(url); err == nil {
+		t.Errorf("list over the limit fetched %d bytes, want an error", len(got))
+	}
+}
+
+func TestLoadRemoteFallsBackToCache(t *testing.T) {
+	limit := maxListSize
+	t.Cleanup(func() { maxListSize = limit })
+	cacheDir := t.TempDir()
+
+	body := "ads.example\n"
+	url := serveList(t, &body)
+	if err := loadRemote(New(), url, cacheDir); err != nil {
+		t.Fatalf("loadRemote: %s", err)
+	}
+
+	// An oversized list is rejected and the cached copy is used instead of a truncated one
+	maxListSize = 4
+	list := New()
+	if err := loadRemote(list, url, cacheDir); err != nil {
+		t.Fatalf("loadRemote with an oversized list: %s", err)
+	}
+	if !list.Contains("ads.example") {
+		t.Error("cached copy wasn't loaded")
+	}
+}
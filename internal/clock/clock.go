@@ -0,0 +1,118 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of the current time and of tickers, so time based behaviour can be driven by hand
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks on C until it is stopped, like time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the Clock backed by the time package
+type Real struct{}
+
+// Function to get the current wall clock time
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// Function to start a time.Ticker
+func (Real) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.ticker.C
+}
+
+func (t realTicker) Stop() {
+	t.ticker.Stop()
+}
+
+// Fake is a Clock that only moves when Advance is called
+type Fake struct {
+	mutex   sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// Function to create a fake clock standing still at start
+func NewFake(start time.Time) *Fake {
+	return &Fake{now: start}
+}
+
+// Function to get the fake clock's current time
+func (f *Fake) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+// Function to start a ticker that fires as Advance moves the fake clock past each interval
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	t := &fakeTicker{clock: f, interval: d, next: f.now.Add(d), c: make(chan time.Time, 1)}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+// Function to move the fake clock forward by d, firing any tickers that fall due. Like a real
+// ticker, a tick is dropped when the previous one hasn't been received yet
+func (f *Fake) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = f.now.Add(d)
+	for _, t := range f.tickers {
+		for !t.next.After(f.now) {
+			select {
+			case t.c <- t.next:
+			default:
+			}
+			t.next = t.next.Add(t.interval)
+		}
+	}
+}
+
+// Function to count the tickers running on the fake clock, so a test can wait for a goroutine
+// to start its ticker before moving the clock
+func (f *Fake) Tickers() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.tickers)
+}
+
+type fakeTicker struct {
+	clock    *Fake
+	interval time.Duration
+	next     time.Time
+	c        chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	for i, other := range t.clock.tickers {
+		if other == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeAdvance(t *testing.T) {
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	fake := NewFake(start)
+	ticker := fake.NewTicker(time.Minute)
+	defer ticker.Stop()
+	if got := fake.Tickers(); got != 1 {
+		t.Fatalf("Tickers = %d, want 1", got)
+	}
+
+	fake.Advance(59 * time.Second)
+	select {
+	case tick := <-ticker.C():
+		t.Fatalf("ticked at %s before the interval passed", tick)
+	default:
+	}
+	fake.Advance(time.Second)
+	select {
+	case tick := <-ticker.C():
+		if !tick.Equal(start.Add(time.Minute)) {
+			t.Errorf("tick at %s, want %s", tick, start.Add(time.Minute))
+		}
+	default:
+		t.Fatal("no tick once the interval passed")
+	}
+	if now := fake.Now(); !now.Equal(start.Add(time.Minute)) {
+		t.Errorf("Now = %s, want %s", now, start.Add(time.Minute))
+	}
+
+	// A stopped ticker no longer fires
+	ticker.Stop()
+	if got := fake.Tickers(); got != 0 {
+		t.Errorf("Tickers = %d after Stop, want 0", got)
+	}
+	fake.Advance(time.Hour)
+	select {
+	case tick := <-ticker.C():
+		t.Errorf("stopped ticker ticked at %s", tick)
+	default:
+	}
+}
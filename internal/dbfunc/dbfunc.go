@@ -2,106 +2,997 @@ package dbfunc
 
 import (
 	"database/sql"
+	"encoding/csv"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/chaoticcyber/dnsToy/internal/clock"
+	"github.com/chaoticcyber/dnsToy/internal/metrics"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
 )
 
-// Function to query the database for domain resolution
-func GetFromDatabase(db *sql.DB, domain string) (string, bool) {
-	var resolvedIP string
-	err := db.QueryRow("SELECT ip FROM resolutions WHERE domain=?", domain).Scan(&resolvedIP)
+// DefaultTTL is stored for resolutions whose upstream TTL isn't known
+const DefaultTTL uint32 = 60
+
+// Policies for AddToDatabase when a domain is already stored with a different IP
+const (
+	ConflictUpdate = "update" // Overwrite the stored IP with the new one
+	ConflictKeep   = "keep"   // Keep the first stored IP and ignore the new one
+)
+
+// OnConflict is the policy AddToDatabase applies when a domain's IP changes
+var OnConflict = ConflictUpdate
+
+// PreserveCase shows domains in the spelling they were first stored with, lookups match
+// case-insensitively on the normalized domain either way
+var PreserveCase = false
+
+// PreferFamily is the address family ("v4" or "v6") that leads a domain's stored addresses when it
+// has both, so it becomes the entry's IP. Empty keeps the order the addresses were resolved in
+var PreferFamily = ""
+
+// Clock is read for the timestamps stored with entries and the ages compared with their TTLs
+var Clock clock.Clock = clock.Real{}
+
+// Function to format the clock's current time the way SQLite's CURRENT_TIMESTAMP does
+func timestamp() string {
+	return Clock.Now().UTC().Format("2006-01-02 15:04:05")
+}
+
+// Function to record how long a database operation took, called deferred with its start time
+func observe(op string, start time.Time) {
+	metrics.Observe("dnstoy_db_duration_seconds", time.Since(start).Seconds(), "op", op)
+}
+
+// Function to normalize a domain to the form it is stored under: lowercase, fully qualified
+// and with internationalized labels in their punycode form, so every spelling of a name
+// shares one entry
+func NormalizeDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if domain == "" {
+		return "."
+	}
+	for i := 0; i < len(domain); i++ {
+		if domain[i] >= 0x80 {
+			if ascii, err := idna.Lookup.ToASCII(strings.TrimSuffix(domain, ".")); err == nil {
+				domain = ascii
+			}
+			break
+		}
+	}
+	if !strings.HasSuffix(domain, ".") {
+		domain += "."
+	}
+	return domain
+}
+
+// Function to get the spelling of a domain stored in domain_display, as it was given. It is
+// recorded whatever PreserveCase says, so the flag can be turned on later for existing entries
+func displayDomain(domain string) string {
+	return dns.Fqdn(strings.TrimSpace(domain))
+}
+
+// Function to get the column domains are shown from, the first spelling seen with PreserveCase
+// and the normalized domain otherwise
+func displayColumn() string {
+	if !PreserveCase {
+		return "domain"
+	}
+	return "COALESCE(domain_display, domain)"
+}
+
+// Function to open the SQLite database in WAL mode with a busy timeout, so concurrent
+// readers and writers wait for each other instead of failing with "database is locked"
+func Open(path string, busyTimeoutMs int) (*sql.DB, error) {
+	dsn := fmt.Sprintf("file:%s?_busy_timeout=%d&_journal_mode=WAL", path, busyTimeoutMs)
+	return sql.Open("sqlite3", dsn)
+}
+
+// Function to open a database from a full SQLite DSN, e.g. a read-only replica
+// given as file:replica.db?mode=ro
+func OpenDSN(dsn string) (*sql.DB, error) {
+	return sql.Open("sqlite3", dsn)
+}
+
+// Function to create the tables used by the resolver if they don't exist
+func CreateTables(db *sql.DB) error {
+	// query_count is an INTEGER, which SQLite stores as a signed 64-bit value
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS resolutions (domain TEXT PRIMARY KEY, ip TEXT, query_count INTEGER DEFAULT 0)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS queries (domain TEXT, qtype TEXT, query_count INTEGER DEFAULT 0, PRIMARY KEY (domain, qtype))`)
+	if err != nil {
+		return err
+	}
+	// Records of types other than A, kept in their text form and expired by their TTL
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS records (domain TEXT, qtype TEXT, data TEXT, ttl INTEGER, stored_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS records_domain_qtype ON records (domain, qtype)`)
+	if err != nil {
+		return err
+	}
+	// The entries that were fresh at the last shutdown, saved by SaveSnapshot
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS cache_snapshot (domain TEXT PRIMARY KEY, expires_at TIMESTAMP)`)
+	if err != nil {
+		return err
+	}
+	// Columns added after the table was first created
+	if err := addColumn(db, "resolutions", "ttl", fmt.Sprintf("INTEGER DEFAULT %d", DefaultTTL)); err != nil {
+		return err
+	}
+	if err := addColumn(db, "resolutions", "changed_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+	if err := addColumn(db, "resolutions", "country", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	// A NULL cache_ttl falls back to the default passed to GetWithExpiry
+	if err := addColumn(db, "resolutions", "cache_ttl", "INTEGER"); err != nil {
+		return err
+	}
+	if err := addColumn(db, "resolutions", "resolved_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+	// An operator set upstream for a domain that isn't resolved yet is stored with an empty ip
+	if err := addColumn(db, "resolutions", "upstream", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	// Entries stored as *.parent answer for every name below parent that has no entry of its own
+	if err := addColumn(db, "resolutions", "wildcard", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	// Operator entered entries are static, they are never expired or overwritten by resolved answers
+	if err := addColumn(db, "resolutions", "inserted_at", "TIMESTAMP"); err != nil {
+		return err
+	}
+	if err := addColumn(db, "resolutions", "static", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	// The domain column is the lowercase lookup key, domain_display the first spelling seen
+	if err := addColumn(db, "resolutions", "domain_display", "TEXT"); err != nil {
+		return err
+	}
+	if err := normalizeStoredDomains(db); err != nil {
+		return err
+	}
+	return convertStoredIPs(db)
+}
+
+// Function to fold entries stored under other spellings of a name into its normalized entry,
+// adding up their query counts
+func normalizeStoredDomains(db *sql.DB) error {
+	rows, err := db.Query("SELECT domain FROM resolutions")
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return "", false // Domain not found in database
+		return err
+	}
+	var stale []string
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			rows.Close()
+			return err
+		}
+		if NormalizeDomain(domain) != domain {
+			stale = append(stale, domain)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, domain := range stale {
+		normalized := NormalizeDomain(domain)
+		// Keep the normalized entry when there is one, otherwise rename the stale one
+		result, err := db.Exec(`UPDATE resolutions SET query_count = query_count +
+			(SELECT query_count FROM resolutions WHERE domain=?) WHERE domain=?`, domain, normalized)
+		if err != nil {
+			return err
 		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n > 0 {
+			_, err = db.Exec("DELETE FROM resolutions WHERE domain=?", domain)
+		} else {
+			_, err = db.Exec("UPDATE resolutions SET domain=? WHERE domain=?", normalized, domain)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Function to add a column to an existing table, doing nothing when it is already there
+func addColumn(db *sql.DB, table, column, definition string) error {
+	_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil && strings.Contains(err.Error(), "duplicate column name") {
+		return nil
+	}
+	return err
+}
+
+// Function to check if a domain is a wildcard entry, one starting with "*."
+func IsWildcard(domain string) bool {
+	return strings.HasPrefix(domain, "*.")
+}
+
+// Function to find the closest wildcard entry covering a domain, e.g. *.test.local. for
+// a.b.test.local. when there is no *.b.test.local., ErrNotFound when none does
+func matchWildcard(db *sql.DB, domain string) (string, error) {
+	var candidates []string
+	var args []interface{}
+	for off, end := dns.NextLabel(domain, 0); !end; off, end = dns.NextLabel(domain, off) {
+		candidates = append(candidates, "?")
+		args = append(args, "*."+domain[off:])
+	}
+	if len(candidates) == 0 {
+		return "", ErrNotFound
+	}
+	var wildcard string
+	err := db.QueryRow(`SELECT domain FROM resolutions WHERE wildcard=1 AND ip != '' AND domain IN (`+strings.Join(candidates, ", ")+`)
+		ORDER BY length(domain) DESC LIMIT 1`, args...).Scan(&wildcard)
+	if err != nil {
+		return "", queryError("wildcard", domain, err)
+	}
+	return wildcard, nil
+}
+
+// Function to find the entry answering a domain, its own or else a covering wildcard,
+// ErrNotFound when there is neither
+func answeringEntry(db *sql.DB, domain string) (string, string, error) {
+	ip, err := exactEntry(db, domain)
+	if err != ErrNotFound {
+		return domain, ip, err
+	}
+	wildcard, err := matchWildcard(db, domain)
+	if err != nil {
+		return "", "", err
+	}
+	ip, err = exactEntry(db, wildcard)
+	return wildcard, ip, err
+}
+
+// Function to query the database for domain resolution, falling back to a wildcard entry
+// when the domain has no entry of its own. The error is ErrNotFound when neither exists
+// and a *QueryError when the database failed
+func GetFromDatabase(db *sql.DB, domain string) (string, error) {
+	defer observe("get", time.Now())
+	entry, resolvedIP, err := answeringEntry(db, NormalizeDomain(domain))
+	if err != nil {
+		return "", err
+	}
+
+	// Increment the query count for the domain
+	if _, err := db.Exec("UPDATE resolutions SET query_count=query_count+1 WHERE domain=?", entry); err != nil {
+		log.Printf("Error incrementing query count for %s: %s\n", entry, err)
+	}
+	return resolvedIP, nil
+}
+
+// Function to query the database for domain resolution the way GetFromDatabase does, logging
+// database errors and reporting them as not found, for callers that only need to know if it hit
+func GetFromDatabaseOK(db *sql.DB, domain string) (string, bool) {
+	resolvedIP, err := GetFromDatabase(db, domain)
+	if err != nil && err != ErrNotFound {
 		log.Println(err)
+	}
+	return resolvedIP, err == nil
+}
+
+// Function to query the database for domain resolution, also reporting whether the entry has
+// outlived its cache TTL (defaultCacheTTL for entries without their own, 0 to keep them forever).
+// When adaptiveMax is set, the default is stretched for popular domains with AdaptiveCacheTTL.
+// It only reads, so it can run against a replica, the caller counts the query with IncrementQueryCount.
+// A domain without an entry of its own is answered from a covering wildcard entry, and the returned
+// resolution is the entry that answered, with every address it holds. Wildcard and static entries never expire.
+// The error is ErrNotFound when there is no entry and a *QueryError when the database failed
+func GetWithExpiry(db *sql.DB, domain string, defaultCacheTTL, adaptiveMax uint32) (Resolution, bool, error) {
+	defer observe("get", time.Now())
+	entry, _, err := answeringEntry(db, NormalizeDomain(domain))
+	if err != nil {
+		return Resolution{}, false, err
+	}
+	var ownCacheTTL sql.NullInt64
+	row := db.QueryRow("SELECT domain, "+resolutionColumns+", cache_ttl FROM resolutions WHERE domain=?", entry)
+	r, err := scanResolution(row, &ownCacheTTL)
+	if err != nil {
+		return Resolution{}, false, queryError("get", entry, err)
+	}
+	if r.Addresses, err = storedAddresses(db, r); err != nil {
+		return Resolution{}, false, queryError("addresses", entry, err)
+	}
+	if r.Wildcard || r.Static {
+		return r, false, nil
+	}
+	cacheTTL := int64(defaultCacheTTL)
+	if ownCacheTTL.Valid {
+		// A TTL the operator set for the entry is used as it is
+		cacheTTL = ownCacheTTL.Int64
+	} else if adaptiveMax > 0 {
+		cacheTTL = int64(AdaptiveCacheTTL(defaultCacheTTL, int64(r.QueryCount), adaptiveMax))
+	}
+	return r, cacheTTL > 0 && r.Age() >= time.Duration(cacheTTL)*time.Second, nil
+}
+
+// Function to scale a cache TTL by a domain's popularity, adding the base TTL once more for
+// each power of ten queries, capped at max
+func AdaptiveCacheTTL(base uint32, queryCount int64, max uint32) uint32 {
+	ttl := uint64(base)
+	for count := queryCount; count >= 10 && ttl < uint64(max); count /= 10 {
+		ttl += uint64(base)
+	}
+	if ttl > uint64(max) {
+		return max
+	}
+	return uint32(ttl)
+}
+
+// Function to get the IP stored for a domain under exactly that name
+func exactEntry(db *sql.DB, domain string) (string, error) {
+	var ip storedIP
+	err := db.QueryRow("SELECT ip FROM resolutions WHERE domain=? AND ip != ''", domain).Scan(&ip)
+	if err != nil {
+		return "", queryError("get", domain, err)
+	}
+	return string(ip), nil
+}
+
+// Function to get the upstream server set for a domain, found is false when it has none
+func GetUpstream(db *sql.DB, domain string) (string, bool) {
+	var upstream string
+	err := db.QueryRow("SELECT upstream FROM resolutions WHERE domain=?", NormalizeDomain(domain)).Scan(&upstream)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
 		return "", false
 	}
+	return upstream, upstream != ""
+}
 
-	// Increment the query count for the domain
-	db.Exec("UPDATE resolutions SET query_count=query_count+1 WHERE domain=?", domain)
-	return resolvedIP, true // Domain found in database
+// Function to set the upstream server cache misses for a domain are forwarded to, an empty
+// upstream goes back to the configured ones
+func SetUpstream(db *sql.DB, domain, upstream string) error {
+	_, err := db.Exec(`INSERT INTO resolutions(domain, ip, upstream) VALUES(?, '', ?)
+		ON CONFLICT(domain) DO UPDATE SET upstream=excluded.upstream`, NormalizeDomain(domain), upstream)
+	return err
+}
+
+// Function to count a query answered for a domain
+func IncrementQueryCount(db *sql.DB, domain string) error {
+	defer observe("increment", time.Now())
+	_, err := db.Exec("UPDATE resolutions SET query_count=query_count+1 WHERE domain=?", NormalizeDomain(domain))
+	return err
+}
+
+// Function to set how long a domain's entry is kept before it is resolved again, 0 to keep it forever
+func SetCacheTTL(db *sql.DB, domain string, cacheTTL uint32) error {
+	result, err := db.Exec("UPDATE resolutions SET cache_ttl=? WHERE domain=?", cacheTTL, NormalizeDomain(domain))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("%s is not in the database", domain)
+	}
+	return nil
 }
 
-// Function to perform DNS resolution and store in the database
+// Function to replace the stored records of a type for a domain, given in their text form
+func SetRecords(db *sql.DB, domain, qtype string, records []string, ttl uint32) error {
+	defer observe("set_records", time.Now())
+	domain = NormalizeDomain(domain)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM records WHERE domain=? AND qtype=?", domain, qtype); err != nil {
+		return err
+	}
+	for _, record := range records {
+		if _, err := tx.Exec("INSERT INTO records(domain, qtype, data, ttl, stored_at) VALUES(?, ?, ?, ?, ?)", domain, qtype, record, ttl, timestamp()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Function to get the stored records of a type for a domain that haven't outlived their TTL,
+// along with the seconds they have left
+func GetRecords(db *sql.DB, domain, qtype string) ([]string, uint32, error) {
+	defer observe("get_records", time.Now())
+	rows, err := db.Query(`SELECT data, ttl - (? - CAST(strftime('%s', stored_at) AS INTEGER))
+		FROM records WHERE domain=? AND qtype=?`, Clock.Now().Unix(), NormalizeDomain(domain), qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	var records []string
+	var remaining int64
+	for rows.Next() {
+		var record string
+		if err := rows.Scan(&record, &remaining); err != nil {
+			return nil, 0, err
+		}
+		if remaining <= 0 {
+			return nil, 0, rows.Err()
+		}
+		records = append(records, record)
+	}
+	return records, uint32(remaining), rows.Err()
+}
+
+// Function to query the database for a domain that resolves to the given IP, the error is
+// ErrNotFound when none does and a *QueryError when the database failed
+func GetDomainForIP(db *sql.DB, ip string) (string, error) {
+	var domain string
+	err := db.QueryRow("SELECT domain FROM resolutions WHERE ip=? ORDER BY query_count DESC LIMIT 1", encodeIP(ip)).Scan(&domain)
+	if err != nil {
+		return "", queryError("reverse", ip, err)
+	}
+	return domain, nil
+}
+
+// Function to resolve a domain with the system resolver and store every address it returns,
+// returning the one that became the entry's IP
 func ResolveAndStore(db *sql.DB, domain string) (net.IP, error) {
 	resolvedIPs, err := net.LookupIP(domain)
 	if err != nil {
 		return nil, err
 	}
-
 	if len(resolvedIPs) == 0 {
-		return nil, fmt.Errorf("no IP addresses found for %s", domain)
+		return nil, fmt.Errorf("no addresses found for %s", domain)
 	}
+	resolvedIPs = orderByFamily(resolvedIPs)
+	if _, err := ExistsInDatabaseIncrementCount(db, domain, resolvedIPs, DefaultTTL); err != nil {
+		return nil, err
+	}
+	return resolvedIPs[0], nil
+}
 
-	// Choose the first resolved IP address
-	resolvedIP := resolvedIPs[0]
+// Function to order addresses so the PreferFamily family comes first, keeping the order
+// within each family
+func orderByFamily(ips []net.IP) []net.IP {
+	ordered := append([]net.IP(nil), ips...)
+	if PreferFamily == "" {
+		return ordered
+	}
+	rank := func(ip net.IP) int {
+		if (ip.To4() != nil) == (PreferFamily == "v4") {
+			return 0
+		}
+		return 1
+	}
+	sort.SliceStable(ordered, func(i, j int) bool { return rank(ordered[i]) < rank(ordered[j]) })
+	return ordered
+}
+
+// Function to add a resolution to the database, updating an existing entry and warning when
+// its IP changed (a CDN shift or a compromised upstream). A changed IP is stored or ignored
+// according to OnConflict, and a static entry is only ever replaced by another static one
+func AddToDatabase(db *sql.DB, r Resolution) error {
+	return addResolution(db, r, nil)
+}
+
+// Function to add a resolution like AddToDatabase. With the entry's full address set, r.IP first,
+// the entry only counts as changed when the set differs from the stored one, so an upstream
+// rotating the order of the same addresses keeps the stored IP
+func addResolution(db *sql.DB, r Resolution, addresses []string) error {
+	defer observe("add", time.Now())
+	display := displayDomain(r.Domain)
+	domain := NormalizeDomain(r.Domain)
+	ip := r.IP
+	var stored storedIP
+	var static bool
+	err := db.QueryRow("SELECT ip, static FROM resolutions WHERE domain=?", domain).Scan(&stored, &static)
+	oldIP := string(stored)
+	changed, from, to := oldIP != ip, oldIP, ip
+	if err == nil && oldIP != "" && addresses != nil {
+		previous, err := storedAddresses(db, Resolution{Domain: domain, IP: oldIP})
+		if err != nil {
+			return err
+		}
+		changed, from, to = !sameAddresses(previous, addresses), strings.Join(previous, ","), strings.Join(addresses, ",")
+		if !changed {
+			ip = oldIP
+		}
+	}
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = db.Exec("INSERT INTO resolutions(domain, ip, ttl, resolved_at, inserted_at, static) VALUES(?, ?, ?, ?, ?, ?)",
+			domain, encodeIP(ip), r.TTL, timestamp(), timestamp(), r.Static)
+	case err != nil:
+		return err
+	case static && !r.Static:
+		// Resolved answers never replace what the operator entered
+		_, err = db.Exec("UPDATE resolutions SET resolved_at=? WHERE domain=?", timestamp(), domain)
+	case oldIP == "":
+		// The entry only held an operator set upstream so far
+		_, err = db.Exec("UPDATE resolutions SET ip=?, ttl=?, resolved_at=?, inserted_at=COALESCE(inserted_at, ?), static=? WHERE domain=?",
+			encodeIP(ip), r.TTL, timestamp(), timestamp(), r.Static, domain)
+	case changed && OnConflict == ConflictKeep && !r.Static:
+		log.Printf("Warning: IP for %s changed from %s to %s, keeping %s\n", domain, from, to, oldIP)
+		_, err = db.Exec("UPDATE resolutions SET resolved_at=? WHERE domain=?", timestamp(), domain)
+	case changed:
+		log.Printf("Warning: IP for %s changed from %s to %s\n", domain, from, to)
+		metrics.Inc("dnstoy_record_changes_total")
+		_, err = db.Exec("UPDATE resolutions SET ip=?, ttl=?, changed_at=?, resolved_at=?, static=? WHERE domain=?",
+			encodeIP(ip), r.TTL, timestamp(), timestamp(), r.Static, domain)
+	default:
+		_, err = db.Exec("UPDATE resolutions SET ttl=?, resolved_at=?, static=? WHERE domain=?", r.TTL, timestamp(), r.Static, domain)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE resolutions SET query_count=query_count+1, wildcard=?, domain_display=COALESCE(domain_display, ?) WHERE domain=?",
+		IsWildcard(domain), display, domain)
+	return err
+}
+
+// Resolution is one row of the resolutions table, and what AddToDatabase stores
+type Resolution struct {
+	Domain     string
+	IP         string
+	QueryCount int
+	TTL        uint32
+	Country    string
+	InsertedAt time.Time // When the entry was first stored, zero for entries stored before it was recorded
+	ResolvedAt time.Time // Zero for entries that were never resolved
+	Wildcard   bool      // Set for *.parent entries answering every name below parent
+	Static     bool      // Set for entries the operator entered, which resolved answers don't replace
+	Addresses  []string  // Every address the entry answers with, filled in by GetWithExpiry
+}
+
+// Function to get the seconds left of the resolution's TTL, ttl - (now - resolved_at), stopping at 0.
+// Wildcard and static entries never expire, so they always have their whole TTL left
+func (r Resolution) Remaining() uint32 {
+	if r.Wildcard || r.Static {
+		return r.TTL
+	}
+	age := uint64(r.Age() / time.Second)
+	if age >= uint64(r.TTL) {
+		return 0
+	}
+	return r.TTL - uint32(age)
+}
 
-	// Store the resolved IP in the database
-	err = AddToDatabase(db, domain, resolvedIP.String())
-	db.Exec("UPDATE resolutions SET query_count=query_count+1 WHERE domain=?", domain)
+// Function to get how long ago the resolution was resolved, 0 when it never was
+func (r Resolution) Age() time.Duration {
+	if r.ResolvedAt.IsZero() {
+		return 0
+	}
+	return Clock.Now().Sub(r.ResolvedAt)
+}
+
+// resolutionColumns are the columns scanResolutions reads, after the domain column
+const resolutionColumns = "ip, query_count, ttl, COALESCE(country, ''), inserted_at, resolved_at, wildcard, static"
+
+// Function to build the address record answering for the resolution, an A or AAAA record
+// by the family of its IP, or nil when the IP doesn't parse
+func (r Resolution) ToRR() dns.RR {
+	ip := net.ParseIP(r.IP)
+	if ip == nil {
+		return nil
+	}
+	hdr := dns.RR_Header{Name: dns.Fqdn(r.Domain), Class: dns.ClassINET, Ttl: r.TTL}
+	if ip4 := ip.To4(); ip4 != nil {
+		hdr.Rrtype = dns.TypeA
+		return &dns.A{Hdr: hdr, A: ip4}
+	}
+	hdr.Rrtype = dns.TypeAAAA
+	return &dns.AAAA{Hdr: hdr, AAAA: ip}
+}
+
+// Function to list the resolutions, most queried first
+func ListResolutions(db *sql.DB) ([]Resolution, error) {
+	rows, err := db.Query("SELECT domain, " + resolutionColumns + " FROM resolutions ORDER BY query_count DESC")
 	if err != nil {
 		return nil, err
 	}
+	return scanResolutions(rows)
+}
 
-	return resolvedIP, nil
+// Function to find the resolutions whose domain contains substr, most queried first
+func Search(db *sql.DB, substr string) ([]Resolution, error) {
+	// Escape the LIKE wildcards so they match literally
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(substr))
+	rows, err := db.Query(`SELECT domain, `+resolutionColumns+` FROM resolutions
+		WHERE domain LIKE '%' || ? || '%' ESCAPE '\' ORDER BY query_count DESC`, escaped)
+	if err != nil {
+		return nil, err
+	}
+	return scanResolutions(rows)
 }
 
-// Function to add a domain and its resolution to the database
-func AddToDatabase(db *sql.DB, domain, ip string) error {
-	_, err := db.Exec("INSERT INTO resolutions(domain, ip) VALUES(?, ?)", domain, ip)
-	db.Exec("UPDATE resolutions SET query_count=query_count+1 WHERE domain=?", domain)
-	return err
+// Function to read resolution rows, closing them
+func scanResolutions(rows *sql.Rows) ([]Resolution, error) {
+	defer rows.Close()
+	var resolutions []Resolution
+	for rows.Next() {
+		r, err := scanResolution(rows)
+		if err != nil {
+			return nil, err
+		}
+		resolutions = append(resolutions, r)
+	}
+	return resolutions, rows.Err()
+}
+
+// Function to read the domain and resolutionColumns of one row, followed by any extra columns
+func scanResolution(row interface{ Scan(...interface{}) error }, extra ...interface{}) (Resolution, error) {
+	var r Resolution
+	var ip storedIP
+	var insertedAt, resolvedAt sql.NullTime
+	dest := append([]interface{}{&r.Domain, &ip, &r.QueryCount, &r.TTL, &r.Country, &insertedAt, &resolvedAt, &r.Wildcard, &r.Static}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return Resolution{}, err
+	}
+	r.IP, r.InsertedAt, r.ResolvedAt = string(ip), insertedAt.Time, resolvedAt.Time
+	return r, nil
+}
+
+// Function to print resolutions in the same table as DumpDatabase
+func PrintResolutions(resolutions []Resolution) {
+	fmt.Printf("%-40s%-30s%-15s%-10s\n", "DOMAIN", "IP", "QUERY COUNT", "COUNTRY")
+	fmt.Println("---------------------------------------------------------------------------------")
+	for _, r := range resolutions {
+		domain := r.Domain
+		if r.Wildcard {
+			domain += " (wildcard)"
+		}
+		if r.Static {
+			domain += " (static)"
+		}
+		fmt.Printf("%-40s%-30s%-15d%-10s\n", domain, r.IP, r.QueryCount, r.Country)
+	}
+}
+
+// Function to get the most queried domains that were resolved upstream, leaving out wildcard and
+// static entries, which are answered from what the operator entered
+func TopDomains(db *sql.DB, limit int) ([]string, error) {
+	rows, err := db.Query("SELECT domain FROM resolutions WHERE wildcard=0 AND static=0 AND ip != '' ORDER BY query_count DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var domains []string
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+	}
+	return domains, rows.Err()
+}
+
+// Function to halve every query count, so the counts follow recent popularity rather than
+// all-time totals, returning the number of rows changed
+func DecayCounts(db *sql.DB) (int64, error) {
+	var changed int64
+	for _, table := range []string{"resolutions", "queries"} {
+		result, err := db.Exec("UPDATE " + table + " SET query_count = query_count / 2 WHERE query_count > 0")
+		if err != nil {
+			return changed, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return changed, err
+		}
+		changed += n
+	}
+	return changed, nil
+}
+
+// Function to write the resolutions under origin as a zone file that BIND or NSD can load, with an SOA
+// and NS record for the origin and an A or AAAA record per domain carrying its upstream TTL
+func ExportZoneFile(db *sql.DB, origin string, w io.Writer) error {
+	origin = NormalizeDomain(origin)
+	resolutions, err := ListResolutions(db)
+	if err != nil {
+		return err
+	}
+	sort.Slice(resolutions, func(i, j int) bool { return resolutions[i].Domain < resolutions[j].Domain })
+
+	nameServer := "ns." + origin
+	if origin == "." {
+		nameServer = "ns.localhost."
+	}
+	soa := &dns.SOA{
+		Hdr:     dns.RR_Header{Name: origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:      nameServer,
+		Mbox:    "hostmaster." + strings.TrimPrefix(nameServer, "ns."),
+		Serial:  uint32(Clock.Now().Unix()),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  604800,
+		Minttl:  DefaultTTL,
+	}
+	ns := &dns.NS{Hdr: dns.RR_Header{Name: origin, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}, Ns: nameServer}
+	if _, err := fmt.Fprintf(w, "$ORIGIN %s\n$TTL %d\n%s\n%s\n", origin, DefaultTTL, soa, ns); err != nil {
+		return err
+	}
+
+	for _, r := range resolutions {
+		// Entries outside the origin can't be loaded into its zone
+		if r.IP == "" || !dns.IsSubDomain(origin, r.Domain) {
+			continue
+		}
+		rr := r.ToRR()
+		if rr == nil {
+			continue
+		}
+		if _, err := fmt.Fprintln(w, rr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Function to write the stored resolutions as CSV, a header row followed by the domain, ip,
+// query_count and ttl of each entry, most queried first
+func ExportCSV(db *sql.DB, w io.Writer) error {
+	rows, err := db.Query("SELECT " + displayColumn() + `, ip, query_count, ttl FROM resolutions
+		WHERE ip != '' ORDER BY query_count DESC, domain`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	out := csv.NewWriter(w)
+	if err := out.Write([]string{"domain", "ip", "query_count", "ttl"}); err != nil {
+		return err
+	}
+	for rows.Next() {
+		var domain string
+		var ip storedIP
+		var queryCount int64
+		var ttl uint32
+		if err := rows.Scan(&domain, &ip, &queryCount, &ttl); err != nil {
+			return err
+		}
+		if err := out.Write([]string{domain, string(ip), strconv.FormatInt(queryCount, 10), strconv.FormatUint(uint64(ttl), 10)}); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	out.Flush()
+	return out.Error()
 }
 
 // Function to dump the contents of the database
 func DumpDatabase(db *sql.DB) error {
-	rows, err := db.Query("SELECT domain, ip, query_count FROM resolutions")
+	rows, err := db.Query("SELECT " + displayColumn() + ", " + resolutionColumns + " FROM resolutions")
+	if err != nil {
+		return err
+	}
+	resolutions, err := scanResolutions(rows)
+	if err != nil {
+		return err
+	}
+	fmt.Println("\nDatabase contents:")
+	PrintResolutions(resolutions)
+	return nil
+}
+
+// Function to set the country a domain's stored IP is located in
+func SetCountry(db *sql.DB, domain, country string) error {
+	domain = NormalizeDomain(domain)
+	_, err := db.Exec("UPDATE resolutions SET country=? WHERE domain=?", country, domain)
+	return err
+}
+
+// Function to store every resolved address of a domain, counting the query once. The addresses are
+// ordered by PreferFamily and the first becomes the entry's IP through AddToDatabase, so new entries
+// start with a query count of 1. The full set is kept as the entry's A and AAAA records, replacing
+// the set stored before. It reports whether the domain had an entry already
+func ExistsInDatabaseIncrementCount(db *sql.DB, domain string, ips []net.IP, ttl uint32) (bool, error) {
+	defer observe("exists_increment", time.Now())
+	if len(ips) == 0 {
+		return false, fmt.Errorf("no addresses to store for %s", domain)
+	}
+	ips = orderByFamily(ips)
+	domain = NormalizeDomain(domain)
+	var exists bool
+	err := db.QueryRow("SELECT ip != '' FROM resolutions WHERE domain=?", domain).Scan(&exists)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addresses = append(addresses, ip.String())
+	}
+	if err := addResolution(db, Resolution{Domain: domain, IP: addresses[0], TTL: ttl}, addresses); err != nil {
+		return exists, err
+	}
+	return exists, setAddressRecords(db, domain, ips, ttl)
+}
+
+// Function to check if two address lists hold the same addresses, in any order
+func sameAddresses(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = append([]string(nil), a...), append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Function to store a domain's addresses as its A and AAAA records, a family without addresses
+// has its stored records removed
+func setAddressRecords(db *sql.DB, domain string, ips []net.IP, ttl uint32) error {
+	sets := map[string][]string{"A": nil, "AAAA": nil}
+	for _, ip := range ips {
+		rr := Resolution{Domain: domain, IP: ip.String(), TTL: ttl}.ToRR()
+		if rr == nil {
+			continue
+		}
+		qtype := dns.TypeToString[rr.Header().Rrtype]
+		sets[qtype] = append(sets[qtype], rr.String())
+	}
+	for _, qtype := range []string{"A", "AAAA"} {
+		if err := SetRecords(db, domain, qtype, sets[qtype], ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Function to read every address stored for an entry, its A and AAAA records in the order they were
+// stored with the PreferFamily family first. The records only stand for the entry while they include its IP, an operator entry or an IP
+// kept by OnConflict answers with that IP alone
+func storedAddresses(db *sql.DB, r Resolution) ([]string, error) {
+	rows, err := db.Query("SELECT data FROM records WHERE domain=? AND qtype IN ('A', 'AAAA') ORDER BY rowid", r.Domain)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ips []net.IP
+	current := false
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var ip net.IP
+		switch parsed, _ := dns.NewRR(data); rr := parsed.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		current = current || ip.Equal(net.ParseIP(r.IP))
+		ips = append(ips, ip)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !current {
+		return []string{r.IP}, nil
+	}
+	var addresses []string
+	for _, ip := range orderByFamily(ips) {
+		addresses = append(addresses, ip.String())
+	}
+	return addresses, nil
+}
+
+// Function to record a query for a domain and type, incrementing its count
+func RecordQuery(db *sql.DB, domain, qtype string) error {
+	domain = NormalizeDomain(domain)
+	_, err := db.Exec(`INSERT INTO queries(domain, qtype, query_count) VALUES(?, ?, 1)
+		ON CONFLICT(domain, qtype) DO UPDATE SET query_count=query_count+1`, domain, qtype)
+	return err
+}
+
+// Function to dump the recorded queries
+func DumpQueries(db *sql.DB) error {
+	rows, err := db.Query("SELECT domain, qtype, query_count FROM queries ORDER BY query_count DESC")
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 
 	// Print the table header
-	fmt.Println("\nDatabase contents:")
-	fmt.Printf("%-40s%-30s%-30s\n", "DOMAIN", "IP", "QUERY COUNT")
+	fmt.Println("\nRecorded queries:")
+	fmt.Printf("%-40s%-30s%-30s\n", "DOMAIN", "TYPE", "QUERY COUNT")
 	fmt.Println("---------------------------------------------------------------------------------")
 
 	// Iterate through database rows and print each row in the table
 	for rows.Next() {
-		var domain, ip string
+		var domain, qtype string
 		var queryCount int
-		if err := rows.Scan(&domain, &ip, &queryCount); err != nil {
+		if err := rows.Scan(&domain, &qtype, &queryCount); err != nil {
 			return err
 		}
-		fmt.Printf("%-40s%-30s%-30d\n", domain, ip, queryCount)
+		fmt.Printf("%-40s%-30s%-30d\n", domain, qtype, queryCount)
 	}
-	return nil
+	return rows.Err()
+}
+
+// TTLBucket is one bar of the stored TTL histogram
+type TTLBucket struct {
+	Label string
+	Count int
 }
 
-// Function to check if a domain exists in the database and increment its query count (with IP)
-func ExistsInDatabaseIncrementCount(db *sql.DB, domain string, ip net.IP) (bool, error) {
-	var count int
-	err := db.QueryRow("SELECT query_count FROM resolutions WHERE domain=?", domain).Scan(&count)
+// Function to count stored resolutions by TTL range
+func TTLHistogram(db *sql.DB) ([]TTLBucket, error) {
+	buckets := []TTLBucket{{Label: "<60s"}, {Label: "<300s"}, {Label: "<3600s"}, {Label: ">=3600s"}}
+	err := db.QueryRow(`SELECT
+		COALESCE(SUM(CASE WHEN ttl < 60 THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN ttl >= 60 AND ttl < 300 THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN ttl >= 300 AND ttl < 3600 THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN ttl >= 3600 THEN 1 ELSE 0 END), 0)
+		FROM resolutions`).Scan(&buckets[0].Count, &buckets[1].Count, &buckets[2].Count, &buckets[3].Count)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			// If domain doesn't exist, insert it with IP and a query count of 1
-			_, err := db.Exec("INSERT INTO resolutions(domain, ip, query_count) VALUES(?, ?, 0)", domain, ip.String())
-			if err != nil {
-				return false, err
-			}
-			return false, nil
-		}
-		return false, err
+		return nil, err
 	}
+	return buckets, nil
+}
 
-	// Increment the query count for the domain
-	_, err = db.Exec("UPDATE resolutions SET query_count=query_count+1 WHERE domain=?", domain)
+// Function to print summary statistics of the database
+func DumpStats(db *sql.DB) error {
+	var domains, queries int
+	err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(query_count), 0) FROM resolutions").Scan(&domains, &queries)
 	if err != nil {
-		return false, err
+		return err
+	}
+	buckets, err := TTLHistogram(db)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("\nDatabase statistics:")
+	fmt.Printf("%-40s%-30d\n", "Domains", domains)
+	fmt.Printf("%-40s%-30d\n", "Queries", queries)
+	fmt.Println("\nTTL distribution:")
+	for _, bucket := range buckets {
+		fmt.Printf("%-40s%-30d\n", bucket.Label, bucket.Count)
+	}
+
+	// Countries are only known when a GeoIP database is configured
+	rows, err := db.Query("SELECT country, COUNT(*) FROM resolutions WHERE country != '' GROUP BY country ORDER BY COUNT(*) DESC")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	header := false
+	for rows.Next() {
+		var country string
+		var count int
+		if err := rows.Scan(&country, &count); err != nil {
+			return err
+		}
+		if !header {
+			fmt.Println("\nCountries:")
+			header = true
+		}
+		fmt.Printf("%-40s%-30d\n", country, count)
 	}
-	return true, nil
+	return rows.Err()
 }
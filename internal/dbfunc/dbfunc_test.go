@@ -0,0 +1,743 @@
+package dbfunc
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chaoticcyber/dnsToy/internal/clock"
+	"github.com/chaoticcyber/dnsToy/internal/metrics"
+	"github.com/miekg/dns"
+)
+
+// Function to open an empty database in a temporary directory, with Clock set to a fake
+// clock the test can move
+func newTestDB(t testing.TB) (*sql.DB, *clock.Fake) {
+	t.Helper()
+	db, err := Open(filepath.Join(t.TempDir(), "dns.db"), 5000)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := CreateTables(db); err != nil {
+		t.Fatalf("CreateTables: %s", err)
+	}
+	fake := clock.NewFake(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	Clock = fake
+	t.Cleanup(func() { Clock = clock.Real{} })
+	return db, fake
+}
+
+func TestResolutionToRR(t *testing.T) {
+	for _, test := range []struct {
+		ip    string
+		rtype uint16
+	}{
+		{"192.0.2.1", dns.TypeA},
+		{"2001:db8::1", dns.TypeAAAA},
+		{"::ffff:192.0.2.1", dns.TypeA},
+	} {
+		rr := Resolution{Domain: "example.com", IP: test.ip, TTL: 300}.ToRR()
+		if rr == nil {
+			t.Errorf("ToRR(%s) = nil", test.ip)
+			continue
+		}
+		hdr := rr.Header()
+		if hdr.Rrtype != test.rtype || hdr.Name != "example.com." || hdr.Class != dns.ClassINET || hdr.Ttl != 300 {
+			t.Errorf("ToRR(%s) header = %s", test.ip, hdr)
+		}
+		// The record has to survive a round trip through the wire format
+		msg := new(dns.Msg)
+		msg.Answer = append(msg.Answer, rr)
+		packed, err := msg.Pack()
+		if err != nil {
+			t.Errorf("packing ToRR(%s): %s", test.ip, err)
+			continue
+		}
+		if err := msg.Unpack(packed); err != nil || !dns.IsDuplicate(msg.Answer[0], rr) {
+			t.Errorf("ToRR(%s) didn't survive packing: %v", test.ip, err)
+		}
+	}
+	if rr := (Resolution{Domain: "example.com", IP: "not-an-ip"}).ToRR(); rr != nil {
+		t.Errorf("ToRR of an unparseable IP = %s, want nil", rr)
+	}
+}
+
+func TestAddToDatabaseStoresResolution(t *testing.T) {
+	db, _ := newTestDB(t)
+	if err := AddToDatabase(db, Resolution{Domain: "Example.COM", IP: "192.0.2.1", TTL: 300}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	resolutions, err := ListResolutions(db)
+	if err != nil || len(resolutions) != 1 {
+		t.Fatalf("ListResolutions = %v, %v, want one entry", resolutions, err)
+	}
+	r := resolutions[0]
+	if r.Domain != "example.com." || r.IP != "192.0.2.1" || r.TTL != 300 || r.QueryCount != 1 || r.Static {
+		t.Errorf("stored %+v", r)
+	}
+	if want := Clock.Now(); !r.InsertedAt.Equal(want) || !r.ResolvedAt.Equal(want) {
+		t.Errorf("InsertedAt %s, ResolvedAt %s, want both %s", r.InsertedAt, r.ResolvedAt, want)
+	}
+}
+
+func TestStaticEntryNotReplacedByResolution(t *testing.T) {
+	db, fake := newTestDB(t)
+	if err := AddToDatabase(db, Resolution{Domain: "printer.lan", IP: "192.168.1.5", TTL: DefaultTTL, Static: true}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	fake.Advance(time.Hour)
+	if err := AddToDatabase(db, Resolution{Domain: "printer.lan", IP: "203.0.113.9", TTL: 30}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	r, expired, err := GetWithExpiry(db, "printer.lan", 60, 0)
+	if err != nil {
+		t.Fatalf("GetWithExpiry: %s", err)
+	}
+	if r.IP != "192.168.1.5" || !r.Static {
+		t.Errorf("static entry became %+v", r)
+	}
+	if expired {
+		t.Error("static entry expired")
+	}
+	if r.InsertedAt.Equal(r.ResolvedAt) {
+		t.Error("InsertedAt moved with the later resolution")
+	}
+}
+
+func TestWildcardEntries(t *testing.T) {
+	db, _ := newTestDB(t)
+	for _, r := range []Resolution{
+		{Domain: "*.test.local", IP: "10.0.0.9", Static: true},
+		{Domain: "*.b.test.local", IP: "10.0.0.8", Static: true},
+		{Domain: "exact.test.local", IP: "10.0.0.1", Static: true},
+	} {
+		if err := AddToDatabase(db, r); err != nil {
+			t.Fatalf("AddToDatabase(%s): %s", r.Domain, err)
+		}
+	}
+	for _, test := range []struct {
+		name, ip, entry string
+	}{
+		{"exact.test.local", "10.0.0.1", "exact.test.local."},
+		{"anything.test.local", "10.0.0.9", "*.test.local."},
+		{"a.deeply.nested.test.local", "10.0.0.9", "*.test.local."},
+		{"a.b.test.local", "10.0.0.8", "*.b.test.local."},
+	} {
+		r, _, err := GetWithExpiry(db, test.name, 0, 0)
+		if err != nil {
+			t.Errorf("GetWithExpiry(%s): %s", test.name, err)
+			continue
+		}
+		if r.IP != test.ip || r.Domain != test.entry {
+			t.Errorf("GetWithExpiry(%s) = %s from %s, want %s from %s", test.name, r.IP, r.Domain, test.ip, test.entry)
+		}
+	}
+	// The wildcard only covers names below its parent
+	for _, name := range []string{"test.local", "other.local"} {
+		if _, _, err := GetWithExpiry(db, name, 0, 0); err != ErrNotFound {
+			t.Errorf("GetWithExpiry(%s) error = %v, want ErrNotFound", name, err)
+		}
+	}
+}
+
+func TestGetFromDatabaseCountsAnsweringEntry(t *testing.T) {
+	db, _ := newTestDB(t)
+	if err := AddToDatabase(db, Resolution{Domain: "*.test.local", IP: "10.0.0.9", Static: true}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := GetFromDatabase(db, "host.test.local"); err != nil {
+			t.Fatalf("GetFromDatabase: %s", err)
+		}
+	}
+	r, _, err := GetWithExpiry(db, "host.test.local", 0, 0)
+	if err != nil {
+		t.Fatalf("GetWithExpiry: %s", err)
+	}
+	if r.QueryCount != 4 {
+		t.Errorf("wildcard entry counted %d queries, want 4 (one add and three lookups)", r.QueryCount)
+	}
+	if _, err := exactEntry(db, "host.test.local."); err != ErrNotFound {
+		t.Errorf("answering from the wildcard stored an entry for the name: %v", err)
+	}
+}
+
+func TestExistsInDatabaseIncrementCountStoresEveryAddress(t *testing.T) {
+	db, _ := newTestDB(t)
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("2001:db8::1")}
+	exists, err := ExistsInDatabaseIncrementCount(db, "multi.example", ips, 120)
+	if err != nil || exists {
+		t.Fatalf("first store = %v, %v, want a new entry", exists, err)
+	}
+	r, _, err := GetWithExpiry(db, "multi.example", 0, 0)
+	if err != nil {
+		t.Fatalf("GetWithExpiry: %s", err)
+	}
+	if r.QueryCount != 1 || r.IP != "192.0.2.1" || r.TTL != 120 {
+		t.Errorf("new entry %+v, want query count 1, the first IP and the upstream TTL", r)
+	}
+	if want := []string{"192.0.2.1", "192.0.2.2", "2001:db8::1"}; !slices.Equal(r.Addresses, want) {
+		t.Errorf("addresses %v, want %v", r.Addresses, want)
+	}
+
+	// A later resolution replaces the set and counts the query once more
+	exists, err = ExistsInDatabaseIncrementCount(db, "multi.example", ips[1:2], 120)
+	if err != nil || !exists {
+		t.Fatalf("second store = %v, %v, want an existing entry", exists, err)
+	}
+	r, _, _ = GetWithExpiry(db, "multi.example", 0, 0)
+	if r.QueryCount != 2 || !slices.Equal(r.Addresses, []string{"192.0.2.2"}) {
+		t.Errorf("after the second store %+v", r)
+	}
+
+	if _, err := ExistsInDatabaseIncrementCount(db, "none.example", nil, 120); err == nil {
+		t.Error("storing no addresses succeeded")
+	}
+}
+
+func TestStaticEntryIgnoresResolvedAddresses(t *testing.T) {
+	db, _ := newTestDB(t)
+	if err := AddToDatabase(db, Resolution{Domain: "nas.lan", IP: "192.168.1.2", Static: true}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	ips := []net.IP{net.ParseIP("203.0.113.1"), net.ParseIP("203.0.113.2")}
+	if _, err := ExistsInDatabaseIncrementCount(db, "nas.lan", ips, 60); err != nil {
+		t.Fatalf("ExistsInDatabaseIncrementCount: %s", err)
+	}
+	r, _, _ := GetWithExpiry(db, "nas.lan", 0, 0)
+	if !slices.Equal(r.Addresses, []string{"192.168.1.2"}) {
+		t.Errorf("static entry answers %v, want only the operator's address", r.Addresses)
+	}
+}
+
+func TestPreferFamilyPicksEntryIP(t *testing.T) {
+	db, _ := newTestDB(t)
+	PreferFamily = "v6"
+	t.Cleanup(func() { PreferFamily = "" })
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.2")}
+	if _, err := ExistsInDatabaseIncrementCount(db, "dual.example", ips, 60); err != nil {
+		t.Fatalf("ExistsInDatabaseIncrementCount: %s", err)
+	}
+	r, _, _ := GetWithExpiry(db, "dual.example", 0, 0)
+	if r.IP != "2001:db8::1" {
+		t.Errorf("entry IP %s, want the preferred family's address", r.IP)
+	}
+	if want := []string{"2001:db8::1", "192.0.2.1", "192.0.2.2"}; !slices.Equal(r.Addresses, want) {
+		t.Errorf("addresses %v, want %v", r.Addresses, want)
+	}
+}
+
+func TestGetFromDatabaseErrors(t *testing.T) {
+	db, _ := newTestDB(t)
+	if _, err := GetFromDatabase(db, "missing.example"); err != ErrNotFound {
+		t.Errorf("missing entry error = %v, want ErrNotFound", err)
+	}
+
+	// A database that can't be queried fails with a QueryError, not as a missing entry
+	db.Close()
+	_, err := GetFromDatabase(db, "missing.example")
+	var queryErr *QueryError
+	if !errors.As(err, &queryErr) || errors.Is(err, ErrNotFound) {
+		t.Errorf("closed database error = %v, want a QueryError", err)
+	}
+}
+
+func TestGetFromDatabaseOK(t *testing.T) {
+	db, _ := newTestDB(t)
+	if err := AddToDatabase(db, Resolution{Domain: "found.example", IP: "192.0.2.1", TTL: 300}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	if ip, ok := GetFromDatabaseOK(db, "found.example"); !ok || ip != "192.0.2.1" {
+		t.Errorf("GetFromDatabaseOK(found.example) = %q, %v", ip, ok)
+	}
+	if ip, ok := GetFromDatabaseOK(db, "missing.example"); ok || ip != "" {
+		t.Errorf("GetFromDatabaseOK(missing.example) = %q, %v, want not found", ip, ok)
+	}
+	// A failing database reads as not found too
+	db.Close()
+	if _, ok := GetFromDatabaseOK(db, "found.example"); ok {
+		t.Error("GetFromDatabaseOK on a closed database reported a hit")
+	}
+}
+
+func TestEntryExpiresWithFakeClock(t *testing.T) {
+	db, fake := newTestDB(t)
+	if err := AddToDatabase(db, Resolution{Domain: "expiring.example", IP: "192.0.2.1", TTL: 300}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	for _, step := range []struct {
+		advance time.Duration
+		expired bool
+	}{
+		{0, false},
+		{299 * time.Second, false},
+		{time.Second, true},
+	} {
+		fake.Advance(step.advance)
+		r, expired, err := GetWithExpiry(db, "expiring.example", 300, 0)
+		if err != nil {
+			t.Fatalf("GetWithExpiry: %s", err)
+		}
+		if expired != step.expired {
+			t.Errorf("at age %s expired = %v, want %v", r.Age(), expired, step.expired)
+		}
+	}
+	// Resolving it again starts the cache TTL over
+	if err := AddToDatabase(db, Resolution{Domain: "expiring.example", IP: "192.0.2.1", TTL: 300}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	if _, expired, _ := GetWithExpiry(db, "expiring.example", 300, 0); expired {
+		t.Error("entry still expired after it was resolved again")
+	}
+}
+
+func TestNormalizeDomain(t *testing.T) {
+	for _, test := range []struct {
+		domain, want string
+	}{
+		{"example.com", "example.com."},
+		{"Example.COM", "example.com."},
+		{"EXAMPLE.com.", "example.com."},
+		{"  example.com  ", "example.com."},
+		{"bücher.example", "xn--bcher-kva.example."},
+		{"BÜCHER.Example.", "xn--bcher-kva.example."},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example."},
+		{"*.Test.Local", "*.test.local."},
+		{"", "."},
+	} {
+		if got := NormalizeDomain(test.domain); got != test.want {
+			t.Errorf("NormalizeDomain(%q) = %q, want %q", test.domain, got, test.want)
+		}
+	}
+}
+
+func TestNameVariantsShareOneEntry(t *testing.T) {
+	db, _ := newTestDB(t)
+	variants := []string{"bücher.example", "BÜCHER.example.", "xn--bcher-kva.example", "XN--BCHER-KVA.EXAMPLE.", " Bücher.Example "}
+	for _, domain := range variants {
+		if err := AddToDatabase(db, Resolution{Domain: domain, IP: "192.0.2.1", TTL: 300}); err != nil {
+			t.Fatalf("AddToDatabase(%q): %s", domain, err)
+		}
+	}
+	resolutions, err := ListResolutions(db)
+	if err != nil {
+		t.Fatalf("ListResolutions: %s", err)
+	}
+	if len(resolutions) != 1 {
+		t.Fatalf("stored %d entries for the variants, want one: %+v", len(resolutions), resolutions)
+	}
+	if r := resolutions[0]; r.Domain != "xn--bcher-kva.example." || r.QueryCount != len(variants) {
+		t.Errorf("entry %s counted %d times, want xn--bcher-kva.example. counted %d times", r.Domain, r.QueryCount, len(variants))
+	}
+	for _, domain := range variants {
+		if ip, err := GetFromDatabase(db, domain); err != nil || ip != "192.0.2.1" {
+			t.Errorf("GetFromDatabase(%q) = %q, %v", domain, ip, err)
+		}
+	}
+}
+
+func TestOnConflict(t *testing.T) {
+	t.Cleanup(func() { OnConflict = ConflictUpdate })
+	for _, test := range []struct {
+		policy, want string
+	}{
+		{ConflictUpdate, "203.0.113.2"},
+		{ConflictKeep, "203.0.113.1"},
+	} {
+		db, _ := newTestDB(t)
+		OnConflict = test.policy
+		for _, ip := range []string{"203.0.113.1", "203.0.113.2"} {
+			if err := AddToDatabase(db, Resolution{Domain: "cdn.example", IP: ip, TTL: 60}); err != nil {
+				t.Fatalf("AddToDatabase: %s", err)
+			}
+		}
+		if ip, _ := GetFromDatabase(db, "cdn.example"); ip != test.want {
+			t.Errorf("with %s the entry holds %s, want %s", test.policy, ip, test.want)
+		}
+	}
+}
+
+func TestDisplaySpellingAlwaysStored(t *testing.T) {
+	t.Cleanup(func() { PreserveCase = false })
+	db, _ := newTestDB(t)
+	// Stored with the flag off, shown in its first spelling once the flag is turned on
+	for _, domain := range []string{"WWW.Example.COM", "www.example.com"} {
+		if err := AddToDatabase(db, Resolution{Domain: domain, IP: "192.0.2.1", TTL: 300}); err != nil {
+			t.Fatalf("AddToDatabase: %s", err)
+		}
+	}
+	var display string
+	if err := db.QueryRow("SELECT domain_display FROM resolutions WHERE domain='www.example.com.'").Scan(&display); err != nil {
+		t.Fatalf("reading domain_display: %s", err)
+	}
+	if display != "WWW.Example.COM." {
+		t.Errorf("domain_display = %q, want the raw first spelling", display)
+	}
+	for _, test := range []struct {
+		preserve bool
+		want     string
+	}{{false, "www.example.com."}, {true, "WWW.Example.COM."}} {
+		PreserveCase = test.preserve
+		var csv strings.Builder
+		if err := ExportCSV(db, &csv); err != nil {
+			t.Fatalf("ExportCSV: %s", err)
+		}
+		if !strings.Contains(csv.String(), "\n"+test.want+",") {
+			t.Errorf("with PreserveCase %v the export shows %q, want %s", test.preserve, csv.String(), test.want)
+		}
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	db, _ := newTestDB(t)
+	var mode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil || mode != "wal" {
+		t.Fatalf("journal_mode = %q (%v), want wal", mode, err)
+	}
+	// Writers on their own connections collide without the busy timeout and fail with "database is locked"
+	const writers, writes = 8, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*writers*writes)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				ip := net.IPv4(192, 0, 2, byte(w))
+				if _, err := ExistsInDatabaseIncrementCount(db, "shared.example.", []net.IP{net.IPv4(192, 0, 2, 1)}, 300); err != nil {
+					errs <- err
+				}
+				if _, err := ExistsInDatabaseIncrementCount(db, fmt.Sprintf("writer%d.example.", w), []net.IP{ip}, 300); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent write: %s", err)
+	}
+	resolutions, err := ListResolutions(db)
+	if err != nil {
+		t.Fatalf("ListResolutions: %s", err)
+	}
+	counts := make(map[string]int)
+	for _, r := range resolutions {
+		counts[r.Domain] = r.QueryCount
+	}
+	if counts["shared.example."] != writers*writes {
+		t.Errorf("shared.example. counted %d queries, want %d", counts["shared.example."], writers*writes)
+	}
+	for w := 0; w < writers; w++ {
+		if domain := fmt.Sprintf("writer%d.example.", w); counts[domain] != writes {
+			t.Errorf("%s counted %d queries, want %d", domain, counts[domain], writes)
+		}
+	}
+}
+
+func TestTTLHistogramBoundaries(t *testing.T) {
+	db, _ := newTestDB(t)
+	empty, err := TTLHistogram(db)
+	if err != nil {
+		t.Fatalf("TTLHistogram: %s", err)
+	}
+	for _, bucket := range empty {
+		if bucket.Count != 0 {
+			t.Errorf("empty database has %d entries in %s", bucket.Count, bucket.Label)
+		}
+	}
+
+	// Each boundary value falls in the bucket it starts
+	for i, ttl := range []uint32{0, 59, 60, 299, 300, 3599, 3600, 86400} {
+		r := Resolution{Domain: fmt.Sprintf("ttl%d.example.", i), IP: "192.0.2.1", TTL: ttl}
+		if err := AddToDatabase(db, r); err != nil {
+			t.Fatalf("AddToDatabase: %s", err)
+		}
+	}
+	buckets, err := TTLHistogram(db)
+	if err != nil {
+		t.Fatalf("TTLHistogram: %s", err)
+	}
+	want := []TTLBucket{{"<60s", 2}, {"<300s", 2}, {"<3600s", 2}, {">=3600s", 2}}
+	if !slices.Equal(buckets, want) {
+		t.Errorf("TTLHistogram = %v, want %v", buckets, want)
+	}
+}
+
+func TestAddressChangeTracking(t *testing.T) {
+	db, fake := newTestDB(t)
+	domain := "rotating.example."
+	store := func(last ...byte) {
+		t.Helper()
+		var ips []net.IP
+		for _, b := range last {
+			ips = append(ips, net.IPv4(192, 0, 2, b))
+		}
+		if _, err := ExistsInDatabaseIncrementCount(db, domain, ips, 300); err != nil {
+			t.Fatalf("ExistsInDatabaseIncrementCount: %s", err)
+		}
+	}
+	check := func(step, ip string, changedAt time.Time, changes float64) {
+		t.Helper()
+		var gotIP storedIP
+		var gotChangedAt sql.NullTime
+		if err := db.QueryRow("SELECT ip, changed_at FROM resolutions WHERE domain=?", domain).Scan(&gotIP, &gotChangedAt); err != nil {
+			t.Fatalf("%s: reading the entry: %s", step, err)
+		}
+		if string(gotIP) != ip || gotChangedAt.Valid != !changedAt.IsZero() || !gotChangedAt.Time.Equal(changedAt) {
+			t.Errorf("%s: entry has IP %s changed at %v, want %s changed at %v", step, gotIP, gotChangedAt.Time, ip, changedAt)
+		}
+		if got := metrics.Get("dnstoy_record_changes_total"); got != changes {
+			t.Errorf("%s: dnstoy_record_changes_total = %v, want %v", step, got, changes)
+		}
+	}
+	changes := metrics.Get("dnstoy_record_changes_total")
+
+	store(1, 2, 3)
+	check("first store", "192.0.2.1", time.Time{}, changes)
+
+	// The upstream rotating the same addresses isn't a change
+	fake.Advance(time.Minute)
+	store(2, 3, 1)
+	check("rotated set", "192.0.2.1", time.Time{}, changes)
+
+	// A new address in the set is a change, though the first one stayed the same
+	fake.Advance(time.Minute)
+	store(1, 2, 4)
+	check("changed set", "192.0.2.1", fake.Now(), changes+1)
+
+	// A single IP stored through AddToDatabase still compares on its own
+	fake.Advance(time.Minute)
+	if err := AddToDatabase(db, Resolution{Domain: domain, IP: "192.0.2.9", TTL: 300}); err != nil {
+		t.Fatalf("AddToDatabase: %s", err)
+	}
+	check("new IP", "192.0.2.9", fake.Now(), changes+2)
+}
+
+func TestDecayCountsHalves(t *testing.T) {
+	db, _ := newTestDB(t)
+	counts := map[string]int{"popular.example.": 9, "steady.example.": 4, "once.example.": 1}
+	for domain, count := range counts {
+		if _, err := db.Exec("INSERT INTO resolutions(domain, ip, ttl, query_count) VALUES(?, ?, 300, ?)", domain, encodeIP("192.0.2.1"), count); err != nil {
+			t.Fatalf("inserting %s: %s", domain, err)
+		}
+	}
+	if _, err := db.Exec("INSERT INTO queries(domain, qtype, query_count) VALUES('popular.example.', 'AAAA', 6), ('never.example.', 'A', 0)"); err != nil {
+		t.Fatalf("inserting queries: %s", err)
+	}
+
+	changed, err := DecayCounts(db)
+	if err != nil {
+		t.Fatalf("DecayCounts: %s", err)
+	}
+	// The row already at zero isn't touched
+	if changed != 4 {
+		t.Errorf("DecayCounts changed %d rows, want 4", changed)
+	}
+	want := map[string]int{"popular.example.": 4, "steady.example.": 2, "once.example.": 0}
+	for domain, count := range want {
+		var got int
+		if err := db.QueryRow("SELECT query_count FROM resolutions WHERE domain=?", domain).Scan(&got); err != nil {
+			t.Fatalf("reading %s: %s", domain, err)
+		}
+		if got != count {
+			t.Errorf("%s decayed to %d, want %d", domain, got, count)
+		}
+	}
+	var queries int
+	if err := db.QueryRow("SELECT query_count FROM queries WHERE domain='popular.example.' AND qtype='AAAA'").Scan(&queries); err != nil || queries != 3 {
+		t.Errorf("recorded AAAA queries decayed to %d (%v), want 3", queries, err)
+	}
+
+	// Repeated decay drives every count to zero and then changes nothing
+	for i := 0; i < 4; i++ {
+		if _, err := DecayCounts(db); err != nil {
+			t.Fatalf("DecayCounts: %s", err)
+		}
+	}
+	if changed, err := DecayCounts(db); err != nil || changed != 0 {
+		t.Errorf("DecayCounts on zero counts changed %d rows (%v), want 0", changed, err)
+	}
+}
+
+func TestAdaptiveCacheTTL(t *testing.T) {
+	for _, test := range []struct {
+		queryCount int64
+		want       uint32
+	}{
+		{0, 60},
+		{9, 60},
+		{10, 120},
+		{999, 180},
+		{1000, 240},
+		{1000000, 300},
+	} {
+		if got := AdaptiveCacheTTL(60, test.queryCount, 300); got != test.want {
+			t.Errorf("AdaptiveCacheTTL(60, %d, 300) = %d, want %d", test.queryCount, got, test.want)
+		}
+	}
+}
+
+func TestHotEntryKeptLonger(t *testing.T) {
+	db, fake := newTestDB(t)
+	for _, domain := range []string{"hot.example", "cold.example"} {
+		if err := AddToDatabase(db, Resolution{Domain: domain, IP: "192.0.2.1", TTL: 300}); err != nil {
+			t.Fatalf("AddToDatabase: %s", err)
+		}
+	}
+	if _, err := db.Exec("UPDATE resolutions SET query_count=1000 WHERE domain='hot.example.'"); err != nil {
+		t.Fatalf("UPDATE: %s", err)
+	}
+
+	// Past the base cache TTL only the popular entry is still fresh, until it reaches the cap
+	for _, step := range []struct {
+		advance time.Duration
+		hot     bool
+		cold    bool
+	}{
+		{61 * time.Second, false, true},
+		{178 * time.Second, false, true},
+		{time.Second, true, true},
+	} {
+		fake.Advance(step.advance)
+		for domain, want := range map[string]bool{"hot.example": step.hot, "cold.example": step.cold} {
+			r, expired, err := GetWithExpiry(db, domain, 60, 240)
+			if err != nil {
+				t.Fatalf("GetWithExpiry(%s): %s", domain, err)
+			}
+			if expired != want {
+				t.Errorf("%s with %d queries at age %s expired = %v, want %v", domain, r.QueryCount, r.Age(), expired, want)
+			}
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	db, _ := newTestDB(t)
+	for _, domain := range []string{"mail.example.com", "www.example.com", "example.org", "100%_sure.test", "1000_sure.test"} {
+		if err := AddToDatabase(db, Resolution{Domain: domain, IP: "192.0.2.1", TTL: 300}); err != nil {
+			t.Fatalf("AddToDatabase(%s): %s", domain, err)
+		}
+	}
+	if _, err := db.Exec("UPDATE resolutions SET query_count=CASE domain WHEN 'www.example.com.' THEN 5 WHEN 'mail.example.com.' THEN 2 ELSE 0 END"); err != nil {
+		t.Fatalf("UPDATE: %s", err)
+	}
+
+	for _, test := range []struct {
+		substr string
+		want   []string
+	}{
+		// Matches are ordered by query count, most queried first
+		{"example.com", []string{"www.example.com.", "mail.example.com."}},
+		{"EXAMPLE", []string{"www.example.com.", "mail.example.com.", "example.org."}},
+		// LIKE wildcards in the search match literally
+		{"%_", []string{"100%_sure.test."}},
+		{"0_s", []string{"1000_sure.test."}},
+		{"missing", nil},
+	} {
+		resolutions, err := Search(db, test.substr)
+		if err != nil {
+			t.Fatalf("Search(%q): %s", test.substr, err)
+		}
+		var got []string
+		for _, r := range resolutions {
+			got = append(got, r.Domain)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("Search(%q) = %v, want %v", test.substr, got, test.want)
+		}
+	}
+}
+
+// Function to get how many latencies of a database operation the metrics endpoint has counted
+func dbObservations(t *testing.T, op string) int {
+	t.Helper()
+	var text strings.Builder
+	if err := metrics.WriteText(&text); err != nil {
+		t.Fatalf("WriteText: %s", err)
+	}
+	for _, line := range strings.Split(text.String(), "\n") {
+		series, value, found := strings.Cut(line, " ")
+		if found && strings.HasPrefix(series, "dnstoy_db_duration_seconds_count{") && strings.Contains(series, `op="`+op+`"`) {
+			count, err := strconv.Atoi(value)
+			if err != nil {
+				t.Fatalf("count %q of %s: %s", value, series, err)
+			}
+			return count
+		}
+	}
+	return 0
+}
+
+func TestDBLatencyObserved(t *testing.T) {
+	db, _ := newTestDB(t)
+	for _, call := range []struct {
+		op  string
+		run func() error
+	}{
+		{"add", func() error {
+			return AddToDatabase(db, Resolution{Domain: "timed.example", IP: "192.0.2.1", TTL: 300})
+		}},
+		{"get", func() error {
+			_, err := GetFromDatabase(db, "timed.example")
+			return err
+		}},
+		{"exists_increment", func() error {
+			_, err := ExistsInDatabaseIncrementCount(db, "timed.example", []net.IP{net.ParseIP("192.0.2.1")}, 300)
+			return err
+		}},
+	} {
+		before := dbObservations(t, call.op)
+		if err := call.run(); err != nil {
+			t.Fatalf("%s: %s", call.op, err)
+		}
+		// Each call is timed once under its own op
+		if got := dbObservations(t, call.op) - before; got != 1 {
+			t.Errorf("op %s observed %d latencies, want 1", call.op, got)
+		}
+	}
+}
+
+func TestExportZoneFileParses(t *testing.T) {
+	db, fake := newTestDB(t)
+	for _, r := range []Resolution{
+		{Domain: "host.corp.example", IP: "10.0.0.5", TTL: 300},
+		{Domain: "v6.corp.example", IP: "2001:db8::5", TTL: 600},
+		{Domain: "outside.example", IP: "192.0.2.1", TTL: 300},
+	} {
+		if err := AddToDatabase(db, r); err != nil {
+			t.Fatalf("AddToDatabase(%s): %s", r.Domain, err)
+		}
+	}
+	var zone strings.Builder
+	if err := ExportZoneFile(db, "Corp.Example", &zone); err != nil {
+		t.Fatalf("ExportZoneFile: %s", err)
+	}
+
+	var got []string
+	parser := dns.NewZoneParser(strings.NewReader(zone.String()), "", "export.zone")
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		if soa, isSOA := rr.(*dns.SOA); isSOA && soa.Serial != uint32(fake.Now().Unix()) {
+			t.Errorf("SOA serial %d, want the export time %d", soa.Serial, fake.Now().Unix())
+		}
+		got = append(got, fmt.Sprintf("%s %d %s", rr.Header().Name, rr.Header().Ttl, dns.TypeToString[rr.Header().Rrtype]))
+	}
+	if err := parser.Err(); err != nil {
+		t.Fatalf("exported zone doesn't parse: %s\n%s", err, zone.String())
+	}
+	// Only names inside the origin are exported, after its SOA and NS
+	want := []string{"corp.example. 3600 SOA", "corp.example. 3600 NS", "host.corp.example. 300 A", "v6.corp.example. 600 AAAA"}
+	if !slices.Equal(got, want) {
+		t.Errorf("exported zone holds %v, want %v\n%s", got, want, zone.String())
+	}
+}
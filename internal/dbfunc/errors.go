@@ -0,0 +1,35 @@
+package dbfunc
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned when the database has no entry for the domain or IP looked up
+var ErrNotFound = errors.New("not found in database")
+
+// QueryError is a failure of the database itself, as opposed to a missing entry
+type QueryError struct {
+	Op  string // Lookup that failed, e.g. "get"
+	Key string // Domain or IP that was looked up
+	Err error  // Error returned by the database
+}
+
+// Function to describe the failed lookup
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("database %s %s: %s", e.Op, e.Key, e.Err)
+}
+
+// Function to get the database error, so errors.Is and errors.As see through the QueryError
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// Function to turn the error of a single row query into ErrNotFound or a QueryError
+func queryError(op, key string, err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return &QueryError{Op: op, Key: key, Err: err}
+}
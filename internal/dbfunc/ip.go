@@ -0,0 +1,90 @@
+package dbfunc
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+)
+
+// BinaryIPs stores IPs in their 4 or 16 byte form instead of as text, which keeps rows smaller.
+// CreateTables converts the stored entries to whichever form is set, so it can be switched either way
+var BinaryIPs = false
+
+// Function to convert an IP in text form to the value stored in the ip column. Empty and
+// unparseable values are always stored as text
+func encodeIP(ip string) interface{} {
+	if !BinaryIPs {
+		return ip
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if ip4 := parsed.To4(); ip4 != nil {
+		return []byte(ip4)
+	}
+	return []byte(parsed)
+}
+
+// storedIP reads the ip column in either form as the IP's text form
+type storedIP string
+
+// Function to scan the ip column, SQLite hands over text as a string and blobs as bytes
+func (s *storedIP) Scan(src interface{}) error {
+	switch value := src.(type) {
+	case nil:
+		*s = ""
+	case string:
+		*s = storedIP(value)
+	case []byte:
+		if len(value) != net.IPv4len && len(value) != net.IPv6len {
+			return fmt.Errorf("stored IP has %d bytes", len(value))
+		}
+		*s = storedIP(net.IP(value).String())
+	default:
+		return fmt.Errorf("unexpected stored IP type %T", src)
+	}
+	return nil
+}
+
+// Function to convert the stored IPs to the form BinaryIPs selects, leaving entries without
+// an IP as they are
+func convertStoredIPs(db *sql.DB) error {
+	from := "blob"
+	if BinaryIPs {
+		from = "text"
+	}
+	rows, err := db.Query("SELECT domain, ip FROM resolutions WHERE typeof(ip) = ? AND ip != ''", from)
+	if err != nil {
+		return err
+	}
+	stored := make(map[string]string)
+	for rows.Next() {
+		var domain string
+		var ip storedIP
+		if err := rows.Scan(&domain, &ip); err != nil {
+			rows.Close()
+			return err
+		}
+		stored[domain] = string(ip)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(stored) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for domain, ip := range stored {
+		if _, err := tx.Exec("UPDATE resolutions SET ip=? WHERE domain=?", encodeIP(ip), domain); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,127 @@
+package dbfunc
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+)
+
+// Function to set BinaryIPs for the test, restoring it afterwards
+func useBinaryIPs(t testing.TB, binary bool) {
+	t.Helper()
+	previous := BinaryIPs
+	BinaryIPs = binary
+	t.Cleanup(func() { BinaryIPs = previous })
+}
+
+// Function to read how a domain's ip column is stored, its SQLite type and size in bytes
+func storedForm(t testing.TB, db *sql.DB, domain string) (string, int) {
+	t.Helper()
+	var kind string
+	var size int
+	if err := db.QueryRow("SELECT typeof(ip), length(CAST(ip AS BLOB)) FROM resolutions WHERE domain=?", domain).Scan(&kind, &size); err != nil {
+		t.Fatalf("reading the ip of %s: %s", domain, err)
+	}
+	return kind, size
+}
+
+var roundTripIPs = []struct {
+	domain, ip string
+	size       int
+}{
+	{"v4.example.", "192.0.2.1", 4},
+	{"v6.example.", "2001:db8::1", 16},
+}
+
+// Function to check every round trip entry reads back as its address, and is stored as kind
+func checkRoundTrip(t *testing.T, db *sql.DB, kind string) {
+	t.Helper()
+	for _, test := range roundTripIPs {
+		if storedKind, size := storedForm(t, db, test.domain); storedKind != kind || (kind == "blob" && size != test.size) {
+			t.Errorf("%s stored as %s of %d bytes, want %s", test.domain, storedKind, size, kind)
+		}
+		if ip, err := exactEntry(db, test.domain); err != nil || ip != test.ip {
+			t.Errorf("%s read back as %q (%v), want %s", test.domain, ip, err, test.ip)
+		}
+		if domain, err := GetDomainForIP(db, test.ip); err != nil || domain != test.domain {
+			t.Errorf("GetDomainForIP(%s) = %q (%v), want %s", test.ip, domain, err, test.domain)
+		}
+	}
+}
+
+func TestBinaryIPsRoundTrip(t *testing.T) {
+	useBinaryIPs(t, true)
+	db, _ := newTestDB(t)
+	for _, test := range roundTripIPs {
+		if err := AddToDatabase(db, Resolution{Domain: test.domain, IP: test.ip, TTL: 300}); err != nil {
+			t.Fatalf("AddToDatabase(%s): %s", test.domain, err)
+		}
+	}
+	checkRoundTrip(t, db, "blob")
+
+	// An IPv4-mapped IPv6 address is stored in 4 bytes and reads back as IPv4
+	if err := AddToDatabase(db, Resolution{Domain: "mapped.example.", IP: "::ffff:192.0.2.2", TTL: 300}); err != nil {
+		t.Fatalf("AddToDatabase(mapped.example.): %s", err)
+	}
+	if kind, size := storedForm(t, db, "mapped.example."); kind != "blob" || size != 4 {
+		t.Errorf("mapped.example. stored as %s of %d bytes, want a 4 byte blob", kind, size)
+	}
+	if ip, err := exactEntry(db, "mapped.example."); err != nil || ip != "192.0.2.2" {
+		t.Errorf("mapped.example. read back as %q (%v), want 192.0.2.2", ip, err)
+	}
+}
+
+func TestConvertStoredIPs(t *testing.T) {
+	useBinaryIPs(t, false)
+	db, _ := newTestDB(t)
+	for _, test := range roundTripIPs {
+		if err := AddToDatabase(db, Resolution{Domain: test.domain, IP: test.ip, TTL: 300}); err != nil {
+			t.Fatalf("AddToDatabase(%s): %s", test.domain, err)
+		}
+	}
+	checkRoundTrip(t, db, "text")
+
+	// Switching the form converts the stored entries at startup, and switching back undoes it
+	BinaryIPs = true
+	if err := CreateTables(db); err != nil {
+		t.Fatalf("CreateTables converting to binary: %s", err)
+	}
+	checkRoundTrip(t, db, "blob")
+	BinaryIPs = false
+	if err := CreateTables(db); err != nil {
+		t.Fatalf("CreateTables converting to text: %s", err)
+	}
+	checkRoundTrip(t, db, "text")
+}
+
+// Function to report the bytes the ip column takes per row in each form, alongside the cost of
+// storing an address
+func BenchmarkStoredIPSize(b *testing.B) {
+	for _, binary := range []bool{false, true} {
+		name := "text"
+		if binary {
+			name = "binary"
+		}
+		b.Run(name, func(b *testing.B) {
+			useBinaryIPs(b, binary)
+			db, _ := newTestDB(b)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				domain := fmt.Sprintf("host%d.example.", i)
+				ip := fmt.Sprintf("2001:db8:85a3:8d3:1319:8a2e:370:%x", i&0xffff)
+				if i%2 == 0 {
+					ip = fmt.Sprintf("198.51.%d.%d", i>>8&0xff, i&0xff)
+				}
+				if err := AddToDatabase(db, Resolution{Domain: domain, IP: ip, TTL: 300}); err != nil {
+					b.Fatalf("AddToDatabase(%s): %s", domain, err)
+				}
+			}
+			b.StopTimer()
+			var size float64
+			if err := db.QueryRow("SELECT avg(length(CAST(ip AS BLOB))) FROM resolutions").Scan(&size); err != nil {
+				b.Fatalf("measuring the ip column: %s", err)
+			}
+			b.ReportMetric(size, "ip-bytes/row")
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package dbfunc
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// QueryLogEntry is one line of the query log, a JSON object per answered question
+type QueryLogEntry struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	Name   string    `json:"name"`
+	Qtype  string    `json:"qtype"`
+	Rcode  string    `json:"rcode"`
+}
+
+// Function to rebuild every query_count from a query log, e.g. after the counts were reset.
+// Each A question counts for the entry that answers it, its own or a covering wildcard, and
+// entries the log never mentions go back to 0. It returns the number of entries counted
+func RecountFromLog(db *sql.DB, r io.Reader) (int, error) {
+	counts := make(map[string]int64)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry QueryLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return 0, fmt.Errorf("line %d: %s", line, err)
+		}
+		if entry.Qtype == "A" && entry.Name != "" {
+			counts[NormalizeDomain(entry.Name)]++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	// Names are attributed before anything is written, so a failing lookup leaves the counts alone
+	entries := make(map[string]int64)
+	for name, count := range counts {
+		entry, _, err := answeringEntry(db, name)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		entries[entry] += count
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE resolutions SET query_count=0"); err != nil {
+		return 0, err
+	}
+	for entry, count := range entries {
+		if _, err := tx.Exec("UPDATE resolutions SET query_count=? WHERE domain=?", count, entry); err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), tx.Commit()
+}
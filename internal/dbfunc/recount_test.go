@@ -0,0 +1,70 @@
+package dbfunc
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+// Function to read the stored query_count of a normalized domain
+func queryCount(t *testing.T, db *sql.DB, domain string) int64 {
+	t.Helper()
+	var count int64
+	if err := db.QueryRow("SELECT query_count FROM resolutions WHERE domain=?", domain).Scan(&count); err != nil {
+		t.Fatalf("reading %s: %s", domain, err)
+	}
+	return count
+}
+
+func TestRecountFromLog(t *testing.T) {
+	db, _ := newTestDB(t)
+	for _, r := range []Resolution{
+		{Domain: "example.com", IP: "192.0.2.1", TTL: 300},
+		{Domain: "*.test.local", IP: "10.0.0.9", Static: true},
+		{Domain: "quiet.example", IP: "192.0.2.2", TTL: 300},
+	} {
+		if err := AddToDatabase(db, r); err != nil {
+			t.Fatalf("AddToDatabase(%s): %s", r.Domain, err)
+		}
+	}
+	if _, err := db.Exec("UPDATE resolutions SET query_count=50"); err != nil {
+		t.Fatalf("setting counts: %s", err)
+	}
+
+	queryLog := strings.Join([]string{
+		`{"time":"2026-10-16T12:00:00Z","client":"192.0.2.10","name":"example.com.","qtype":"A","rcode":"NOERROR"}`,
+		`{"time":"2026-10-16T12:00:01Z","client":"192.0.2.10","name":"Example.COM","qtype":"A","rcode":"NOERROR"}`,
+		`{"time":"2026-10-16T12:00:02Z","client":"192.0.2.10","name":"example.com.","qtype":"AAAA","rcode":"NOERROR"}`,
+		``,
+		`{"time":"2026-10-16T12:00:03Z","client":"192.0.2.11","name":"a.test.local.","qtype":"A","rcode":"NOERROR"}`,
+		`{"time":"2026-10-16T12:00:04Z","client":"192.0.2.11","name":"b.test.local.","qtype":"A","rcode":"NOERROR"}`,
+		`{"time":"2026-10-16T12:00:05Z","client":"192.0.2.11","name":"a.test.local.","qtype":"A","rcode":"NOERROR"}`,
+		`{"time":"2026-10-16T12:00:06Z","client":"192.0.2.12","name":"unknown.example.","qtype":"A","rcode":"NXDOMAIN"}`,
+	}, "\n")
+	counted, err := RecountFromLog(db, strings.NewReader(queryLog))
+	if err != nil {
+		t.Fatalf("RecountFromLog: %s", err)
+	}
+	if counted != 2 {
+		t.Errorf("RecountFromLog counted %d entries, want 2", counted)
+	}
+	// Only A questions count, spellings of a name share its entry, the names a wildcard answers
+	// count for the wildcard, and an entry the log never mentions goes back to 0
+	want := map[string]int64{"example.com.": 2, "*.test.local.": 3, "quiet.example.": 0}
+	for domain, count := range want {
+		if got := queryCount(t, db, domain); got != count {
+			t.Errorf("%s recounted to %d, want %d", domain, got, count)
+		}
+	}
+	if _, err := exactEntry(db, "unknown.example."); err != ErrNotFound {
+		t.Errorf("recounting a name without an entry stored one: %v", err)
+	}
+
+	// A log that can't be parsed leaves the counts alone
+	if _, err := RecountFromLog(db, strings.NewReader(`{"name":"quiet.example.","qtype":"A"}`+"\nnot json\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("RecountFromLog of a broken log error = %v, want one naming line 2", err)
+	}
+	if got := queryCount(t, db, "quiet.example."); got != 0 {
+		t.Errorf("a broken log changed quiet.example. to %d", got)
+	}
+}
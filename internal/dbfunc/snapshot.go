@@ -0,0 +1,71 @@
+package dbfunc
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Function to save the cache snapshot, the resolved entries still within their TTL at shutdown
+// along with when each one expires, replacing the previous snapshot. Static and wildcard entries
+// never expire, so they are left out. It returns the number of entries saved
+func SaveSnapshot(db *sql.DB) (int, error) {
+	resolutions, err := ListResolutions(db)
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM cache_snapshot"); err != nil {
+		return 0, err
+	}
+	now := Clock.Now()
+	saved := 0
+	for _, r := range resolutions {
+		if r.Static || r.Wildcard || r.IP == "" || r.ResolvedAt.IsZero() {
+			continue
+		}
+		remaining := r.Remaining()
+		if remaining == 0 {
+			continue
+		}
+		expiresAt := now.Add(time.Duration(remaining) * time.Second).UTC().Format("2006-01-02 15:04:05")
+		if _, err := tx.Exec("INSERT INTO cache_snapshot(domain, expires_at) VALUES(?, ?)", r.Domain, expiresAt); err != nil {
+			return 0, err
+		}
+		saved++
+	}
+	return saved, tx.Commit()
+}
+
+// Function to load the snapshot saved by SaveSnapshot and clear it, so it is restored only once.
+// The domains are split into those still fresh, which can be answered from the database as they
+// are, and those whose TTL ran out while the server was stopped, which need resolving again
+func LoadSnapshot(db *sql.DB) (fresh, expired []string, err error) {
+	rows, err := db.Query("SELECT domain, expires_at FROM cache_snapshot ORDER BY expires_at")
+	if err != nil {
+		return nil, nil, err
+	}
+	now := Clock.Now()
+	for rows.Next() {
+		var domain string
+		var expiresAt time.Time
+		if err := rows.Scan(&domain, &expiresAt); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		if expiresAt.After(now) {
+			fresh = append(fresh, domain)
+		} else {
+			expired = append(expired, domain)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	_, err = db.Exec("DELETE FROM cache_snapshot")
+	return fresh, expired, err
+}
@@ -0,0 +1,57 @@
+package dbfunc
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSnapshotSurvivesRestart(t *testing.T) {
+	_, fake := newTestDB(t)
+	path := filepath.Join(t.TempDir(), "dns.db")
+	db, err := Open(path, 5000)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	if err := CreateTables(db); err != nil {
+		t.Fatalf("CreateTables: %s", err)
+	}
+	for _, r := range []Resolution{
+		{Domain: "short.example", IP: "192.0.2.1", TTL: 60},
+		{Domain: "long.example", IP: "192.0.2.2", TTL: 3600},
+		{Domain: "stale.example", IP: "192.0.2.3", TTL: 10},
+		{Domain: "nas.lan", IP: "192.168.1.2", Static: true},
+	} {
+		if err := AddToDatabase(db, r); err != nil {
+			t.Fatalf("AddToDatabase(%s): %s", r.Domain, err)
+		}
+	}
+	fake.Advance(30 * time.Second)
+	// stale.example is past its TTL at shutdown and nas.lan never expires, neither is saved
+	if saved, err := SaveSnapshot(db); err != nil || saved != 2 {
+		t.Fatalf("SaveSnapshot = %d, %v, want 2 entries", saved, err)
+	}
+	db.Close()
+
+	// The server is down for ten minutes, longer than short.example had left
+	fake.Advance(10 * time.Minute)
+	db, err = Open(path, 5000)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer db.Close()
+	if err := CreateTables(db); err != nil {
+		t.Fatalf("CreateTables: %s", err)
+	}
+	fresh, expired, err := LoadSnapshot(db)
+	if err != nil {
+		t.Fatalf("LoadSnapshot: %s", err)
+	}
+	if !slices.Equal(fresh, []string{"long.example."}) || !slices.Equal(expired, []string{"short.example."}) {
+		t.Errorf("LoadSnapshot = fresh %v, expired %v, want long.example. fresh and short.example. expired", fresh, expired)
+	}
+	if fresh, expired, err := LoadSnapshot(db); err != nil || len(fresh)+len(expired) != 0 {
+		t.Errorf("second LoadSnapshot = %v, %v, %v, want the snapshot cleared", fresh, expired, err)
+	}
+}
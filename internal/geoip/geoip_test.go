@@ -0,0 +1,49 @@
+package geoip
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// testdata/country.mmdb is a small IPv6 database with 24-bit records mapping 192.0.2.0/24 to DE,
+// 2001:db8::/32 to NL and 198.51.100.0/24 to US, the last record's key stored as a pointer
+func TestCountryFromFixture(t *testing.T) {
+	reader, err := Open("testdata/country.mmdb")
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	for _, test := range []struct {
+		ip, want string
+	}{
+		{"192.0.2.1", "DE"},
+		{"192.0.2.255", "DE"},
+		{"2001:db8:1::1", "NL"},
+		{"198.51.100.7", "US"},
+		{"192.0.3.1", ""},
+		{"203.0.113.1", ""},
+		{"2001:db9::1", ""},
+	} {
+		got, err := reader.Country(net.ParseIP(test.ip))
+		if err != nil {
+			t.Errorf("Country(%s): %s", test.ip, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Country(%s) = %q, want %q", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestNilReaderCountry(t *testing.T) {
+	var reader *Reader
+	if code, err := reader.Country(net.ParseIP("192.0.2.1")); code != "" || err != nil {
+		t.Errorf("nil reader Country = %q, %v", code, err)
+	}
+}
+
+func TestInvalidDatabase(t *testing.T) {
+	if _, err := New([]byte("not a maxmind database")); !errors.Is(err, ErrInvalidDatabase) {
+		t.Errorf("New on garbage = %v, want ErrInvalidDatabase", err)
+	}
+}
@@ -0,0 +1,200 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Kinds of metric, used for the TYPE line of the text format
+const (
+	KindCounter   = "counter"
+	KindGauge     = "gauge"
+	KindHistogram = "histogram"
+)
+
+// LatencyBuckets are the histogram bucket upper bounds, in seconds, used by Observe
+var LatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// sample is one labelled series of a metric
+type sample struct {
+	labels  []string // Alternating label names and values
+	value   float64  // Current value, or the sum of observations for histograms
+	count   uint64   // Number of observations for histograms
+	buckets []uint64 // Observations at or below each of LatencyBuckets for histograms
+}
+
+var (
+	mutex  sync.Mutex
+	kinds  = make(map[string]string)             // Metric name to its kind
+	values = make(map[string]map[string]*sample) // Metric name to label set key to sample
+
+	constLabels []string // Name, value pairs added to every series when written out
+)
+
+// Function to build the label set key from alternating name and value pairs
+func labelKey(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func series(name, kind string, labels []string) *sample {
+	if _, found := values[name]; !found {
+		values[name] = make(map[string]*sample)
+		kinds[name] = kind
+	}
+	key := labelKey(labels)
+	s, found := values[name][key]
+	if !found {
+		s = &sample{labels: append([]string(nil), labels...)}
+		values[name][key] = s
+	}
+	return s
+}
+
+// Function to set labels, as name, value pairs, that are added to every series when written out
+func SetConstLabels(labels ...string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	constLabels = append([]string(nil), labels...)
+}
+
+// Function to get the labels of a series written out, with the constant labels in front
+func writtenLabels(s *sample, extra ...string) []string {
+	labels := append(append([]string(nil), constLabels...), s.labels...)
+	return append(labels, extra...)
+}
+
+// Function to add delta to a counter, labels are given as name, value pairs
+func Add(name string, delta float64, labels ...string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	series(name, KindCounter, labels).value += delta
+}
+
+// Function to increment a counter by one
+func Inc(name string, labels ...string) {
+	Add(name, 1, labels...)
+}
+
+// Function to set a gauge to value
+func Set(name string, value float64, labels ...string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	series(name, KindGauge, labels).value = value
+}
+
+// Function to record an observation, e.g. a latency in seconds, in a histogram
+func Observe(name string, value float64, labels ...string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	s := series(name, KindHistogram, labels)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(LatencyBuckets))
+	}
+	s.value += value
+	s.count++
+	for i, bound := range LatencyBuckets {
+		if value <= bound {
+			s.buckets[i]++
+		}
+	}
+}
+
+// Function to get the current value of a metric
+func Get(name string, labels ...string) float64 {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if s, found := values[name][labelKey(labels)]; found {
+		return s.value
+	}
+	return 0
+}
+
+// Function to sum a metric across all series, grouped by the value of one label
+func ByLabel(name, label string) map[string]float64 {
+	mutex.Lock()
+	defer mutex.Unlock()
+	totals := make(map[string]float64)
+	for _, s := range values[name] {
+		for i := 0; i+1 < len(s.labels); i += 2 {
+			if s.labels[i] == label {
+				totals[s.labels[i+1]] += s.value
+			}
+		}
+	}
+	return totals
+}
+
+// Function to sum a metric across all of its series
+func Total(name string) float64 {
+	mutex.Lock()
+	defer mutex.Unlock()
+	total := 0.0
+	for _, s := range values[name] {
+		total += s.value
+	}
+	return total
+}
+
+// Function to write every metric in the Prometheus text exposition format
+func WriteText(w io.Writer) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "# TYPE %s %s\n", name, kinds[name]); err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(values[name]))
+		for key := range values[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := values[name][key]
+			if kinds[name] == KindHistogram {
+				if err := writeHistogram(w, name, s); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "%s%s %v\n", name, labelKey(writtenLabels(s)), s.value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Function to write the cumulative buckets, sum and count series of a histogram
+func writeHistogram(w io.Writer, name string, s *sample) error {
+	for i, bound := range LatencyBuckets {
+		key := labelKey(writtenLabels(s, "le", fmt.Sprint(bound)))
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", name, key, s.buckets[i]); err != nil {
+			return err
+		}
+	}
+	key := labelKey(writtenLabels(s, "le", "+Inf"))
+	if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", name, key, s.count); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s_sum%s %v\n", name, labelKey(writtenLabels(s)), s.value); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s_count%s %d\n", name, labelKey(writtenLabels(s)), s.count)
+	return err
+}
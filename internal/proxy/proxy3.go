@@ -17,6 +17,9 @@ import (
 
 var enableDNSLookup = true // Default is set to enable DNS lookup
 
+// lookupIP resolves a name to its addresses, replaced in tests
+var lookupIP = net.LookupIP
+
 func main() {
 	// Open SQLite database for DNS resolutions
 	database, err := sql.Open("sqlite3", "dns.db")
@@ -52,16 +55,17 @@ func main() {
 					continue
 				}
 				// Perform the DNS resolution to get the IP address
-				ips, err := net.LookupIP(question.Name)
+				ips, err := lookupIP(question.Name)
 				if err != nil {
 					log.Printf("Error resolving %s: %s\n", question.Name, err)
 					continue
 				}
 
-				// Take the first resolved IP address
-				var resolvedIP net.IP
-				if len(ips) > 0 {
-					resolvedIP = ips[0]
+				// Take the first resolved IP address of the family the query asked for
+				resolvedIP := firstOfFamily(ips, question.Qtype)
+				if resolvedIP == nil {
+					log.Printf("No %s address found for %s\n", familyName(question.Qtype), question.Name)
+					continue
 				}
 
 				// Perform database update with the client's IP address
@@ -163,18 +167,17 @@ func getFromDatabase(db *sql.DB, domain string) (string, bool) {
 
 // Function to perform DNS resolution and store in the database
 func resolveAndStore(db *sql.DB, domain string) (net.IP, error) {
-	resolvedIPs, err := net.LookupIP(domain)
+	resolvedIPs, err := lookupIP(domain)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(resolvedIPs) == 0 {
-		return nil, fmt.Errorf("no IP addresses found for %s", domain)
+	// Choose the first resolved IPv4 address, the record built from it is an A record
+	resolvedIP := firstOfFamily(resolvedIPs, dns.TypeA)
+	if resolvedIP == nil {
+		return nil, fmt.Errorf("no IPv4 addresses found for %s", domain)
 	}
 
-	// Choose the first resolved IP address
-	resolvedIP := resolvedIPs[0]
-
 	// Store the resolved IP in the database
 	err = addToDatabase(db, domain, resolvedIP.String())
 	if err != nil {
@@ -184,6 +187,26 @@ func resolveAndStore(db *sql.DB, domain string) (net.IP, error) {
 	return resolvedIP, nil
 }
 
+// Function to pick the first address of the family a query type asks for, IPv4 for A and
+// IPv6 for AAAA, or nil when there is none
+func firstOfFamily(ips []net.IP, qtype uint16) net.IP {
+	for _, ip := range ips {
+		isV4 := ip.To4() != nil
+		if (qtype == dns.TypeA && isV4) || (qtype == dns.TypeAAAA && !isV4) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// Function to name the address family a query type asks for, for log messages
+func familyName(qtype uint16) string {
+	if qtype == dns.TypeAAAA {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
 // Function to add a domain and its resolution to the database
 func addToDatabase(db *sql.DB, domain, ip string) error {
 	_, err := db.Exec("INSERT INTO resolutions(domain, ip) VALUES(?, ?)", domain, ip)
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"database/sql"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestFirstOfFamilyMixedLookup(t *testing.T) {
+	ips := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::2")}
+	if ip := firstOfFamily(ips, dns.TypeA); !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("A query picked %s, want 192.0.2.1", ip)
+	}
+	if ip := firstOfFamily(ips, dns.TypeAAAA); !ip.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("AAAA query picked %s, want 2001:db8::1", ip)
+	}
+	if ip := firstOfFamily(ips[:1], dns.TypeA); ip != nil {
+		t.Errorf("A query without IPv4 addresses picked %s, want nil", ip)
+	}
+}
+
+func TestFamilyName(t *testing.T) {
+	if got := familyName(dns.TypeA); got != "IPv4" {
+		t.Errorf("familyName(A) = %s, want IPv4", got)
+	}
+	if got := familyName(dns.TypeAAAA); got != "IPv6" {
+		t.Errorf("familyName(AAAA) = %s, want IPv6", got)
+	}
+}
+
+func TestResolveAndStoreKeepsIPv4OfMixedLookup(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "dns.db"))
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE resolutions (domain TEXT PRIMARY KEY, ip TEXT, query_count INTEGER DEFAULT 0)`); err != nil {
+		t.Fatalf("CREATE TABLE: %s", err)
+	}
+	// The resolver lists the IPv6 address first, as it does on dual-stack hosts
+	lookupIP = func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}, nil
+	}
+	t.Cleanup(func() { lookupIP = net.LookupIP })
+
+	ip, err := resolveAndStore(db, "mixed.example.")
+	if err != nil {
+		t.Fatalf("resolveAndStore: %s", err)
+	}
+	if !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("resolveAndStore returned %s, want 192.0.2.1", ip)
+	}
+	stored, found := getFromDatabase(db, "mixed.example.")
+	if !found || stored != "192.0.2.1" {
+		t.Errorf("stored %q (found %v), want the IPv4 address 192.0.2.1", stored, found)
+	}
+}
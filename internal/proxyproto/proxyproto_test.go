@@ -0,0 +1,128 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadHeaderV1(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.0.2.7 198.51.100.1 40000 53\r\npayload"))
+	addr, err := ReadHeader(r)
+	if err != nil {
+		t.Fatalf("ReadHeader: %s", err)
+	}
+	if got := addr.(*net.TCPAddr); !got.IP.Equal(net.ParseIP("192.0.2.7")) || got.Port != 40000 {
+		t.Errorf("got %s, want 192.0.2.7:40000", got)
+	}
+	rest, _ := io.ReadAll(r)
+	if string(rest) != "payload" {
+		t.Errorf("payload after header = %q, want %q", rest, "payload")
+	}
+}
+
+func TestReadHeaderV1Unknown(t *testing.T) {
+	addr, err := ReadHeader(bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n")))
+	if err != nil || addr != nil {
+		t.Errorf("got %v, %v, want no address and no error", addr, err)
+	}
+}
+
+func TestReadHeaderV1Invalid(t *testing.T) {
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 not-an-ip 198.51.100.1 40000 53\r\n",
+		"PROXY TCP4 192.0.2.7 198.51.100.1 70000 53\r\n",
+		"PROXY " + strings.Repeat("x", 120) + "\r\n",
+	} {
+		if _, err := ReadHeader(bufio.NewReader(strings.NewReader(header))); err == nil {
+			t.Errorf("ReadHeader(%q) succeeded, want an error", header)
+		}
+	}
+}
+
+// Function to build a v2 PROXY header with the given command, family and body
+func v2Header(command, family byte, body []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(body)))
+	return append(header, body...)
+}
+
+func TestReadHeaderV2(t *testing.T) {
+	body := make([]byte, 36)
+	copy(body[0:16], net.ParseIP("2001:db8::7"))
+	copy(body[16:32], net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(body[32:34], 40000)
+	binary.BigEndian.PutUint16(body[34:36], 53)
+	addr, err := ReadHeader(bufio.NewReader(bytes.NewReader(v2Header(1, 0x21, body))))
+	if err != nil {
+		t.Fatalf("ReadHeader: %s", err)
+	}
+	if got := addr.(*net.TCPAddr); !got.IP.Equal(net.ParseIP("2001:db8::7")) || got.Port != 40000 {
+		t.Errorf("got %s, want [2001:db8::7]:40000", got)
+	}
+
+	// LOCAL commands carry no client address
+	addr, err = ReadHeader(bufio.NewReader(bytes.NewReader(v2Header(0, 0, nil))))
+	if err != nil || addr != nil {
+		t.Errorf("LOCAL header: got %v, %v, want no address and no error", addr, err)
+	}
+}
+
+// Function to connect to a listener wrapped with the trusted networks, send data
+// and return the accepted connection's remote address and payload
+func acceptWith(t *testing.T, trusted string, data string) (net.Addr, string) {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	_, network, _ := net.ParseCIDR(trusted)
+	listener := NewListener(inner, []*net.IPNet{network})
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %s", err)
+	}
+	if _, err := client.Write([]byte(data)); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	client.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %s", err)
+	}
+	defer conn.Close()
+	addr := conn.RemoteAddr()
+	payload, _ := io.ReadAll(conn)
+	return addr, string(payload)
+}
+
+func TestListenerTrustedPeer(t *testing.T) {
+	addr, payload := acceptWith(t, "127.0.0.0/8", "PROXY TCP4 192.0.2.7 198.51.100.1 40000 53\r\nquery")
+	if ip := addr.(*net.TCPAddr).IP; !ip.Equal(net.ParseIP("192.0.2.7")) {
+		t.Errorf("RemoteAddr = %s, want the address from the header", addr)
+	}
+	if payload != "query" {
+		t.Errorf("payload = %q, want %q", payload, "query")
+	}
+}
+
+func TestListenerUntrustedPeer(t *testing.T) {
+	data := "PROXY TCP4 127.0.0.1 198.51.100.1 40000 53\r\nquery"
+	addr, payload := acceptWith(t, "192.0.2.0/24", data)
+	if ip := addr.(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Errorf("RemoteAddr = %s, want the real peer address", addr)
+	}
+	// The header isn't parsed, so it reaches the DNS server as payload and fails there
+	if payload != data {
+		t.Errorf("payload = %q, want the untouched stream", payload)
+	}
+}
@@ -0,0 +1,187 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client is a minimal Redis client speaking RESP over one connection, redialed after errors
+type Client struct {
+	addr    string
+	timeout time.Duration
+
+	mutex  sync.Mutex // Serializes commands on the connection
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Error is an error reply from the Redis server
+type Error string
+
+func (e Error) Error() string { return "redis: " + string(e) }
+
+// errNil is returned internally for nil bulk replies
+var errNil = errors.New("redis: nil")
+
+// Function to create a client for the server at addr, dialing it lazily
+func New(addr string, timeout time.Duration) *Client {
+	return &Client{addr: addr, timeout: timeout}
+}
+
+// Function to send a command and read its reply
+func (c *Client) Do(args ...string) (interface{}, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+		if err != nil {
+			return nil, err
+		}
+		c.conn, c.reader = conn, bufio.NewReader(conn)
+	}
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		c.reset()
+		return nil, err
+	}
+	reply, err := readReply(c.reader)
+	if err != nil && err != errNil {
+		if _, isReply := err.(Error); !isReply {
+			// The connection is in an unknown state
+			c.reset()
+		}
+	}
+	return reply, err
+}
+
+func (c *Client) reset() {
+	c.conn.Close()
+	c.conn, c.reader = nil, nil
+}
+
+// Function to close the connection
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn, c.reader = nil, nil
+	return err
+}
+
+// Function to read one RESP reply
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, errNil
+		}
+		buf := make([]byte, size+2)
+		if _, err := readFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, errNil
+		}
+		items := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			item, err := readReply(r)
+			if err != nil && err != errNil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+func readFull(r *bufio.Reader, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := r.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Function to get a string value, found is false when the key doesn't exist
+func (c *Client) Get(key string) (string, bool, error) {
+	reply, err := c.Do("GET", key)
+	if err == errNil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return "", false, fmt.Errorf("redis: unexpected GET reply %v", reply)
+	}
+	return value, true, nil
+}
+
+// Function to set a value that expires after ttl
+func (c *Client) SetEX(key, value string, ttl time.Duration) error {
+	seconds := int64(ttl / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	_, err := c.Do("SET", key, value, "EX", strconv.FormatInt(seconds, 10))
+	return err
+}
+
+// Function to get the remaining time to live of a key, negative when it has none or doesn't exist
+func (c *Client) TTL(key string) (time.Duration, error) {
+	reply, err := c.Do("TTL", key)
+	if err != nil {
+		return 0, err
+	}
+	seconds, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected TTL reply %v", reply)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
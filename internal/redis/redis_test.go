@@ -0,0 +1,183 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer speaks enough RESP for the client: GET, SET with EX, TTL and an error for anything else
+type fakeServer struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	values   map[string]string
+	expires  map[string]time.Time
+	now      time.Time // Moved by tests to expire keys
+}
+
+func startFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	s := &fakeServer{listener: listener, values: make(map[string]string), expires: make(map[string]time.Time), now: time.Unix(1760000000, 0)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) advance(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.now = s.now.Add(d)
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		reply, err := readReply(reader)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]interface{})
+		var args []string
+		for _, item := range items {
+			arg, _ := item.(string)
+			args = append(args, arg)
+		}
+		if _, err := conn.Write([]byte(s.handle(args))); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeServer) handle(args []string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(args) == 0 {
+		return "-ERR empty command\r\n"
+	}
+	key := ""
+	if len(args) > 1 {
+		key = args[1]
+		if expires, found := s.expires[key]; found && !s.now.Before(expires) {
+			delete(s.values, key)
+			delete(s.expires, key)
+		}
+	}
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		value, found := s.values[key]
+		if !found {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "SET":
+		if len(args) != 5 || strings.ToUpper(args[3]) != "EX" {
+			return "-ERR syntax error\r\n"
+		}
+		seconds, err := strconv.Atoi(args[4])
+		if err != nil || seconds <= 0 {
+			return "-ERR invalid expire time in 'set' command\r\n"
+		}
+		s.values[key] = args[2]
+		s.expires[key] = s.now.Add(time.Duration(seconds) * time.Second)
+		return "+OK\r\n"
+	case "TTL":
+		if _, found := s.values[key]; !found {
+			return ":-2\r\n"
+		}
+		return fmt.Sprintf(":%d\r\n", int64(s.expires[key].Sub(s.now)/time.Second))
+	}
+	return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+}
+
+func TestGetSetTTL(t *testing.T) {
+	server := startFakeServer(t)
+	client := New(server.listener.Addr().String(), time.Second)
+	defer client.Close()
+
+	if _, found, err := client.Get("dns:example.com."); err != nil || found {
+		t.Fatalf("Get of a missing key = found %v, %v", found, err)
+	}
+	if err := client.SetEX("dns:example.com.", "192.0.2.1", 300*time.Second); err != nil {
+		t.Fatalf("SetEX: %s", err)
+	}
+	if value, found, err := client.Get("dns:example.com."); err != nil || !found || value != "192.0.2.1" {
+		t.Errorf("Get = %q, %v, %v, want 192.0.2.1", value, found, err)
+	}
+	if ttl, err := client.TTL("dns:example.com."); err != nil || ttl != 300*time.Second {
+		t.Errorf("TTL = %s, %v, want 5m0s", ttl, err)
+	}
+
+	server.advance(200 * time.Second)
+	if ttl, err := client.TTL("dns:example.com."); err != nil || ttl != 100*time.Second {
+		t.Errorf("TTL after 200s = %s, %v, want 1m40s", ttl, err)
+	}
+	server.advance(100 * time.Second)
+	if _, found, err := client.Get("dns:example.com."); err != nil || found {
+		t.Errorf("Get after the TTL ran out = found %v, %v", found, err)
+	}
+	if ttl, err := client.TTL("dns:example.com."); err != nil || ttl >= 0 {
+		t.Errorf("TTL of an expired key = %s, %v, want negative", ttl, err)
+	}
+}
+
+func TestSetEXRoundsUpToOneSecond(t *testing.T) {
+	server := startFakeServer(t)
+	client := New(server.listener.Addr().String(), time.Second)
+	defer client.Close()
+	if err := client.SetEX("short", "value", 10*time.Millisecond); err != nil {
+		t.Fatalf("SetEX with a sub-second TTL: %s", err)
+	}
+	if ttl, err := client.TTL("short"); err != nil || ttl != time.Second {
+		t.Errorf("TTL = %s, %v, want 1s", ttl, err)
+	}
+}
+
+func TestErrorReplyKeepsConnection(t *testing.T) {
+	server := startFakeServer(t)
+	client := New(server.listener.Addr().String(), time.Second)
+	defer client.Close()
+	_, err := client.Do("NOSUCHCOMMAND")
+	if _, isReply := err.(Error); !isReply {
+		t.Fatalf("unknown command error = %v, want an Error reply", err)
+	}
+	conn := client.conn
+	if _, _, err := client.Get("key"); err != nil {
+		t.Fatalf("Get after an error reply: %s", err)
+	}
+	if client.conn != conn {
+		t.Error("connection was redialed after an error reply")
+	}
+}
+
+func TestRedialAfterConnectionLoss(t *testing.T) {
+	server := startFakeServer(t)
+	client := New(server.listener.Addr().String(), time.Second)
+	defer client.Close()
+	if err := client.SetEX("key", "value", time.Minute); err != nil {
+		t.Fatalf("SetEX: %s", err)
+	}
+	// The server side goes away, the first command fails and the next one dials again
+	client.conn.(*net.TCPConn).CloseRead()
+	client.Get("key")
+	if value, found, err := client.Get("key"); err != nil || !found || value != "value" {
+		t.Errorf("Get after redial = %q, %v, %v", value, found, err)
+	}
+}
@@ -0,0 +1,268 @@
+package rpz
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Action is what a matching rule does to the answer
+type Action int
+
+// Actions of RPZ rules, picked by the CNAME target or the records of the rule
+const (
+	ActionNXDOMAIN  Action = iota // CNAME . answers the name doesn't exist
+	ActionNODATA                  // CNAME *. answers the name has no records of the type
+	ActionPassthru                // CNAME rpz-passthru. resolves the name as usual
+	ActionDrop                    // CNAME rpz-drop. sends no answer at all
+	ActionLocalData               // Any other records are answered in place of the real ones
+)
+
+// Names of the actions, used in logs and metric labels
+var actionNames = map[Action]string{
+	ActionNXDOMAIN:  "nxdomain",
+	ActionNODATA:    "nodata",
+	ActionPassthru:  "passthru",
+	ActionDrop:      "drop",
+	ActionLocalData: "local_data",
+}
+
+// Function to get the name of an action
+func (a Action) String() string {
+	return actionNames[a]
+}
+
+// Rule is the policy for one trigger
+type Rule struct {
+	Action  Action
+	Records []dns.RR // Records answered for ActionLocalData
+}
+
+// Function to build the answer records of a local data rule for a question, renamed to the queried name.
+// A CNAME is answered for any type, otherwise only records of the asked type are
+func (r *Rule) Answer(name string, qtype uint16) []dns.RR {
+	var answer []dns.RR
+	for _, record := range r.Records {
+		if record.Header().Rrtype != qtype && record.Header().Rrtype != dns.TypeCNAME {
+			continue
+		}
+		rr := dns.Copy(record)
+		rr.Header().Name = name
+		answer = append(answer, rr)
+	}
+	return answer
+}
+
+// ipRule is a rule triggered by an address inside a network
+type ipRule struct {
+	network *net.IPNet
+	rule    *Rule
+}
+
+// Policy is a loaded response policy zone
+type Policy struct {
+	qnames    map[string]*Rule // Exact names to their rules
+	wildcards map[string]*Rule // Parents of *. triggers to their rules, covering names below them
+	ips       []ipRule         // Triggers on the addresses in the answer (rpz-ip)
+	clientIPs []ipRule         // Triggers on the address of the client (rpz-client-ip)
+}
+
+// Function to load a policy from an RPZ zone file
+func Load(path string) (*Policy, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Parse(file, path)
+}
+
+// Function to read a policy from an RPZ zone, the zone's origin is taken from its SOA record
+func Parse(r io.Reader, file string) (*Policy, error) {
+	parser := dns.NewZoneParser(r, ".", file)
+	var records []dns.RR
+	origin := ""
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		if soa, isSOA := rr.(*dns.SOA); isSOA && origin == "" {
+			origin = strings.ToLower(soa.Hdr.Name)
+			continue
+		}
+		records = append(records, rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	if origin == "" {
+		return nil, fmt.Errorf("%s has no SOA record", file)
+	}
+
+	// Every record with the same owner makes up one trigger's rule
+	rules := make(map[string]*Rule)
+	var owners []string
+	for _, rr := range records {
+		owner := strings.ToLower(rr.Header().Name)
+		if owner == origin || !dns.IsSubDomain(origin, owner) || rr.Header().Rrtype == dns.TypeNS {
+			continue
+		}
+		rule, found := rules[owner]
+		if !found {
+			rule = &Rule{Action: ActionLocalData}
+			rules[owner] = rule
+			owners = append(owners, owner)
+		}
+		if cname, isCNAME := rr.(*dns.CNAME); isCNAME {
+			switch strings.ToLower(cname.Target) {
+			case ".":
+				rule.Action = ActionNXDOMAIN
+				continue
+			case "*.":
+				rule.Action = ActionNODATA
+				continue
+			case "rpz-passthru.":
+				rule.Action = ActionPassthru
+				continue
+			case "rpz-drop.":
+				rule.Action = ActionDrop
+				continue
+			}
+		}
+		rule.Records = append(rule.Records, rr)
+	}
+
+	policy := &Policy{qnames: make(map[string]*Rule), wildcards: make(map[string]*Rule)}
+	for _, owner := range owners {
+		rule := rules[owner]
+		trigger := strings.TrimSuffix(strings.TrimSuffix(owner, origin), ".")
+		switch {
+		case strings.HasSuffix(trigger, ".rpz-ip"):
+			network, err := parseIPTrigger(strings.TrimSuffix(trigger, ".rpz-ip"))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %s", file, owner, err)
+			}
+			policy.ips = append(policy.ips, ipRule{network: network, rule: rule})
+		case strings.HasSuffix(trigger, ".rpz-client-ip"):
+			network, err := parseIPTrigger(strings.TrimSuffix(trigger, ".rpz-client-ip"))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %s", file, owner, err)
+			}
+			policy.clientIPs = append(policy.clientIPs, ipRule{network: network, rule: rule})
+		case strings.HasSuffix(trigger, ".rpz-nsdname"), strings.HasSuffix(trigger, ".rpz-nsip"):
+			// Name server triggers need the delegation path, which a forwarder never sees
+			continue
+		case strings.HasPrefix(trigger, "*."):
+			policy.wildcards[dns.Fqdn(strings.TrimPrefix(trigger, "*."))] = rule
+		default:
+			policy.qnames[dns.Fqdn(trigger)] = rule
+		}
+	}
+	return policy, nil
+}
+
+// Function to parse the owner of an IP trigger, the prefix length followed by the address labels
+// in reverse, with zz standing for the longest run of zero groups in IPv6 addresses
+func parseIPTrigger(trigger string) (*net.IPNet, error) {
+	labels := strings.Split(trigger, ".")
+	if len(labels) < 2 {
+		return nil, fmt.Errorf("invalid IP trigger %q", trigger)
+	}
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix length %q", labels[0])
+	}
+	parts := labels[1:]
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	address := strings.Join(parts, ".")
+	size := 32
+	// Without a zz, IPv6 triggers spell out all eight groups
+	if len(parts) != 4 || strings.Contains(trigger, "zz") {
+		for i, part := range parts {
+			if part == "zz" {
+				parts[i] = ""
+			}
+		}
+		address = strings.Join(parts, ":")
+		if strings.HasPrefix(address, ":") {
+			address = ":" + address
+		}
+		if strings.HasSuffix(address, ":") {
+			address += ":"
+		}
+		size = 128
+	}
+	ip := net.ParseIP(address)
+	if ip == nil || bits < 0 || bits > size {
+		return nil, fmt.Errorf("invalid IP trigger %q", trigger)
+	}
+	if size == 32 {
+		ip = ip.To4()
+	}
+	return &net.IPNet{IP: ip.Mask(net.CIDRMask(bits, size)), Mask: net.CIDRMask(bits, size)}, nil
+}
+
+// Function to find the rule for a queried name, exact triggers win over wildcards
+// and the closest wildcard wins
+func (p *Policy) MatchQName(name string) *Rule {
+	if p == nil {
+		return nil
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	if rule, found := p.qnames[name]; found {
+		return rule
+	}
+	// Wildcards only cover names below their parent, so start at the first parent
+	off, end := dns.NextLabel(name, 0)
+	for ; !end; off, end = dns.NextLabel(name, off) {
+		if rule, found := p.wildcards[name[off:]]; found {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Function to find the rule for an address in an answer, the most specific network wins
+func (p *Policy) MatchIP(ip net.IP) *Rule {
+	if p == nil {
+		return nil
+	}
+	return matchNetworks(p.ips, ip)
+}
+
+// Function to find the rule for the address of the client, the most specific network wins
+func (p *Policy) MatchClientIP(ip net.IP) *Rule {
+	if p == nil {
+		return nil
+	}
+	return matchNetworks(p.clientIPs, ip)
+}
+
+func matchNetworks(rules []ipRule, ip net.IP) *Rule {
+	if ip == nil {
+		return nil
+	}
+	var best *Rule
+	bestBits := -1
+	for _, candidate := range rules {
+		if !candidate.network.Contains(ip) {
+			continue
+		}
+		if bits, _ := candidate.network.Mask.Size(); bits > bestBits {
+			best, bestBits = candidate.rule, bits
+		}
+	}
+	return best
+}
+
+// Function to get the number of triggers in the policy
+func (p *Policy) Len() int {
+	if p == nil {
+		return 0
+	}
+	return len(p.qnames) + len(p.wildcards) + len(p.ips) + len(p.clientIPs)
+}
@@ -0,0 +1,120 @@
+package rpz
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testZone = `$TTL 300
+rpz.example. IN SOA ns.rpz.example. hostmaster.rpz.example. 1 3600 600 86400 300
+rpz.example. IN NS ns.rpz.example.
+gone.test.rpz.example. CNAME .
+empty.test.rpz.example. CNAME *.
+Allowed.Test.rpz.example. CNAME rpz-passthru.
+silent.test.rpz.example. CNAME rpz-drop.
+local.test.rpz.example. A 192.0.2.99
+local.test.rpz.example. TXT "walled garden"
+*.ads.test.rpz.example. CNAME .
+32.1.2.0.192.rpz-ip.rpz.example. CNAME .
+24.0.2.0.192.rpz-ip.rpz.example. CNAME *.
+24.0.113.0.203.rpz-client-ip.rpz.example. CNAME rpz-drop.
+`
+
+func TestParse(t *testing.T) {
+	policy, err := Parse(strings.NewReader(testZone), "test.rpz")
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if policy.Len() != 9 {
+		t.Errorf("Len = %d, want 9 triggers", policy.Len())
+	}
+	for _, test := range []struct {
+		name   string
+		action Action
+		found  bool
+	}{
+		{"gone.test.", ActionNXDOMAIN, true},
+		{"GONE.test", ActionNXDOMAIN, true},
+		{"empty.test.", ActionNODATA, true},
+		{"allowed.test.", ActionPassthru, true},
+		{"silent.test.", ActionDrop, true},
+		{"local.test.", ActionLocalData, true},
+		{"tracker.ads.test.", ActionNXDOMAIN, true},
+		{"a.b.ads.test.", ActionNXDOMAIN, true},
+		// The wildcard only covers names below its parent
+		{"ads.test.", 0, false},
+		{"other.test.", 0, false},
+	} {
+		rule := policy.MatchQName(test.name)
+		if (rule != nil) != test.found {
+			t.Errorf("MatchQName(%s) = %v, want a rule: %v", test.name, rule, test.found)
+			continue
+		}
+		if rule != nil && rule.Action != test.action {
+			t.Errorf("MatchQName(%s) action %s, want %s", test.name, rule.Action, test.action)
+		}
+	}
+
+	// Local data answers with the records of the asked type, renamed to the query
+	answer := policy.MatchQName("local.test.").Answer("local.test.", dns.TypeA)
+	if len(answer) != 1 || answer[0].(*dns.A).A.String() != "192.0.2.99" {
+		t.Errorf("local data A answer = %v", answer)
+	}
+
+	// The most specific network wins
+	if rule := policy.MatchIP(net.ParseIP("192.0.2.1")); rule == nil || rule.Action != ActionNXDOMAIN {
+		t.Errorf("MatchIP(192.0.2.1) = %v, want the /32 rule", rule)
+	}
+	if rule := policy.MatchIP(net.ParseIP("192.0.2.2")); rule == nil || rule.Action != ActionNODATA {
+		t.Errorf("MatchIP(192.0.2.2) = %v, want the /24 rule", rule)
+	}
+	if rule := policy.MatchIP(net.ParseIP("198.51.100.1")); rule != nil {
+		t.Errorf("MatchIP(198.51.100.1) = %v, want none", rule)
+	}
+	if rule := policy.MatchClientIP(net.ParseIP("203.0.113.50")); rule == nil || rule.Action != ActionDrop {
+		t.Errorf("MatchClientIP(203.0.113.50) = %v, want the drop rule", rule)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, zone := range []string{
+		// No SOA to take the origin from
+		"gone.test.rpz.example. 300 IN CNAME .\n",
+		// An IP trigger that isn't an address
+		"rpz.example. 300 IN SOA ns. h. 1 1 1 1 1\n32.x.2.0.192.rpz-ip.rpz.example. 300 IN CNAME .\n",
+	} {
+		if _, err := Parse(strings.NewReader(zone), "bad.rpz"); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", zone)
+		}
+	}
+}
+
+func TestParseIPTrigger(t *testing.T) {
+	for _, test := range []struct {
+		trigger, want string
+	}{
+		{"32.1.2.0.192", "192.0.2.1/32"},
+		{"24.0.2.0.192", "192.0.2.0/24"},
+		{"24.99.2.0.192", "192.0.2.0/24"},
+		{"128.1.zz.db8.2001", "2001:db8::1/128"},
+		{"48.zz.1.db8.2001", "2001:db8:1::/48"},
+		{"128.8.7.6.5.4.3.2.1", "1:2:3:4:5:6:7:8/128"},
+	} {
+		network, err := parseIPTrigger(test.trigger)
+		if err != nil {
+			t.Errorf("parseIPTrigger(%s): %s", test.trigger, err)
+			continue
+		}
+		if network.String() != test.want {
+			t.Errorf("parseIPTrigger(%s) = %s, want %s", test.trigger, network, test.want)
+		}
+	}
+	for _, trigger := range []string{"32", "x.1.2.0.192", "33.1.2.0.192", "129.1.zz.db8.2001", "32.1.2.0.300"} {
+		if network, err := parseIPTrigger(trigger); err == nil {
+			t.Errorf("parseIPTrigger(%s) = %s, want an error", trigger, network)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package schedule
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// window is a range of minutes after midnight on a set of weekdays, an end before the start
+// runs past midnight into the next day
+type window struct {
+	days       [7]bool // Indexed by time.Weekday
+	start, end int
+}
+
+// Function to check if a time falls inside the window
+func (w window) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	if w.start <= w.end {
+		return w.days[today] && minute >= w.start && minute < w.end
+	}
+	// The part before midnight belongs to today, the part after it to the day before
+	yesterday := (today + 6) % 7
+	return (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+// Rules maps domains to the time windows they are allowed in, a rule also covers every
+// subdomain below it and the closest rule wins
+type Rules struct {
+	domains map[string][]window
+}
+
+// Function to load rules from a file
+func Load(path string) (*Rules, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Parse(file, path)
+}
+
+// Function to read rules from r, one per line as a domain followed by windows such as
+// "mon-fri 08:00-18:00" or "sat,sun 10:00-12:00,14:00-16:00". Several lines for a domain add up
+func Parse(r io.Reader, file string) (*Rules, error) {
+	rules := &Rules{domains: make(map[string][]window)}
+	scanner := bufio.NewScanner(r)
+	for number := 1; scanner.Scan(); number++ {
+		line := scanner.Text()
+		// Drop comments
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 || len(fields)%2 == 0 {
+			return nil, fmt.Errorf("%s:%d: expected a domain followed by days and times", file, number)
+		}
+		domain := dns.Fqdn(strings.TrimPrefix(strings.ToLower(fields[0]), "*."))
+		for i := 1; i < len(fields); i += 2 {
+			days, err := parseDays(fields[i])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", file, number, err)
+			}
+			for _, span := range strings.Split(fields[i+1], ",") {
+				start, end, err := parseSpan(span)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %s", file, number, err)
+				}
+				rules.domains[domain] = append(rules.domains[domain], window{days: days, start: start, end: end})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Short names of the weekdays, in time.Weekday order
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Function to parse a comma separated list of days and day ranges, "*" is every day
+func parseDays(value string) ([7]bool, error) {
+	var days [7]bool
+	if value == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return days, nil
+	}
+	for _, part := range strings.Split(strings.ToLower(value), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from, err := parseDay(first)
+		if err != nil {
+			return days, err
+		}
+		to := from
+		if isRange {
+			if to, err = parseDay(last); err != nil {
+				return days, err
+			}
+		}
+		// Ranges wrap around the week, so fri-mon covers the weekend
+		for day := from; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseDay(name string) (int, error) {
+	for i, day := range dayNames {
+		if name == day {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q, expected one of %s", name, strings.Join(dayNames, ","))
+}
+
+// Function to parse a HH:MM-HH:MM span into minutes after midnight, 24:00 is accepted as an end
+func parseSpan(span string) (int, int, error) {
+	first, last, found := strings.Cut(span, "-")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid time range %q, expected HH:MM-HH:MM", span)
+	}
+	start, err := parseClock(first)
+	if err != nil || start == 24*60 {
+		return 0, 0, fmt.Errorf("invalid time range %q, expected HH:MM-HH:MM", span)
+	}
+	end, err := parseClock(last)
+	if err != nil || start == end {
+		return 0, 0, fmt.Errorf("invalid time range %q, expected HH:MM-HH:MM", span)
+	}
+	return start, end, nil
+}
+
+func parseClock(value string) (int, error) {
+	var hour, minute int
+	if _, err := fmt.Sscanf(value, "%d:%d", &hour, &minute); err != nil {
+		return 0, err
+	}
+	if hour < 0 || minute < 0 || minute > 59 || hour > 24 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return hour*60 + minute, nil
+}
+
+// Function to check if a name is outside every window of its closest rule at a time,
+// names without a rule are never blocked
+func (r *Rules) Blocked(name string, now time.Time) bool {
+	if r == nil {
+		return false
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		windows, found := r.domains[name[off:]]
+		if !found {
+			continue
+		}
+		for _, w := range windows {
+			if w.contains(now) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Function to get the number of domains with rules
+func (r *Rules) Len() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.domains)
+}
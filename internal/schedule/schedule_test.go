@@ -0,0 +1,109 @@
+package schedule
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Function to get a time on the given weekday of the week of 2026-10-12, a Monday
+func at(day time.Weekday, hour, minute int) time.Time {
+	offset := (int(day) + 6) % 7
+	return time.Date(2026, 10, 12+offset, hour, minute, 0, 0, time.UTC)
+}
+
+func TestWindowContainsAcrossMidnight(t *testing.T) {
+	// Friday 22:00 until Saturday 02:00
+	w := window{start: 22 * 60, end: 2 * 60}
+	w.days[time.Friday] = true
+	for _, test := range []struct {
+		t    time.Time
+		want bool
+	}{
+		{at(time.Friday, 21, 59), false},
+		{at(time.Friday, 22, 0), true},
+		{at(time.Friday, 23, 59), true},
+		{at(time.Saturday, 0, 0), true},
+		{at(time.Saturday, 1, 59), true},
+		{at(time.Saturday, 2, 0), false},
+		// The early hours of Friday belong to Thursday's window, which isn't set
+		{at(time.Friday, 1, 0), false},
+		{at(time.Saturday, 23, 0), false},
+	} {
+		if got := w.contains(test.t); got != test.want {
+			t.Errorf("contains(%s) = %v, want %v", test.t.Format("Mon 15:04"), got, test.want)
+		}
+	}
+}
+
+func TestWindowContainsSameDay(t *testing.T) {
+	w := window{start: 8 * 60, end: 18 * 60}
+	for day := time.Monday; day <= time.Friday; day++ {
+		w.days[day] = true
+	}
+	for _, test := range []struct {
+		t    time.Time
+		want bool
+	}{
+		{at(time.Monday, 8, 0), true},
+		{at(time.Wednesday, 17, 59), true},
+		{at(time.Wednesday, 18, 0), false},
+		{at(time.Tuesday, 7, 59), false},
+		{at(time.Saturday, 12, 0), false},
+	} {
+		if got := w.contains(test.t); got != test.want {
+			t.Errorf("contains(%s) = %v, want %v", test.t.Format("Mon 15:04"), got, test.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	rules, err := Parse(strings.NewReader(`
+# Games only in the evening and at the weekend
+*.Games.Example mon-fri 17:00-21:00
+games.example   sat,sun 10:00-12:00,14:00-24:00
+late.example    fri-mon 22:00-02:00 # wraps past midnight and around the week
+`), "test.schedule")
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	if rules.Len() != 2 {
+		t.Errorf("Len = %d, want 2 domains", rules.Len())
+	}
+	for _, test := range []struct {
+		name    string
+		t       time.Time
+		blocked bool
+	}{
+		{"games.example", at(time.Monday, 18, 0), false},
+		{"play.GAMES.example.", at(time.Monday, 18, 0), false},
+		{"games.example", at(time.Monday, 10, 0), true},
+		{"games.example", at(time.Sunday, 11, 0), false},
+		{"games.example", at(time.Sunday, 13, 0), true},
+		{"games.example", at(time.Sunday, 23, 59), false},
+		{"late.example", at(time.Tuesday, 1, 0), false},
+		{"late.example", at(time.Tuesday, 23, 0), true},
+		{"unlisted.example", at(time.Monday, 3, 0), false},
+	} {
+		if got := rules.Blocked(test.name, test.t); got != test.blocked {
+			t.Errorf("Blocked(%s, %s) = %v, want %v", test.name, test.t.Format("Mon 15:04"), got, test.blocked)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, line := range []string{
+		"games.example",
+		"games.example mon-fri",
+		"games.example someday 10:00-12:00",
+		"games.example mon 10:00",
+		"games.example mon 10:00-10:00",
+		"games.example mon 24:00-02:00",
+		"games.example mon 10:00-25:00",
+		"games.example mon 10:60-11:00",
+	} {
+		if _, err := Parse(strings.NewReader(line), "bad.schedule"); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", line)
+		}
+	}
+}